@@ -0,0 +1,73 @@
+package cache
+
+import (
+	"context"
+	"encoding/json"
+	"strconv"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// write stores an encoded value, recording its store time when TrackAge is on
+func (r *RedisCache) write(ctx context.Context, key string, value interface{}, ttl time.Duration) error {
+	ttl, err := r.resolveTTL(ttl)
+	if err != nil {
+		return err
+	}
+	if !ttlJittered(ctx) {
+		ttl = jitterTTL(ttl, r.ttlJitter)
+	}
+
+	if !r.trackAge {
+		return r.client.Set(ctx, r.key(key), value, ttl).Err()
+	}
+
+	pipe := r.client.TxPipeline()
+	pipe.Set(ctx, r.key(key), value, ttl)
+	pipe.Set(ctx, r.metaKey(key), time.Now().UnixMilli(), ttl)
+	_, err = pipe.Exec(ctx)
+	return err
+}
+
+// GetWithAge retrieves a value along with how long ago it was stored.
+// The age is only known for values written while TrackAge is on; it is 0 otherwise.
+func (r *RedisCache) GetWithAge(key string, dest interface{}) (time.Duration, error) {
+	pipe := r.client.Pipeline()
+	valueCmd := pipe.Get(r.ctx, r.key(key))
+	storedCmd := pipe.Get(r.ctx, r.metaKey(key))
+	if _, err := pipe.Exec(r.ctx); err != nil && err != redis.Nil {
+		return 0, err
+	}
+
+	data, err := valueCmd.Bytes()
+	if err == redis.Nil {
+		return 0, ErrCacheMiss
+	}
+	if err != nil {
+		return 0, err
+	}
+
+	if isNegative(data) {
+		return 0, ErrNotFound
+	}
+	if err := json.Unmarshal(data, dest); err != nil {
+		return 0, err
+	}
+
+	storedAt, err := strconv.ParseInt(storedCmd.Val(), 10, 64)
+	if err != nil {
+		return 0, nil
+	}
+	return time.Since(time.UnixMilli(storedAt)), nil
+}
+
+// ageKeyPrefix starts the keys holding store times. They live outside the
+// cache prefix, like tag keys, so Scan and Clear's key listing never mistake
+// them for cached items.
+const ageKeyPrefix = "age:"
+
+// metaKey returns the Redis key holding a value's store time
+func (r *RedisCache) metaKey(key string) string {
+	return ageKeyPrefix + r.key(key)
+}
@@ -0,0 +1,57 @@
+package cache
+
+import (
+	"sort"
+	"testing"
+	"time"
+)
+
+func TestTrackAgeKeysStayOutOfScan(t *testing.T) {
+	c, server := newTestRedisCache(t, RedisConfig{TrackAge: true})
+
+	for _, key := range []string{"a", "b", "meta:c"} {
+		if err := c.Tags("t").Set(key, key, time.Minute); err != nil {
+			t.Fatalf("Set: %v", err)
+		}
+	}
+
+	keys := scanKeys(t, c, "*")
+	sort.Strings(keys)
+	if len(keys) != 3 || keys[0] != "a" || keys[1] != "b" || keys[2] != "meta:c" {
+		t.Errorf("Scan = %v, want [a b meta:c]", keys)
+	}
+
+	var value string
+	age, err := c.GetWithAge("a", &value)
+	if err != nil {
+		t.Fatalf("GetWithAge: %v", err)
+	}
+	if value != "a" || age < 0 || age > time.Second {
+		t.Errorf("GetWithAge = %q, %v", value, age)
+	}
+
+	// Deleting a value removes its age key too
+	if err := c.Delete("a"); err != nil {
+		t.Fatalf("Delete: %v", err)
+	}
+	if server.Exists("age:cache:a") {
+		t.Error("Delete left the age key behind")
+	}
+
+	if err := c.Tags("t").Flush(); err != nil {
+		t.Fatalf("Flush: %v", err)
+	}
+	if keys := server.Keys(); len(keys) != 0 {
+		t.Errorf("keys left after tag Flush: %v", keys)
+	}
+
+	if err := c.Set("d", "d", time.Minute); err != nil {
+		t.Fatalf("Set: %v", err)
+	}
+	if err := c.Clear(); err != nil {
+		t.Fatalf("Clear: %v", err)
+	}
+	if keys := server.Keys(); len(keys) != 0 {
+		t.Errorf("keys left after Clear: %v", keys)
+	}
+}
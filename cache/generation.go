@@ -0,0 +1,101 @@
+package cache
+
+import (
+	"errors"
+	"log"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// generation tracks the current key generation of a cache prefix, stored in
+// Redis so every instance agrees, and re-read at most once per refresh
+type generation struct {
+	key     string // Redis key holding the generation counter
+	refresh time.Duration
+
+	mu      sync.Mutex
+	value   int64
+	fetched time.Time
+}
+
+// newGeneration returns the generation tracker for prefix, or nil when
+// generations are off
+func newGeneration(prefix string, enabled bool, refresh time.Duration) *generation {
+	if !enabled {
+		return nil
+	}
+	if refresh <= 0 {
+		refresh = time.Second
+	}
+	return &generation{key: prefix + "generation", refresh: refresh}
+}
+
+// keyPrefix returns the prefix of every data key: the cache prefix, followed
+// by the current generation when generations are on
+func (r *RedisCache) keyPrefix() string {
+	if r.generation == nil {
+		return r.prefix
+	}
+	return r.prefix + "g" + strconv.FormatInt(r.generation.current(r), 10) + ":"
+}
+
+// key returns the full Redis key of a data key
+func (r *RedisCache) key(key string) string {
+	return r.keyPrefix() + key
+}
+
+// current returns the generation, re-reading it from Redis once it is older
+// than refresh. If Redis can't be read, the last known generation is kept.
+func (g *generation) current(r *RedisCache) int64 {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	if time.Since(g.fetched) < g.refresh {
+		return g.value
+	}
+
+	// Failed reads also wait for the next refresh, so an outage doesn't add
+	// a round-trip and a log line to every command
+	g.fetched = time.Now()
+	value, err := r.client.Get(r.ctx, g.key).Int64()
+	if err != nil && err != redis.Nil {
+		log.Printf("cache: reading generation %q: %v", g.key, err)
+		return g.value
+	}
+	g.value = value
+	return g.value
+}
+
+// ClearLazy invalidates every cached item at once by moving the cache to a
+// new key generation, which takes a single INCR however many keys there are.
+// Items of older generations become unreachable and are left for their TTL to
+// remove. Other instances switch over within GenerationRefresh. It requires
+// RedisConfig.Generations.
+func (r *RedisCache) ClearLazy() error {
+	if r.generation == nil {
+		return errors.New("cache generations are not enabled")
+	}
+
+	value, err := r.client.Incr(r.ctx, r.generation.key).Result()
+	if err != nil {
+		return err
+	}
+
+	g := r.generation
+	g.mu.Lock()
+	g.value, g.fetched = value, time.Now()
+	g.mu.Unlock()
+	return nil
+}
+
+// forPrefix returns the generation tracker of a WithPrefix view, which has a
+// generation of its own
+func (g *generation) forPrefix(prefix string) *generation {
+	if g == nil {
+		return nil
+	}
+	return newGeneration(prefix, true, g.refresh)
+}
@@ -0,0 +1,91 @@
+package cache
+
+import (
+	"encoding/json"
+	"errors"
+
+	"github.com/redis/go-redis/v9"
+)
+
+var (
+	// ErrAlreadySubscribed is returned when an invalidation subscriber is already running
+	ErrAlreadySubscribed = errors.New("invalidation subscriber already running")
+)
+
+// InvalidationHandler is called with the keys named in an invalidation message
+type InvalidationHandler func(keys []string)
+
+// invalidationSubscriber is a running Pub/Sub subscription
+type invalidationSubscriber struct {
+	pubsub *redis.PubSub
+	done   chan struct{}
+}
+
+// PublishInvalidation announces that keys changed so other nodes can drop local copies
+func (r *RedisCache) PublishInvalidation(keys ...string) error {
+	if len(keys) == 0 {
+		return nil
+	}
+
+	data, err := json.Marshal(keys)
+	if err != nil {
+		return err
+	}
+
+	return r.client.Publish(r.ctx, r.invalidationChannel, data).Err()
+}
+
+// SubscribeInvalidations starts a background subscriber that calls handler for
+// every invalidation message, including ones published by this node.
+// The subscriber runs until StopInvalidations or Close is called.
+func (r *RedisCache) SubscribeInvalidations(handler InvalidationHandler) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.subscriber != nil {
+		return ErrAlreadySubscribed
+	}
+
+	pubsub := r.client.Subscribe(r.ctx, r.invalidationChannel)
+
+	// Wait for the subscription to be confirmed
+	if _, err := pubsub.Receive(r.ctx); err != nil {
+		pubsub.Close()
+		return err
+	}
+
+	sub := &invalidationSubscriber{
+		pubsub: pubsub,
+		done:   make(chan struct{}),
+	}
+	r.subscriber = sub
+
+	go func() {
+		defer close(sub.done)
+		for msg := range pubsub.Channel() {
+			var keys []string
+			if err := json.Unmarshal([]byte(msg.Payload), &keys); err != nil {
+				continue
+			}
+			handler(keys)
+		}
+	}()
+
+	return nil
+}
+
+// StopInvalidations stops the invalidation subscriber if one is running
+func (r *RedisCache) StopInvalidations() error {
+	r.mu.Lock()
+	sub := r.subscriber
+	r.subscriber = nil
+	r.mu.Unlock()
+
+	if sub == nil {
+		return nil
+	}
+
+	err := sub.pubsub.Close()
+	<-sub.done
+	return err
+}
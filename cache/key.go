@@ -0,0 +1,37 @@
+package cache
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"strings"
+)
+
+// keyPartEscaper escapes the separator inside key parts, and the escape
+// character itself, so different part lists never build the same key
+var keyPartEscaper = strings.NewReplacer("%", "%25", ":", "%3A")
+
+// CacheKey builds a readable key from parts joined with ":", for callers
+// outside HTTP handlers such as background jobs. A ":" or "%" inside a part
+// is percent-encoded, so CacheKey("a:b", "c") and CacheKey("a", "b:c") differ.
+func CacheKey(parts ...string) string {
+	escaped := make([]string, len(parts))
+	for i, part := range parts {
+		escaped[i] = keyPartEscaper.Replace(part)
+	}
+	return strings.Join(escaped, ":")
+}
+
+// HashKey builds a fixed-length key from arbitrary values, e.g. a request
+// struct. The values are JSON-encoded as one array, which sorts map keys, and
+// the key is the hex SHA-256 of that encoding. Values that encode to the same
+// JSON share a key.
+func HashKey(values ...interface{}) (string, error) {
+	data, err := json.Marshal(values)
+	if err != nil {
+		return "", err
+	}
+
+	hash := sha256.Sum256(data)
+	return hex.EncodeToString(hash[:]), nil
+}
@@ -0,0 +1,110 @@
+package cache
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// lockPollInterval is how often RememberLocked checks for a value loaded by another process
+const lockPollInterval = 50 * time.Millisecond
+
+var (
+	// ErrLockNotHeld is returned when unlocking a lock that expired or is owned by someone else
+	ErrLockNotHeld = errors.New("lock not held")
+)
+
+// unlockScript deletes the lock key only if it still holds our token
+var unlockScript = redis.NewScript(`
+if redis.call("GET", KEYS[1]) == ARGV[1] then
+	return redis.call("DEL", KEYS[1])
+end
+return 0
+`)
+
+// Lock tries to acquire a distributed lock for ttl.
+// This is a single-instance lock (SET NX PX), not Redlock: it is only as
+// available as the one Redis server behind this cache.
+func (r *RedisCache) Lock(key string, ttl time.Duration) (string, bool, error) {
+	token, err := generateLockToken()
+	if err != nil {
+		return "", false, err
+	}
+
+	acquired, err := r.client.SetNX(r.ctx, r.lockKey(key), token, ttl).Result()
+	if err != nil {
+		return "", false, err
+	}
+	if !acquired {
+		return "", false, nil
+	}
+
+	return token, true, nil
+}
+
+// Unlock releases a lock acquired with Lock if token still owns it
+func (r *RedisCache) Unlock(key, token string) error {
+	deleted, err := unlockScript.Run(r.ctx, r.client, []string{r.lockKey(key)}, token).Int()
+	if err != nil {
+		return err
+	}
+	if deleted == 0 {
+		return ErrLockNotHeld
+	}
+	return nil
+}
+
+// RememberLocked is like Remember, but a cross-process lock held for at most
+// lockTTL makes sure only one process runs fn for a cold key. The others poll
+// the cache until the value shows up, and run fn themselves if it hasn't
+// within lockTTL, so a crashed or slow lock holder only delays them.
+func (r *RedisCache) RememberLocked(key string, ttl, lockTTL time.Duration, fn func() (interface{}, error), dest interface{}) error {
+	lockName := "remember:" + key
+	deadline := time.Now().Add(lockTTL)
+
+	for {
+		err := r.Get(key, dest)
+		if err != ErrCacheMiss {
+			return err
+		}
+
+		token, acquired, err := r.Lock(lockName, lockTTL)
+		if err != nil {
+			return err
+		}
+		if acquired {
+			// The lock may have expired already if fn outlived lockTTL
+			defer r.Unlock(lockName, token)
+			return r.Remember(key, ttl, fn, dest)
+		}
+
+		if time.Now().After(deadline) {
+			break
+		}
+		time.Sleep(lockPollInterval)
+	}
+
+	// Give up waiting and load locally
+	return r.Remember(key, ttl, fn, dest)
+}
+
+// lockKeyPrefix starts the keys holding locks. Like age keys they live
+// outside the cache prefix, so Clear and Scan leave held locks alone.
+const lockKeyPrefix = "lock:"
+
+// lockKey returns the Redis key used for a lock
+func (r *RedisCache) lockKey(key string) string {
+	return lockKeyPrefix + r.prefix + key
+}
+
+// generateLockToken generates a random lock owner token
+func generateLockToken() (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
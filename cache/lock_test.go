@@ -0,0 +1,89 @@
+package cache
+
+import (
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestLockIsExclusive(t *testing.T) {
+	c, _ := newTestRedisCache(t, RedisConfig{})
+
+	// Many callers race for the same lock, exactly one may win
+	const callers = 20
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	var tokens []string
+	for i := 0; i < callers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			token, acquired, err := c.Lock("job", time.Minute)
+			if err != nil {
+				t.Errorf("Lock: %v", err)
+				return
+			}
+			if acquired {
+				mu.Lock()
+				tokens = append(tokens, token)
+				mu.Unlock()
+			}
+		}()
+	}
+	wg.Wait()
+
+	if len(tokens) != 1 {
+		t.Fatalf("%d callers acquired the lock, want 1", len(tokens))
+	}
+
+	// Only the owner can release it, after which it can be taken again
+	if err := c.Unlock("job", "not-the-token"); err != ErrLockNotHeld {
+		t.Errorf("Unlock with a foreign token = %v, want ErrLockNotHeld", err)
+	}
+	if _, acquired, _ := c.Lock("job", time.Minute); acquired {
+		t.Error("lock acquired while still held")
+	}
+	if err := c.Unlock("job", tokens[0]); err != nil {
+		t.Fatalf("Unlock: %v", err)
+	}
+	if _, acquired, err := c.Lock("job", time.Minute); err != nil || !acquired {
+		t.Errorf("Lock after Unlock = %v, %v; want acquired", acquired, err)
+	}
+}
+
+func TestLockExpires(t *testing.T) {
+	c, server := newTestRedisCache(t, RedisConfig{})
+
+	token, acquired, err := c.Lock("job", time.Second)
+	if err != nil || !acquired {
+		t.Fatalf("Lock = %v, %v; want acquired", acquired, err)
+	}
+	server.FastForward(2 * time.Second)
+
+	if _, acquired, _ := c.Lock("job", time.Second); !acquired {
+		t.Error("expired lock was not released")
+	}
+	// The first owner's token no longer releases the lock
+	if err := c.Unlock("job", token); err != ErrLockNotHeld {
+		t.Errorf("Unlock with an expired token = %v, want ErrLockNotHeld", err)
+	}
+}
+
+func TestClearKeepsLocks(t *testing.T) {
+	c, _ := newTestRedisCache(t, RedisConfig{})
+
+	token, acquired, err := c.Lock("job", time.Minute)
+	if err != nil || !acquired {
+		t.Fatalf("Lock = %v, %v; want acquired", acquired, err)
+	}
+	if err := c.Clear(); err != nil {
+		t.Fatalf("Clear: %v", err)
+	}
+
+	if _, acquired, _ := c.Lock("job", time.Minute); acquired {
+		t.Error("lock acquired after Clear while still held")
+	}
+	if err := c.Unlock("job", token); err != nil {
+		t.Errorf("Unlock after Clear: %v", err)
+	}
+}
@@ -0,0 +1,296 @@
+package cache
+
+import (
+	"encoding/json"
+	"fmt"
+	"hash/fnv"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// MemoryCache implements an in-process cache with the same semantics as
+// RedisCache: values are stored JSON-encoded, so Get hands out copies, and
+// expire after their TTL. Keys are spread over independently locked shards
+// so concurrent requests rarely contend.
+type MemoryCache struct {
+	shards     []*memoryShard
+	defaultTTL time.Duration
+	stopCh     chan struct{}
+	closeOnce  sync.Once
+}
+
+// memoryShard is one independently locked part of a MemoryCache
+type memoryShard struct {
+	mu    sync.RWMutex
+	items map[string]memoryEntry
+}
+
+// memoryEntry is a stored value and when it expires (zero for never)
+type memoryEntry struct {
+	data      []byte
+	expiresAt time.Time
+}
+
+// expired reports whether the entry is past its TTL at now
+func (e memoryEntry) expired(now time.Time) bool {
+	return !e.expiresAt.IsZero() && now.After(e.expiresAt)
+}
+
+// MemoryConfig holds in-memory cache configuration
+type MemoryConfig struct {
+	CleanupInterval time.Duration // How often expired entries are removed (0 = only on access)
+	Shards          int           // Number of independently locked shards (default 16)
+
+	// DefaultTTL is used for writes given a TTL of DefaultExpiration (default NoExpiration)
+	DefaultTTL time.Duration
+}
+
+// NewMemoryCache creates a new in-memory cache
+func NewMemoryCache(cleanupInterval time.Duration) *MemoryCache {
+	return NewMemoryCacheWithConfig(MemoryConfig{
+		CleanupInterval: cleanupInterval,
+	})
+}
+
+// NewMemoryCacheWithConfig creates a new in-memory cache from a config
+func NewMemoryCacheWithConfig(config MemoryConfig) *MemoryCache {
+	if config.Shards <= 0 {
+		config.Shards = 16
+	}
+
+	cache := &MemoryCache{
+		shards:     make([]*memoryShard, config.Shards),
+		defaultTTL: config.DefaultTTL,
+		stopCh:     make(chan struct{}),
+	}
+	for i := range cache.shards {
+		cache.shards[i] = &memoryShard{items: make(map[string]memoryEntry)}
+	}
+
+	// Start cleanup goroutine
+	if config.CleanupInterval > 0 {
+		go cache.startCleanup(config.CleanupInterval)
+	}
+
+	return cache
+}
+
+// shard returns the shard holding key
+func (m *MemoryCache) shard(key string) *memoryShard {
+	h := fnv.New32a()
+	h.Write([]byte(key))
+	return m.shards[h.Sum32()%uint32(len(m.shards))]
+}
+
+// expiresAt resolves ttl like RedisCache and returns the resulting expiry time
+func (m *MemoryCache) expiresAt(ttl time.Duration) (time.Time, error) {
+	switch {
+	case ttl == DefaultExpiration:
+		ttl = m.defaultTTL
+	case ttl == permanentTTL:
+		ttl = NoExpiration
+	case ttl < 0:
+		return time.Time{}, fmt.Errorf("%w: %v", ErrInvalidTTL, ttl)
+	}
+
+	if ttl == NoExpiration {
+		return time.Time{}, nil
+	}
+	return time.Now().Add(ttl), nil
+}
+
+// Get retrieves a value from cache
+func (m *MemoryCache) Get(key string, dest interface{}) error {
+	s := m.shard(key)
+
+	s.mu.RLock()
+	entry, ok := s.items[key]
+	s.mu.RUnlock()
+
+	if !ok || entry.expired(time.Now()) {
+		return ErrCacheMiss
+	}
+
+	return json.Unmarshal(entry.data, dest)
+}
+
+// Set stores a value in cache. TTLs behave as for RedisCache.Set.
+func (m *MemoryCache) Set(key string, value interface{}, ttl time.Duration) error {
+	data, err := json.Marshal(value)
+	if err != nil {
+		return err
+	}
+
+	expiresAt, err := m.expiresAt(ttl)
+	if err != nil {
+		return err
+	}
+
+	s := m.shard(key)
+	s.mu.Lock()
+	s.items[key] = memoryEntry{data: data, expiresAt: expiresAt}
+	s.mu.Unlock()
+
+	return nil
+}
+
+// Delete removes a value from cache
+func (m *MemoryCache) Delete(key string) error {
+	return m.DeleteMany(key)
+}
+
+// DeleteMany removes multiple keys from cache
+func (m *MemoryCache) DeleteMany(keys ...string) error {
+	for _, key := range keys {
+		s := m.shard(key)
+		s.mu.Lock()
+		delete(s.items, key)
+		s.mu.Unlock()
+	}
+	return nil
+}
+
+// Exists checks if a key exists
+func (m *MemoryCache) Exists(key string) (bool, error) {
+	s := m.shard(key)
+
+	s.mu.RLock()
+	entry, ok := s.items[key]
+	s.mu.RUnlock()
+
+	return ok && !entry.expired(time.Now()), nil
+}
+
+// ExistsMany reports which of keys exist. Every key is present in the result.
+func (m *MemoryCache) ExistsMany(keys ...string) (map[string]bool, error) {
+	found := make(map[string]bool, len(keys))
+	for _, key := range keys {
+		found[key], _ = m.Exists(key)
+	}
+	return found, nil
+}
+
+// Clear removes all cached items
+func (m *MemoryCache) Clear() error {
+	for _, s := range m.shards {
+		s.mu.Lock()
+		s.items = make(map[string]memoryEntry)
+		s.mu.Unlock()
+	}
+	return nil
+}
+
+// Len returns the number of stored entries, including expired ones not yet cleaned up
+func (m *MemoryCache) Len() int {
+	n := 0
+	for _, s := range m.shards {
+		s.mu.RLock()
+		n += len(s.items)
+		s.mu.RUnlock()
+	}
+	return n
+}
+
+// Increment increments a numeric value
+func (m *MemoryCache) Increment(key string) (int64, error) {
+	return m.IncrementBy(key, 1)
+}
+
+// Decrement decrements a numeric value
+func (m *MemoryCache) Decrement(key string) (int64, error) {
+	return m.IncrementBy(key, -1)
+}
+
+// IncrementBy increments by a specific amount. Like Redis INCRBY, a missing
+// key starts at 0 without expiry and an existing key keeps its TTL.
+func (m *MemoryCache) IncrementBy(key string, value int64) (int64, error) {
+	s := m.shard(key)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	entry, ok := s.items[key]
+	if !ok || entry.expired(time.Now()) {
+		entry = memoryEntry{}
+	}
+
+	var current int64
+	if entry.data != nil {
+		var err error
+		current, err = strconv.ParseInt(string(entry.data), 10, 64)
+		if err != nil {
+			return 0, fmt.Errorf("cache: value of %q is not an integer", key)
+		}
+	}
+
+	current += value
+	entry.data = []byte(strconv.FormatInt(current, 10))
+	s.items[key] = entry
+
+	return current, nil
+}
+
+// Remember retrieves from cache or executes a function and stores the result
+func (m *MemoryCache) Remember(key string, ttl time.Duration, fn func() (interface{}, error), dest interface{}) error {
+	err := m.Get(key, dest)
+	if err != ErrCacheMiss {
+		return err
+	}
+
+	value, err := fn()
+	if err != nil {
+		return err
+	}
+
+	if err := m.Set(key, value, ttl); err != nil {
+		return err
+	}
+
+	// Marshal and unmarshal to populate dest
+	data, err := json.Marshal(value)
+	if err != nil {
+		return err
+	}
+
+	return json.Unmarshal(data, dest)
+}
+
+// CleanupExpired removes expired entries and returns how many were removed
+func (m *MemoryCache) CleanupExpired() int {
+	now := time.Now()
+	removed := 0
+	for _, s := range m.shards {
+		s.mu.Lock()
+		for key, entry := range s.items {
+			if entry.expired(now) {
+				delete(s.items, key)
+				removed++
+			}
+		}
+		s.mu.Unlock()
+	}
+	return removed
+}
+
+// startCleanup runs periodic cleanup
+func (m *MemoryCache) startCleanup(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			m.CleanupExpired()
+		case <-m.stopCh:
+			return
+		}
+	}
+}
+
+// Close stops the cleanup goroutine
+func (m *MemoryCache) Close() error {
+	m.closeOnce.Do(func() {
+		close(m.stopCh)
+	})
+	return nil
+}
@@ -1,10 +1,17 @@
 package cache
 
 import (
+	"bytes"
+	"context"
 	"crypto/sha256"
 	"encoding/hex"
 	"encoding/json"
 	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
 	"time"
 
 	"github.com/abreed05/goexpress"
@@ -17,6 +24,44 @@ type CacheConfig struct {
 	KeyFunc    func(*goexpress.Context) string
 	SkipFunc   func(*goexpress.Context) bool
 	OnlyStatus []int
+	Header     string   // Response header reporting HIT, MISS or BYPASS (default "X-Cache")
+	Methods    []string // Methods eligible for caching (default GET and HEAD)
+
+	// VaryHeaders are request headers whose values select separate cache
+	// entries, e.g. Accept-Language. They are also sent in the Vary header.
+	VaryHeaders []string
+
+	// CacheCookies allows caching responses that set cookies. Off by default,
+	// since a replayed Set-Cookie would hand one user's cookie to everyone.
+	CacheCookies bool
+
+	// Tags and TagsFunc group stored responses under tags, so FlushTags can
+	// invalidate every route showing some data at once. Requires a RedisCache.
+	Tags     []string
+	TagsFunc func(*goexpress.Context) []string
+
+	// ServeStaleOnError keeps entries for StaleTTL (default 1 hour) past their
+	// TTL and serves such a stale copy, marked STALE, when the handler fails
+	// with an error or a 5xx status instead of passing the failure on
+	ServeStaleOnError bool
+	StaleTTL          time.Duration
+
+	// OnError is called with cache errors other than misses, such as Redis
+	// being unreachable (default logs them). A failed lookup is treated as a
+	// miss and the handler runs; with FailClosed the lookup error is returned
+	// instead.
+	OnError    func(error)
+	FailClosed bool
+
+	// TTLJitter randomizes each stored response's TTL by up to ±TTLJitter,
+	// so routes cached at the same moment don't all expire together. It
+	// replaces the TTLJitter of a RedisCache for the middleware's writes.
+	TTLJitter time.Duration
+
+	// MaxBodyBytes skips caching responses whose body grows past this many
+	// bytes (0 = unlimited). They are still streamed to the client, but the
+	// recorder stops buffering them at the limit.
+	MaxBodyBytes int
 }
 
 // DefaultCacheConfig returns a default cache configuration
@@ -25,6 +70,8 @@ func DefaultCacheConfig(cache Cache) CacheConfig {
 		Cache:      cache,
 		TTL:        5 * time.Minute,
 		OnlyStatus: []int{200},
+		Header:     "X-Cache",
+		Methods:    []string{"GET", "HEAD"},
 		KeyFunc: func(c *goexpress.Context) string {
 			return c.Method() + ":" + c.Path()
 		},
@@ -47,41 +94,119 @@ func Middleware(config CacheConfig) goexpress.Middleware {
 		config.OnlyStatus = []int{200}
 	}
 
+	if config.Header == "" {
+		config.Header = "X-Cache"
+	}
+
+	if config.Methods == nil {
+		config.Methods = []string{"GET", "HEAD"}
+	}
+
+	if config.OnError == nil {
+		config.OnError = func(err error) {
+			log.Printf("cache: %v", err)
+		}
+	}
+
+	if config.ServeStaleOnError && config.StaleTTL <= 0 {
+		config.StaleTTL = time.Hour
+	}
+
+	tagged, _ := config.Cache.(taggedCache)
+	if (config.Tags != nil || config.TagsFunc != nil) && tagged == nil {
+		panic("cache tags require a RedisCache")
+	}
+
 	return func(next goexpress.HandlerFunc) goexpress.HandlerFunc {
 		return func(c *goexpress.Context) error {
 			// Skip if skip function returns true
 			if config.SkipFunc != nil && config.SkipFunc(c) {
+				c.SetHeader(config.Header, "BYPASS")
 				return next(c)
 			}
 
-			// Only cache GET and HEAD requests
-			if c.Method() != "GET" && c.Method() != "HEAD" {
+			// Only cache the configured methods
+			if !containsMethod(config.Methods, c.Method()) {
 				return next(c)
 			}
 
-			// Generate cache key
-			key := config.KeyFunc(c)
+			// Generate cache key. HEAD shares the GET entry, per HTTP semantics.
+			key := cacheKey(c, config.KeyFunc)
+
+			// Requests with a body are keyed by its hash so different bodies don't collide
+			if c.Method() != "GET" && c.Method() != "HEAD" {
+				hash, err := bodyHash(c)
+				if err != nil {
+					return err
+				}
+				key += ":" + hash
+			}
+
+			if len(config.VaryHeaders) > 0 {
+				key += ":" + varyHash(c, config.VaryHeaders)
+				for _, name := range config.VaryHeaders {
+					addVary(c.Response.Header(), name)
+				}
+			}
 
 			// Try to get from cache
-			var cached CachedResponse
-			err := config.Cache.Get(key, &cached)
-			if err == nil {
-				// Cache hit - restore response
-				for k, v := range cached.Headers {
-					c.SetHeader(k, v)
+			var (
+				cached CachedResponse
+				stale  *CachedResponse
+			)
+			err := getCtx(c.Request.Context(), config.Cache, key, &cached)
+			if err == nil && !acceptsEncoding(c.Header("Accept-Encoding"), cached.Headers["Content-Encoding"]) {
+				// A compressed entry the client can't decode counts as a miss
+				err = ErrCacheMiss
+			} else if err == nil {
+				if !cached.isStale() {
+					// Cache hit - restore response
+					return serveCached(c, config, cached, "HIT")
+				}
+				stale = &cached
+			} else if err != ErrCacheMiss {
+				config.OnError(fmt.Errorf("get %q: %w", key, err))
+				if config.FailClosed {
+					return err
 				}
-				c.Status(cached.Status)
-				return c.Send(cached.Body)
 			}
 
-			// Cache miss - execute handler
-			// Create a response recorder
+			// Cache miss - execute handler while recording the response.
+			// With a stale copy to fall back on, the response is held back
+			// until it is known to be good.
+			c.SetHeader(config.Header, "MISS")
+
+			// Remember the headers set so far, so the handler's can be
+			// dropped again if the stale copy is served instead
+			var outerHeaders http.Header
+			if stale != nil {
+				outerHeaders = c.Response.Header().Clone()
+			}
+
 			recorder := &responseRecorder{
-				Context: c,
-				headers: make(map[string]string),
+				ResponseWriter: c.Response,
+				buffered:       stale != nil,
+				maxBody:        config.MaxBodyBytes,
+			}
+			c.Response = recorder
+
+			err = next(c)
+			c.Response = recorder.ResponseWriter
+
+			// Serve the stale copy unless the response already went out
+			if stale != nil && recorder.buffered {
+				if err != nil || recorder.status >= http.StatusInternalServerError {
+					if err != nil {
+						log.Printf("cache: serving stale response for %q after handler error: %v", key, err)
+					}
+					restoreHeaders(c.Response.Header(), outerHeaders)
+					return serveCached(c, config, *stale, "STALE")
+				}
+			}
+			if err := recorder.flush(); err != nil {
+				return err
 			}
 
-			err = next(recorder.Context)
 			if err != nil {
 				return err
 			}
@@ -95,14 +220,63 @@ func Middleware(config CacheConfig) goexpress.Middleware {
 				}
 			}
 
+			// Never replay another user's cookies unless explicitly allowed
+			if _, ok := recorder.headers["Set-Cookie"]; ok && !config.CacheCookies {
+				shouldCache = false
+			}
+
+			// Handlers can skip storing their response or override the TTL
+			if skip, _ := c.Get("cache_skip"); skip == true {
+				shouldCache = false
+			}
+			ttl := config.TTL
+			if v, ok := c.Get("cache_ttl"); ok {
+				if routeTTL, ok := v.(time.Duration); ok {
+					ttl = routeTTL
+				}
+			}
+
 			// Store in cache if appropriate
-			if shouldCache && recorder.body != nil {
+			if shouldCache && recorder.body != nil && !recorder.tooLarge {
 				cached := CachedResponse{
-					Status:  recorder.status,
-					Headers: recorder.headers,
-					Body:    recorder.body,
+					Status:   recorder.status,
+					Headers:  recorder.headers,
+					Body:     recorder.body,
+					StoredAt: time.Now(),
+				}
+
+				// Record the type net/http sniffed for the client, so the
+				// replay doesn't depend on sniffing again
+				if _, ok := cached.Headers["Content-Type"]; !ok && cached.Headers["Content-Encoding"] == "" {
+					cached.Headers["Content-Type"] = http.DetectContentType(cached.Body)
+				}
+
+				// The cache's own jitter is skipped when the middleware
+				// jitters, so the TTL is only moved once
+				ctx := c.Request.Context()
+				if config.TTLJitter > 0 {
+					ttl = jitterTTL(ttl, config.TTLJitter)
+					ctx = withJitteredTTL(ctx)
+				}
+				if config.ServeStaleOnError && ttl > 0 {
+					cached.FreshUntil = cached.StoredAt.Add(ttl)
+					ttl += config.StaleTTL
+				}
+
+				tags := config.Tags
+				if config.TagsFunc != nil {
+					tags = append(append([]string(nil), config.Tags...), config.TagsFunc(c)...)
+				}
+
+				var err error
+				if len(tags) > 0 {
+					err = tagged.Tags(tags...).setCtx(ctx, key, cached, ttl)
+				} else {
+					err = setCtx(ctx, config.Cache, key, cached, ttl)
+				}
+				if err != nil {
+					config.OnError(fmt.Errorf("set %q: %w", key, err))
 				}
-				config.Cache.Set(key, cached, config.TTL)
 			}
 
 			return nil
@@ -110,19 +284,265 @@ func Middleware(config CacheConfig) goexpress.Middleware {
 	}
 }
 
+// restoreHeaders resets h to saved, dropping headers added since and
+// restoring changed ones, so headers set by outer middleware survive
+func restoreHeaders(h, saved http.Header) {
+	for k := range h {
+		if _, ok := saved[k]; !ok {
+			delete(h, k)
+		}
+	}
+	for k, v := range saved {
+		h[k] = v
+	}
+}
+
+// serveCached writes a cached response, labelled with status in the cache header
+func serveCached(c *goexpress.Context, config CacheConfig, cached CachedResponse, status string) error {
+	for k, v := range cached.Headers {
+		if k == "Vary" {
+			// Merge with the Vary set for this request instead of replacing it
+			for _, name := range strings.Split(v, ",") {
+				addVary(c.Response.Header(), strings.TrimSpace(name))
+			}
+			continue
+		}
+		c.SetHeader(k, v)
+	}
+	c.SetHeader(config.Header, status)
+
+	// Compressed entries depend on Accept-Encoding. Their Content-Encoding
+	// header also tells compression middleware not to compress them again.
+	if cached.Headers["Content-Encoding"] != "" {
+		addVary(c.Response.Header(), "Accept-Encoding")
+	}
+
+	if !cached.StoredAt.IsZero() {
+		c.SetHeader("Age", strconv.Itoa(int(time.Since(cached.StoredAt).Seconds())))
+	}
+
+	// HEAD gets the GET response's headers without its body
+	if c.Method() == http.MethodHead {
+		c.SetHeader("Content-Length", strconv.Itoa(len(cached.Body)))
+		c.Status(cached.Status)
+		return c.Send(nil)
+	}
+
+	c.Status(cached.Status)
+	return c.Send(cached.Body)
+}
+
+// acceptsEncoding reports whether an Accept-Encoding header value allows
+// content encoded with encoding ("" for none, always acceptable)
+func acceptsEncoding(header, encoding string) bool {
+	if encoding == "" || strings.EqualFold(encoding, "identity") {
+		return true
+	}
+
+	for _, part := range strings.Split(header, ",") {
+		name, params, _ := strings.Cut(strings.TrimSpace(part), ";")
+		if !strings.EqualFold(name, encoding) && name != "*" {
+			continue
+		}
+		if q, ok := strings.CutPrefix(strings.TrimSpace(params), "q="); ok {
+			if v, err := strconv.ParseFloat(q, 64); err == nil && v == 0 {
+				return false
+			}
+		}
+		return true
+	}
+	return false
+}
+
+// addVary adds name to the Vary header unless it is already listed
+func addVary(h http.Header, name string) {
+	for _, v := range h.Values("Vary") {
+		for _, field := range strings.Split(v, ",") {
+			if strings.EqualFold(strings.TrimSpace(field), name) {
+				return
+			}
+		}
+	}
+	h.Add("Vary", name)
+}
+
+// cacheKey builds the key for a request with keyFunc, treating HEAD as GET
+func cacheKey(c *goexpress.Context, keyFunc func(*goexpress.Context) string) string {
+	if c.Method() != http.MethodHead {
+		return keyFunc(c)
+	}
+
+	c.Request.Method = http.MethodGet
+	defer func() { c.Request.Method = http.MethodHead }()
+	return keyFunc(c)
+}
+
+// containsMethod reports whether method is in methods
+func containsMethod(methods []string, method string) bool {
+	for _, m := range methods {
+		if m == method {
+			return true
+		}
+	}
+	return false
+}
+
+// bodyHash hashes the request body and restores it for the handler
+func bodyHash(c *goexpress.Context) (string, error) {
+	var body []byte
+	if c.Request.Body != nil {
+		var err error
+		body, err = io.ReadAll(c.Request.Body)
+		c.Request.Body.Close()
+		if err != nil {
+			return "", err
+		}
+		c.Request.Body = io.NopCloser(bytes.NewReader(body))
+	}
+
+	hash := sha256.Sum256(body)
+	return hex.EncodeToString(hash[:]), nil
+}
+
+// varyHash hashes the lowercased values of the given request headers.
+// A missing header hashes the same as an empty one.
+func varyHash(c *goexpress.Context, headers []string) string {
+	h := sha256.New()
+	for _, name := range headers {
+		io.WriteString(h, strings.ToLower(c.Header(name)))
+		h.Write([]byte{0})
+	}
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// taggedCache is implemented by caches that support tags
+type taggedCache interface {
+	Tags(tags ...string) *TaggedCache
+}
+
+// FlushTags removes every entry stored under any of the tags, e.g. all cached
+// routes showing products after a product changes
+func FlushTags(cache *RedisCache, tags ...string) error {
+	return cache.Tags(tags...).Flush()
+}
+
+// contextCache is implemented by caches that accept a request context
+type contextCache interface {
+	GetCtx(ctx context.Context, key string, dest interface{}) error
+	SetCtx(ctx context.Context, key string, value interface{}, ttl time.Duration) error
+}
+
+// getCtx reads from cache, passing ctx along when the cache supports it
+func getCtx(ctx context.Context, cache Cache, key string, dest interface{}) error {
+	if cc, ok := cache.(contextCache); ok {
+		return cc.GetCtx(ctx, key, dest)
+	}
+	return cache.Get(key, dest)
+}
+
+// setCtx writes to cache, passing ctx along when the cache supports it
+func setCtx(ctx context.Context, cache Cache, key string, value interface{}, ttl time.Duration) error {
+	if cc, ok := cache.(contextCache); ok {
+		return cc.SetCtx(ctx, key, value, ttl)
+	}
+	return cache.Set(key, value, ttl)
+}
+
 // CachedResponse holds a cached HTTP response
 type CachedResponse struct {
-	Status  int               `json:"status"`
-	Headers map[string]string `json:"headers"`
-	Body    []byte            `json:"body"`
+	Status   int               `json:"status"`
+	Headers  map[string]string `json:"headers"`
+	Body     []byte            `json:"body"`
+	StoredAt time.Time         `json:"stored_at"`
+
+	// FreshUntil is set on entries kept past their TTL for ServeStaleOnError
+	FreshUntil time.Time `json:"fresh_until,omitempty"`
+}
+
+// isStale reports whether the entry is only being kept to serve on errors
+func (r CachedResponse) isStale() bool {
+	return !r.FreshUntil.IsZero() && time.Now().After(r.FreshUntil)
 }
 
-// responseRecorder records the response for caching
+// responseRecorder records the response for caching while passing it
+// through, or holding it back until flush when buffered
 type responseRecorder struct {
-	Context *goexpress.Context
-	status  int
-	headers map[string]string
-	body    []byte
+	http.ResponseWriter
+	status   int
+	headers  map[string]string
+	body     []byte
+	buffered bool
+	maxBody  int  // Stop recording past this many bytes (0 = unlimited)
+	tooLarge bool // Body outgrew maxBody and was dropped
+}
+
+// WriteHeader records the status and headers of the first call
+func (r *responseRecorder) WriteHeader(code int) {
+	if r.status == 0 {
+		r.status = code
+		r.headers = make(map[string]string)
+		for k := range r.Header() {
+			r.headers[k] = r.Header().Get(k)
+		}
+		// Vary is often added to by several middlewares, keep every line
+		if vary := r.Header().Values("Vary"); len(vary) > 1 {
+			r.headers["Vary"] = strings.Join(vary, ", ")
+		}
+	}
+	if !r.buffered {
+		r.ResponseWriter.WriteHeader(code)
+	}
+}
+
+// Write records the body as it is written
+func (r *responseRecorder) Write(b []byte) (int, error) {
+	if r.status == 0 {
+		r.WriteHeader(http.StatusOK)
+	}
+
+	// Past the limit the response can't be cached, so send what was held
+	// back and stream the rest
+	if !r.tooLarge && r.maxBody > 0 && len(r.body)+len(b) > r.maxBody {
+		r.tooLarge = true
+		if err := r.flush(); err != nil {
+			return 0, err
+		}
+		r.body = nil
+	}
+
+	if !r.tooLarge {
+		r.body = append(r.body, b...)
+	}
+	if r.buffered {
+		return len(b), nil
+	}
+	return r.ResponseWriter.Write(b)
+}
+
+// Flush flushes buffered data to the client
+func (r *responseRecorder) Flush() {
+	if r.buffered {
+		return
+	}
+	if f, ok := r.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// flush sends a held back response to the client and stops holding back
+func (r *responseRecorder) flush() error {
+	if !r.buffered || r.status == 0 {
+		return nil
+	}
+	r.buffered = false
+	r.ResponseWriter.WriteHeader(r.status)
+	_, err := r.ResponseWriter.Write(r.body)
+	return err
+}
+
+// Unwrap returns the wrapped ResponseWriter for http.ResponseController
+func (r *responseRecorder) Unwrap() http.ResponseWriter {
+	return r.ResponseWriter
 }
 
 // GenerateCacheKey generates a cache key from method, path, and query params
@@ -132,8 +552,22 @@ func GenerateCacheKey(c *goexpress.Context) string {
 	return hex.EncodeToString(hash[:])
 }
 
-// Invalidate removes specific keys from cache
+// batchDeleter is implemented by caches that delete several keys in one round-trip
+type batchDeleter interface {
+	DeleteMany(keys ...string) error
+}
+
+// Invalidate removes specific keys from cache, in a single command when the
+// cache supports it (RedisCache)
 func Invalidate(cache Cache, keys ...string) error {
+	if len(keys) == 0 {
+		return nil
+	}
+
+	if bd, ok := cache.(batchDeleter); ok {
+		return bd.DeleteMany(keys...)
+	}
+
 	for _, key := range keys {
 		if err := cache.Delete(key); err != nil {
 			return err
@@ -145,7 +579,7 @@ func Invalidate(cache Cache, keys ...string) error {
 // InvalidatePattern removes keys matching a pattern (Redis only)
 func InvalidatePattern(cache *RedisCache, pattern string) error {
 	client := cache.GetClient()
-	keys, err := client.Keys(cache.ctx, cache.prefix+pattern).Result()
+	keys, err := client.Keys(cache.ctx, cache.key(pattern)).Result()
 	if err != nil {
 		return err
 	}
@@ -169,7 +603,8 @@ func CacheJSON(cache Cache, key string, data interface{}, ttl time.Duration) err
 		Headers: map[string]string{
 			"Content-Type": "application/json",
 		},
-		Body: jsonData,
+		Body:     jsonData,
+		StoredAt: time.Now(),
 	}
 
 	return cache.Set(key, cached, ttl)
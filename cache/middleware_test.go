@@ -0,0 +1,565 @@
+package cache
+
+import (
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/abreed05/goexpress"
+)
+
+// newTestMemoryCache returns a MemoryCache closed when the test ends
+func newTestMemoryCache(t *testing.T) *MemoryCache {
+	t.Helper()
+	c := NewMemoryCache(time.Hour)
+	t.Cleanup(func() { c.Close() })
+	return c
+}
+
+// serve runs handler behind mw for a GET of path and returns the response
+func serve(t *testing.T, mw goexpress.Middleware, path string, handler goexpress.HandlerFunc) (*httptest.ResponseRecorder, error) {
+	t.Helper()
+	return serveRequest(t, mw, httptest.NewRequest("GET", path, nil), handler)
+}
+
+// serveRequest runs handler behind mw for req and returns the response
+func serveRequest(t *testing.T, mw goexpress.Middleware, req *http.Request, handler goexpress.HandlerFunc) (*httptest.ResponseRecorder, error) {
+	t.Helper()
+	rec := httptest.NewRecorder()
+	return rec, mw(handler)(goexpress.NewContext(rec, req))
+}
+
+func TestServeStaleOnError(t *testing.T) {
+	store := newTestMemoryCache(t)
+	config := DefaultCacheConfig(store)
+	config.ServeStaleOnError = true
+	cacheMiddleware := Middleware(config)
+
+	// An entry past its TTL, kept for errors only
+	stale := CachedResponse{
+		Status:     200,
+		Headers:    map[string]string{"Content-Type": "text/plain"},
+		Body:       []byte("stale"),
+		StoredAt:   time.Now().Add(-10 * time.Minute),
+		FreshUntil: time.Now().Add(-5 * time.Minute),
+	}
+	if err := store.Set("GET:/report", stale, time.Hour); err != nil {
+		t.Fatal(err)
+	}
+
+	// Outer middleware setting headers before the cache runs
+	outer := func(next goexpress.HandlerFunc) goexpress.HandlerFunc {
+		return func(c *goexpress.Context) error {
+			c.SetHeader("X-Request-Id", "abc")
+			c.SetHeader("Content-Type", "application/json")
+			return cacheMiddleware(next)(c)
+		}
+	}
+
+	rec, err := serve(t, outer, "/report", func(c *goexpress.Context) error {
+		c.SetHeader("X-Debug", "failed")
+		c.SetHeader("Content-Type", "text/html")
+		return errors.New("backend down")
+	})
+	if err != nil {
+		t.Fatalf("error passed on despite a stale copy: %v", err)
+	}
+
+	if body := rec.Body.String(); body != "stale" {
+		t.Errorf("body = %q, want the stale copy", body)
+	}
+	if got := rec.Header().Get("X-Cache"); got != "STALE" {
+		t.Errorf("X-Cache = %q, want STALE", got)
+	}
+	if got := rec.Header().Get("X-Request-Id"); got != "abc" {
+		t.Errorf("X-Request-Id = %q, outer middleware header was dropped", got)
+	}
+	if got := rec.Header().Get("X-Debug"); got != "" {
+		t.Errorf("X-Debug = %q, failed handler's header leaked into the stale response", got)
+	}
+	if got := rec.Header().Get("Content-Type"); got != "text/plain" {
+		t.Errorf("Content-Type = %q, want the stale entry's", got)
+	}
+
+	// A successful handler replaces the stale copy
+	rec, err = serve(t, outer, "/report", func(c *goexpress.Context) error {
+		return c.String("fresh")
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if body := rec.Body.String(); body != "fresh" {
+		t.Errorf("body = %q, want fresh", body)
+	}
+
+	var cached CachedResponse
+	if err := store.Get("GET:/report", &cached); err != nil || string(cached.Body) != "fresh" {
+		t.Errorf("stored body = %q, %v, want fresh", cached.Body, err)
+	}
+}
+
+func TestResponsesSettingCookiesAreNotCached(t *testing.T) {
+	store := newTestMemoryCache(t)
+	cacheMiddleware := Middleware(DefaultCacheConfig(store))
+
+	calls := 0
+	handler := func(c *goexpress.Context) error {
+		calls++
+		c.Cookie(&http.Cookie{Name: "session_id", Value: "secret"})
+		return c.String("hello")
+	}
+
+	for i := 0; i < 2; i++ {
+		rec, err := serve(t, cacheMiddleware, "/greeting", handler)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := rec.Header().Get("X-Cache"); got != "MISS" {
+			t.Errorf("request %d: X-Cache = %q, want MISS", i+1, got)
+		}
+	}
+	if calls != 2 {
+		t.Errorf("handler ran %d times, want 2", calls)
+	}
+	if store.Len() != 0 {
+		t.Errorf("cache holds %d entries, want 0", store.Len())
+	}
+
+	// CacheCookies opts back in
+	config := DefaultCacheConfig(store)
+	config.CacheCookies = true
+	if _, err := serve(t, Middleware(config), "/greeting", handler); err != nil {
+		t.Fatal(err)
+	}
+	if store.Len() != 1 {
+		t.Errorf("cache holds %d entries with CacheCookies, want 1", store.Len())
+	}
+}
+
+// failingCache is a Cache whose lookups fail with err
+type failingCache struct {
+	Cache
+	err error
+}
+
+func (f failingCache) Get(key string, dest interface{}) error {
+	return f.err
+}
+
+func TestLookupErrors(t *testing.T) {
+	errDown := errors.New("redis down")
+	failing := failingCache{Cache: newTestMemoryCache(t), err: errDown}
+	handler := func(c *goexpress.Context) error {
+		return c.String("hello")
+	}
+
+	// The zero value fails open: the lookup error counts as a miss
+	config := CacheConfig{Cache: failing, OnError: func(error) {}}
+	rec, err := serve(t, Middleware(config), "/greeting", handler)
+	if err != nil {
+		t.Fatalf("fail open: %v", err)
+	}
+	if rec.Body.String() != "hello" {
+		t.Errorf("fail open: body = %q, want hello", rec.Body.String())
+	}
+
+	config.FailClosed = true
+	if _, err := serve(t, Middleware(config), "/greeting", handler); err != errDown {
+		t.Errorf("fail closed: err = %v, want %v", err, errDown)
+	}
+}
+
+func TestVaryHeaders(t *testing.T) {
+	store := newTestMemoryCache(t)
+	config := DefaultCacheConfig(store)
+	config.VaryHeaders = []string{"Accept-Language"}
+	cacheMiddleware := Middleware(config)
+
+	handler := func(c *goexpress.Context) error {
+		if c.Header("Accept-Language") == "fr" {
+			return c.String("bonjour")
+		}
+		return c.String("hello")
+	}
+	get := func(lang string) *httptest.ResponseRecorder {
+		t.Helper()
+		req := httptest.NewRequest("GET", "/greeting", nil)
+		if lang != "" {
+			req.Header.Set("Accept-Language", lang)
+		}
+		rec, err := serveRequest(t, cacheMiddleware, req, handler)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return rec
+	}
+
+	for _, tc := range []struct {
+		lang, body, status string
+	}{
+		{"en", "hello", "MISS"},
+		{"fr", "bonjour", "MISS"},
+		{"en", "hello", "HIT"},
+		{"FR", "bonjour", "HIT"}, // values are compared lowercased
+		{"", "hello", "MISS"},
+	} {
+		rec := get(tc.lang)
+		if rec.Body.String() != tc.body || rec.Header().Get("X-Cache") != tc.status {
+			t.Errorf("Accept-Language %q: got %q (%s), want %q (%s)",
+				tc.lang, rec.Body.String(), rec.Header().Get("X-Cache"), tc.body, tc.status)
+		}
+		if vary := rec.Header().Get("Vary"); vary != "Accept-Language" {
+			t.Errorf("Accept-Language %q: Vary = %q", tc.lang, vary)
+		}
+	}
+	if store.Len() != 3 {
+		t.Errorf("cache holds %d entries, want 3", store.Len())
+	}
+
+	// A Vary set by an earlier middleware, e.g. CORS, is kept
+	withCORS := func(next goexpress.HandlerFunc) goexpress.HandlerFunc {
+		inner := cacheMiddleware(next)
+		return func(c *goexpress.Context) error {
+			c.Response.Header().Add("Vary", "Origin")
+			return inner(c)
+		}
+	}
+	for _, status := range []string{"MISS", "HIT"} {
+		req := httptest.NewRequest("GET", "/cors", nil)
+		rec, err := serveRequest(t, withCORS, req, handler)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := rec.Header().Get("X-Cache"); got != status {
+			t.Errorf("X-Cache = %q, want %s", got, status)
+		}
+		if vary := strings.Join(rec.Header().Values("Vary"), ", "); vary != "Origin, Accept-Language" {
+			t.Errorf("%s: Vary = %q, want \"Origin, Accept-Language\"", status, vary)
+		}
+	}
+}
+
+// deleteCounter is a Cache without DeleteMany that counts Delete calls
+type deleteCounter struct {
+	Cache
+	deletes int
+}
+
+func (d *deleteCounter) Delete(key string) error {
+	d.deletes++
+	return d.Cache.Delete(key)
+}
+
+func TestInvalidate(t *testing.T) {
+	c, server := newTestRedisCache(t, RedisConfig{Prefix: "app:"})
+	keys := make([]string, 100)
+	for i := range keys {
+		keys[i] = "item:" + strconv.Itoa(i)
+		if err := c.Set(keys[i], i, time.Minute); err != nil {
+			t.Fatalf("Set: %v", err)
+		}
+	}
+
+	// A RedisCache deletes them all with a single DEL
+	sent := logCommands(c)
+	if err := Invalidate(c, keys...); err != nil {
+		t.Fatalf("Invalidate: %v", err)
+	}
+	dels := sent.named("del")
+	if len(sent.cmds) != 1 || len(dels) != 1 || len(dels[0].Args()) != 1+len(keys) {
+		t.Errorf("Invalidate sent %v, want a single DEL of %d keys", sent.cmds, len(keys))
+	}
+	if n := len(server.Keys()); n != 0 {
+		t.Errorf("%d keys left after Invalidate", n)
+	}
+
+	// Other caches delete key by key
+	store := &deleteCounter{Cache: newTestMemoryCache(t)}
+	for _, key := range keys[:3] {
+		if err := store.Set(key, 1, time.Minute); err != nil {
+			t.Fatalf("Set: %v", err)
+		}
+	}
+	if err := Invalidate(store, keys[:3]...); err != nil {
+		t.Fatalf("Invalidate: %v", err)
+	}
+	if store.deletes != 3 {
+		t.Errorf("Delete called %d times, want 3", store.deletes)
+	}
+	if ok, _ := store.Exists(keys[0]); ok {
+		t.Error("key still cached after Invalidate")
+	}
+}
+
+func TestHeadSharesGetEntry(t *testing.T) {
+	store := newTestMemoryCache(t)
+	cacheMiddleware := Middleware(DefaultCacheConfig(store))
+
+	calls := 0
+	handler := func(c *goexpress.Context) error {
+		calls++
+		c.SetHeader("Content-Type", "text/plain")
+		return c.String("hello")
+	}
+	do := func(method, path string) *httptest.ResponseRecorder {
+		t.Helper()
+		rec, err := serveRequest(t, cacheMiddleware, httptest.NewRequest(method, path, nil), handler)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return rec
+	}
+
+	// A HEAD is answered from a warm GET entry, without the body
+	do("GET", "/a")
+	rec := do("HEAD", "/a")
+	if calls != 1 || rec.Header().Get("X-Cache") != "HIT" {
+		t.Errorf("HEAD after GET: %d handler calls, X-Cache %q; want a hit", calls, rec.Header().Get("X-Cache"))
+	}
+	if rec.Body.Len() != 0 {
+		t.Errorf("HEAD body = %q, want none", rec.Body.String())
+	}
+	if got := rec.Header().Get("Content-Length"); got != "5" {
+		t.Errorf("HEAD Content-Length = %q, want the GET body's 5", got)
+	}
+	if got := rec.Header().Get("Content-Type"); got != "text/plain" {
+		t.Errorf("HEAD Content-Type = %q, want text/plain", got)
+	}
+
+	// A GET is answered from the entry a HEAD stored, with the body
+	calls = 0
+	do("HEAD", "/b")
+	rec = do("GET", "/b")
+	if calls != 1 || rec.Header().Get("X-Cache") != "HIT" {
+		t.Errorf("GET after HEAD: %d handler calls, X-Cache %q; want a hit", calls, rec.Header().Get("X-Cache"))
+	}
+	if rec.Body.String() != "hello" {
+		t.Errorf("GET body = %q, want hello", rec.Body.String())
+	}
+}
+
+func TestMaxBodyBytes(t *testing.T) {
+	store := newTestMemoryCache(t)
+	config := DefaultCacheConfig(store)
+	config.MaxBodyBytes = 10
+	cacheMiddleware := Middleware(config)
+
+	// Written in chunks, so the limit is crossed mid-response
+	write := func(body string) goexpress.HandlerFunc {
+		return func(c *goexpress.Context) error {
+			for i := 0; i < len(body); i += 4 {
+				end := i + 4
+				if end > len(body) {
+					end = len(body)
+				}
+				if _, err := c.Response.Write([]byte(body[i:end])); err != nil {
+					return err
+				}
+			}
+			return nil
+		}
+	}
+
+	rec, err := serve(t, cacheMiddleware, "/at-limit", write("0123456789"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rec.Body.String() != "0123456789" || store.Len() != 1 {
+		t.Errorf("body at the limit: sent %q, %d entries; want it sent and stored", rec.Body.String(), store.Len())
+	}
+
+	rec, err = serve(t, cacheMiddleware, "/over-limit", write("0123456789A"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rec.Body.String() != "0123456789A" {
+		t.Errorf("body over the limit = %q, want it streamed whole", rec.Body.String())
+	}
+	if store.Len() != 1 {
+		t.Errorf("cache holds %d entries, the body over the limit was stored", store.Len())
+	}
+
+	// With a stale copy to fall back on the response is held back, and
+	// released once it outgrows the limit
+	config.ServeStaleOnError = true
+	stale := CachedResponse{Status: 200, Body: []byte("old"), FreshUntil: time.Now().Add(-time.Minute)}
+	if err := store.Set("GET:/stale", stale, time.Hour); err != nil {
+		t.Fatal(err)
+	}
+	rec, err = serve(t, Middleware(config), "/stale", write("0123456789A"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rec.Body.String() != "0123456789A" {
+		t.Errorf("held back body over the limit = %q, want it sent whole", rec.Body.String())
+	}
+	var cached CachedResponse
+	if err := store.Get("GET:/stale", &cached); err != nil || string(cached.Body) != "old" {
+		t.Errorf("stale entry = %q, %v; want it left in place", cached.Body, err)
+	}
+}
+
+func TestReplayKeepsContentType(t *testing.T) {
+	store := newTestMemoryCache(t)
+	cacheMiddleware := Middleware(DefaultCacheConfig(store))
+
+	for _, tt := range []struct {
+		path, contentType, want string
+	}{
+		{"/page", "text/html; charset=utf-8", "text/html; charset=utf-8"},
+		{"/sniffed", "", "text/html; charset=utf-8"}, // set by net/http from the body
+	} {
+		handler := func(c *goexpress.Context) error {
+			if tt.contentType != "" {
+				c.SetHeader("Content-Type", tt.contentType)
+			}
+			_, err := c.Response.Write([]byte("<!DOCTYPE html><p>hi</p>"))
+			return err
+		}
+		if _, err := serve(t, cacheMiddleware, tt.path, handler); err != nil {
+			t.Fatal(err)
+		}
+		rec, err := serve(t, cacheMiddleware, tt.path, handler)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if rec.Header().Get("X-Cache") != "HIT" {
+			t.Fatalf("%s: X-Cache = %q, want HIT", tt.path, rec.Header().Get("X-Cache"))
+		}
+		if got := rec.Header().Get("Content-Type"); got != tt.want {
+			t.Errorf("%s: replayed Content-Type = %q, want %q", tt.path, got, tt.want)
+		}
+	}
+}
+
+func TestReplayPrecompressed(t *testing.T) {
+	store := newTestMemoryCache(t)
+	cacheMiddleware := Middleware(DefaultCacheConfig(store))
+
+	var gz bytes.Buffer
+	zw := gzip.NewWriter(&gz)
+	zw.Write([]byte(`{"hello":"world"}`))
+	zw.Close()
+
+	calls := 0
+	handler := func(c *goexpress.Context) error {
+		calls++
+		if !strings.Contains(c.Header("Accept-Encoding"), "gzip") {
+			return c.JSON(map[string]string{"hello": "world"})
+		}
+		c.SetHeader("Content-Type", "application/json")
+		c.SetHeader("Content-Encoding", "gzip")
+		_, err := c.Response.Write(gz.Bytes())
+		return err
+	}
+	get := func(acceptEncoding string) *httptest.ResponseRecorder {
+		t.Helper()
+		req := httptest.NewRequest("GET", "/data", nil)
+		req.Header.Set("Accept-Encoding", acceptEncoding)
+		rec, err := serveRequest(t, cacheMiddleware, req, handler)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return rec
+	}
+
+	get("gzip")
+	rec := get("gzip, br")
+	if calls != 1 || rec.Header().Get("X-Cache") != "HIT" {
+		t.Fatalf("%d handler calls, X-Cache %q; want a hit", calls, rec.Header().Get("X-Cache"))
+	}
+	// Replayed as is, marked as encoded so compression middleware leaves it alone
+	if !bytes.Equal(rec.Body.Bytes(), gz.Bytes()) {
+		t.Error("replayed body differs from the compressed original")
+	}
+	if got := rec.Header().Get("Content-Encoding"); got != "gzip" {
+		t.Errorf("Content-Encoding = %q, want gzip", got)
+	}
+	if got := rec.Header().Get("Content-Type"); got != "application/json" {
+		t.Errorf("Content-Type = %q, want application/json", got)
+	}
+	if got := rec.Header().Get("Vary"); got != "Accept-Encoding" {
+		t.Errorf("Vary = %q, want Accept-Encoding", got)
+	}
+
+	// Clients that can't decode it get a fresh response instead
+	rec = get("identity")
+	if calls != 2 || rec.Header().Get("Content-Encoding") != "" {
+		t.Errorf("%d handler calls, Content-Encoding %q; want a fresh plain response",
+			calls, rec.Header().Get("Content-Encoding"))
+	}
+}
+
+func TestRouteOverrides(t *testing.T) {
+	c, server := newTestRedisCache(t, RedisConfig{Prefix: "app:"})
+	cacheMiddleware := Middleware(DefaultCacheConfig(c))
+
+	// cache_skip keeps a response out of the cache
+	_, err := serve(t, cacheMiddleware, "/skipped", func(c *goexpress.Context) error {
+		c.Set("cache_skip", true)
+		return c.String("ok")
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if server.Exists("app:GET:/skipped") {
+		t.Error("response stored despite cache_skip")
+	}
+
+	// cache_ttl replaces the configured TTL
+	_, err = serve(t, cacheMiddleware, "/short", func(c *goexpress.Context) error {
+		c.Set("cache_ttl", 30*time.Second)
+		return c.String("ok")
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ttl := server.TTL("app:GET:/short"); ttl != 30*time.Second {
+		t.Errorf("TTL = %v, want 30s from cache_ttl", ttl)
+	}
+
+	// Without overrides the configured TTL applies
+	if _, err := serve(t, cacheMiddleware, "/default", func(c *goexpress.Context) error {
+		return c.String("ok")
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if ttl := server.TTL("app:GET:/default"); ttl != 5*time.Minute {
+		t.Errorf("TTL = %v, want the default 5m", ttl)
+	}
+}
+
+func TestMiddlewareJittersOnce(t *testing.T) {
+	// Only the middleware's small jitter may move the TTL, not the cache's
+	c, server := newTestRedisCache(t, RedisConfig{TTLJitter: 30 * time.Minute})
+	config := DefaultCacheConfig(c)
+	config.TTL = time.Hour
+	config.TTLJitter = time.Second
+	handler := func(c *goexpress.Context) error {
+		return c.String("hello")
+	}
+
+	for _, tags := range [][]string{nil, {"pages"}} {
+		config.Tags = tags
+		mw := Middleware(config)
+		for i := 0; i < 10; i++ {
+			path := "/page/" + strconv.Itoa(i)
+			if _, err := serve(t, mw, path, handler); err != nil {
+				t.Fatal(err)
+			}
+			ttl := server.TTL("cache:GET:" + path)
+			if ttl < time.Hour-time.Second || ttl > time.Hour+time.Second {
+				t.Errorf("tags %v: TTL of %s = %v, want 1h ±1s", tags, path, ttl)
+			}
+		}
+		if err := c.Clear(); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
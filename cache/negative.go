@@ -0,0 +1,42 @@
+package cache
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"time"
+)
+
+// negativeEntry marks a key known not to exist. It isn't valid JSON, so it
+// can't collide with a value stored by Set.
+var negativeEntry = []byte("\x00cache:not-found")
+
+// isNegative reports whether data is a cached negative entry
+func isNegative(data []byte) bool {
+	return bytes.Equal(data, negativeEntry)
+}
+
+// RememberAllowMiss is like Remember, but when fn returns ErrNotFound the miss
+// itself is cached for negativeTTL. Until then lookups return ErrNotFound
+// without calling fn again. A negativeTTL that resolves to NoExpiration
+// returns ErrInvalidTTL, since a miss cached forever would hide the record
+// once it is created.
+func (r *RedisCache) RememberAllowMiss(key string, ttl, negativeTTL time.Duration, fn func() (interface{}, error), dest interface{}) error {
+	resolved, err := r.resolveTTL(negativeTTL)
+	if err != nil {
+		return err
+	}
+	if resolved == NoExpiration {
+		return fmt.Errorf("%w: negative TTL %v never expires", ErrInvalidTTL, negativeTTL)
+	}
+
+	return r.Remember(key, ttl, func() (interface{}, error) {
+		value, err := fn()
+		if errors.Is(err, ErrNotFound) {
+			if err := r.write(r.ctx, key, negativeEntry, negativeTTL); err != nil {
+				return nil, err
+			}
+		}
+		return value, err
+	}, dest)
+}
@@ -0,0 +1,73 @@
+package cache
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+// cacheMiss stores a negative entry for key with RememberAllowMiss
+func cacheMiss(t *testing.T, c *RedisCache, key string) {
+	t.Helper()
+	var dest string
+	err := c.RememberAllowMiss(key, time.Minute, 30*time.Second, func() (interface{}, error) {
+		return nil, ErrNotFound
+	}, &dest)
+	if err != ErrNotFound {
+		t.Fatalf("RememberAllowMiss: err = %v, want ErrNotFound", err)
+	}
+}
+
+func TestGetExNegativeEntry(t *testing.T) {
+	c, _ := newTestRedisCache(t, RedisConfig{})
+	cacheMiss(t, c, "user:1")
+
+	var dest string
+	if err := c.GetEx("user:1", &dest, time.Minute); err != ErrNotFound {
+		t.Errorf("GetEx of a negative entry: err = %v, want ErrNotFound", err)
+	}
+}
+
+func TestGetDelNegativeEntry(t *testing.T) {
+	c, _ := newTestRedisCache(t, RedisConfig{})
+	cacheMiss(t, c, "token:1")
+
+	var dest string
+	if err := c.GetDel("token:1", &dest); err != ErrNotFound {
+		t.Errorf("GetDel of a negative entry: err = %v, want ErrNotFound", err)
+	}
+	if err := c.GetDel("token:1", &dest); err != ErrCacheMiss {
+		t.Errorf("second GetDel: err = %v, want ErrCacheMiss", err)
+	}
+}
+
+func TestRememberAllowMissRejectsPermanentMisses(t *testing.T) {
+	c, server := newTestRedisCache(t, RedisConfig{})
+
+	calls := 0
+	fn := func() (interface{}, error) {
+		calls++
+		return nil, ErrNotFound
+	}
+	var dest string
+	for _, negativeTTL := range []time.Duration{NoExpiration, DefaultExpiration} {
+		if err := c.RememberAllowMiss("user:1", time.Minute, negativeTTL, fn, &dest); !errors.Is(err, ErrInvalidTTL) {
+			t.Errorf("RememberAllowMiss with negative TTL %v = %v, want ErrInvalidTTL", negativeTTL, err)
+		}
+	}
+	if calls != 0 {
+		t.Errorf("loader ran %d times, want 0", calls)
+	}
+	if server.Exists("cache:user:1") {
+		t.Error("a negative entry was stored")
+	}
+
+	// A DefaultTTL gives DefaultExpiration something to resolve to
+	c, server = newTestRedisCache(t, RedisConfig{DefaultTTL: time.Minute})
+	if err := c.RememberAllowMiss("user:1", time.Hour, DefaultExpiration, fn, &dest); err != ErrNotFound {
+		t.Fatalf("RememberAllowMiss = %v, want ErrNotFound", err)
+	}
+	if ttl := server.TTL("cache:user:1"); ttl != time.Minute {
+		t.Errorf("negative entry TTL = %v, want 1m", ttl)
+	}
+}
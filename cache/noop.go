@@ -0,0 +1,38 @@
+package cache
+
+import "time"
+
+// NoopCache is a Cache that stores nothing: Get always misses and writes are
+// accepted and dropped. Use it in tests and where caching is turned off, so
+// the same code, including Middleware, runs either way.
+type NoopCache struct{}
+
+// Get always returns ErrCacheMiss
+func (NoopCache) Get(key string, dest interface{}) error {
+	return ErrCacheMiss
+}
+
+// Set discards the value
+func (NoopCache) Set(key string, value interface{}, ttl time.Duration) error {
+	return nil
+}
+
+// Delete does nothing
+func (NoopCache) Delete(key string) error {
+	return nil
+}
+
+// Exists always reports false
+func (NoopCache) Exists(key string) (bool, error) {
+	return false, nil
+}
+
+// Clear does nothing
+func (NoopCache) Clear() error {
+	return nil
+}
+
+// Close does nothing
+func (NoopCache) Close() error {
+	return nil
+}
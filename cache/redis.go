@@ -1,17 +1,54 @@
 package cache
 
 import (
+	"bytes"
 	"context"
 	"encoding/json"
 	"errors"
+	"fmt"
+	"log"
+	"math"
+	"math/rand"
+	"reflect"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 
+	"github.com/abreed05/goexpress-redis/internal/redishook"
 	"github.com/redis/go-redis/v9"
+	"go.opentelemetry.io/otel/trace"
+	"golang.org/x/sync/singleflight"
 )
 
 var (
 	// ErrCacheMiss is returned when a key is not found
 	ErrCacheMiss = errors.New("cache miss")
+	// ErrValueTooLarge is returned when a value exceeds MaxValueSize
+	ErrValueTooLarge = errors.New("cache value too large")
+	// ErrNotFound is returned by loaders, and for cached negative entries,
+	// when the value is known not to exist
+	ErrNotFound = errors.New("not found")
+	// ErrInvalidTTL is returned for negative TTLs, for NoExpiration when
+	// StrictTTL is on, and for IncrementWithTTL without a positive TTL
+	ErrInvalidTTL = errors.New("invalid cache TTL")
+	// ErrClosed is returned by commands made after Close
+	ErrClosed = errors.New("cache is closed")
+)
+
+// pingTimeout bounds health check pings
+const pingTimeout = 2 * time.Second
+
+const (
+	// NoExpiration is the TTL for values that are kept until deleted.
+	// A TTL of 0 never means "already expired".
+	NoExpiration time.Duration = 0
+	// DefaultExpiration is the TTL that stands for RedisConfig.DefaultTTL
+	DefaultExpiration time.Duration = -1
+
+	// permanentTTL is passed by SetPermanent and RememberForever, which store
+	// without expiry even when StrictTTL rejects NoExpiration
+	permanentTTL time.Duration = math.MinInt64
 )
 
 // Cache is the interface for cache operations
@@ -37,51 +74,289 @@ type Cache interface {
 
 // RedisCache implements a Redis-based cache
 type RedisCache struct {
-	client *redis.Client
-	prefix string
-	ctx    context.Context
+	client     *redis.Client
+	ownsClient bool
+	closer     *clientCloser
+	prefix     string
+	tagPrefix  string
+	ctx        context.Context
+
+	maxValueSize   int
+	rejectedWrites int64
+	trackAge       bool
+	defaultTTL     time.Duration
+	strictTTL      bool
+	ttlJitter      time.Duration
+	deleteBatch    int
+	generation     *generation // Key generation, nil unless Generations is on
+
+	tracer              trace.Tracer
+	invalidationChannel string
+	subscriber          *invalidationSubscriber
+	mu                  sync.Mutex
+
+	refreshes singleflight.Group // Background refreshes in flight, by full key
 }
 
 // RedisConfig holds Redis cache configuration
 type RedisConfig struct {
 	Addr     string
+	Username string // ACL username (Redis 6+), empty for the default user
 	Password string
 	DB       int
 	Prefix   string
+
+	// Databases is how many databases the server has, its "databases"
+	// setting (default 16). NewRedisCache rejects a DB outside that range.
+	Databases int
+
+	// ConnectRetries is how many times NewRedisCache retries the initial ping,
+	// waiting ConnectBackoff (default 500ms) before the first retry and
+	// doubling the wait each time
+	ConnectRetries int
+	ConnectBackoff time.Duration
+
+	// OpTimeout bounds every Redis command made by NewRedisCache's client, so a
+	// network partition returns an error instead of hanging (0 = no timeout).
+	// Shared clients passed to a WithClient constructor are left as they are.
+	OpTimeout time.Duration
+
+	// MaxValueSize rejects values larger than this many bytes (0 = unlimited)
+	MaxValueSize int
+
+	// TrackAge records when each value was stored (in an "age:" + full key
+	// sibling written in the same round-trip) so GetWithAge can report its age
+	TrackAge bool
+
+	// DefaultTTL is used for writes given a TTL of DefaultExpiration (default NoExpiration)
+	DefaultTTL time.Duration
+
+	// StrictTTL rejects writes with a TTL of NoExpiration, so a computed TTL
+	// that came out as zero can't create a key that never expires. Values
+	// meant to be kept are stored with SetPermanent or RememberForever.
+	StrictTTL bool
+
+	// TTLJitter randomizes every expiring write's TTL by up to ±TTLJitter, so
+	// keys written together with the same TTL don't all expire at once
+	TTLJitter time.Duration
+
+	// TracerProvider enables OpenTelemetry spans around Get, Set and Remember when set
+	TracerProvider trace.TracerProvider
+
+	// InvalidationChannel is the Pub/Sub channel for invalidation messages (default Prefix + "invalidations")
+	InvalidationChannel string
+
+	// DeleteBatchSize caps the keys per DEL command in DeleteMany and Clear;
+	// larger deletions are split into a pipeline of DELs (default 1000)
+	DeleteBatchSize int
+
+	// Generations puts a generation number in every key, so ClearLazy can
+	// invalidate everything by bumping it instead of deleting keys. Old
+	// generations are only removed by their TTL, so give every write one.
+	// Each instance re-reads the generation at most every GenerationRefresh
+	// (default 1s).
+	Generations       bool
+	GenerationRefresh time.Duration
 }
 
 // NewRedisCache creates a new Redis cache
 func NewRedisCache(config RedisConfig) (*RedisCache, error) {
+	if err := validateDB(config.DB, config.Databases); err != nil {
+		return nil, err
+	}
+
 	client := redis.NewClient(&redis.Options{
 		Addr:     config.Addr,
+		Username: config.Username,
 		Password: config.Password,
 		DB:       config.DB,
+
+		// Honour context deadlines, including OpTimeout
+		ContextTimeoutEnabled: true,
 	})
+	if config.OpTimeout > 0 {
+		client.AddHook(redishook.Timeout(config.OpTimeout))
+	}
 
 	ctx := context.Background()
 
-	// Test connection
-	if err := client.Ping(ctx).Err(); err != nil {
+	// Test connection, waiting for Redis to come up if configured
+	if err := pingWithRetry(ctx, client, config.ConnectRetries, config.ConnectBackoff); err != nil {
+		client.Close()
 		return nil, err
 	}
 
+	cache := NewRedisCacheWithClient(client, config)
+	cache.ownsClient = true
+	cache.closer = &clientCloser{}
+	client.AddHook(closedHook{cache.closer})
+	return cache, nil
+}
+
+// validateDB checks db against the server's number of databases (default 16),
+// so a typo fails upfront instead of with an error on the first command
+func validateDB(db, databases int) error {
+	if databases <= 0 {
+		databases = 16
+	}
+	if db < 0 || db >= databases {
+		return fmt.Errorf("redis DB %d out of range, must be between 0 and %d", db, databases-1)
+	}
+	return nil
+}
+
+// pingWithRetry pings Redis, retrying up to retries times with an
+// exponential backoff starting at backoff. It returns the last error.
+func pingWithRetry(ctx context.Context, client *redis.Client, retries int, backoff time.Duration) error {
+	if backoff <= 0 {
+		backoff = 500 * time.Millisecond
+	}
+
+	err := client.Ping(ctx).Err()
+	for attempt := 0; err != nil && attempt < retries; attempt++ {
+		time.Sleep(backoff)
+		backoff *= 2
+		err = client.Ping(ctx).Err()
+	}
+	return err
+}
+
+// clientCloser closes an owned client once and remembers that it did
+type clientCloser struct {
+	mu     sync.Mutex
+	closed bool
+}
+
+// close closes client on the first call and returns nil on later ones
+func (c *clientCloser) close(client *redis.Client) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.closed {
+		return nil
+	}
+	c.closed = true
+	return client.Close()
+}
+
+// isClosed reports whether close has been called
+func (c *clientCloser) isClosed() bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.closed
+}
+
+// closedHook fails commands with ErrClosed once the owned client is closed
+type closedHook struct {
+	closer *clientCloser
+}
+
+// DialHook leaves dialing unchanged
+func (h closedHook) DialHook(next redis.DialHook) redis.DialHook {
+	return next
+}
+
+// ProcessHook rejects a single command after Close
+func (h closedHook) ProcessHook(next redis.ProcessHook) redis.ProcessHook {
+	return func(ctx context.Context, cmd redis.Cmder) error {
+		if h.closer.isClosed() {
+			cmd.SetErr(ErrClosed)
+			return ErrClosed
+		}
+		return next(ctx, cmd)
+	}
+}
+
+// ProcessPipelineHook rejects a whole pipeline or transaction after Close
+func (h closedHook) ProcessPipelineHook(next redis.ProcessPipelineHook) redis.ProcessPipelineHook {
+	return func(ctx context.Context, cmds []redis.Cmder) error {
+		if h.closer.isClosed() {
+			for _, cmd := range cmds {
+				cmd.SetErr(ErrClosed)
+			}
+			return ErrClosed
+		}
+		return next(ctx, cmds)
+	}
+}
+
+// NewRedisCacheWithClient creates a Redis cache on top of an existing client.
+// The connection fields of config are ignored, no Ping is made, and Close
+// leaves the shared client open.
+func NewRedisCacheWithClient(client *redis.Client, config RedisConfig) *RedisCache {
 	prefix := config.Prefix
 	if prefix == "" {
 		prefix = "cache:"
 	}
 
+	channel := config.InvalidationChannel
+	if channel == "" {
+		channel = prefix + "invalidations"
+	}
+
+	deleteBatch := config.DeleteBatchSize
+	if deleteBatch <= 0 {
+		deleteBatch = 1000
+	}
+
+	var tracer trace.Tracer
+	if config.TracerProvider != nil {
+		tracer = config.TracerProvider.Tracer(tracerName)
+	}
+
 	return &RedisCache{
-		client: client,
-		prefix: prefix,
-		ctx:    ctx,
-	}, nil
+		client:              client,
+		prefix:              prefix,
+		tagPrefix:           "tag:",
+		ctx:                 context.Background(),
+		tracer:              tracer,
+		maxValueSize:        config.MaxValueSize,
+		trackAge:            config.TrackAge,
+		defaultTTL:          config.DefaultTTL,
+		strictTTL:           config.StrictTTL,
+		ttlJitter:           config.TTLJitter,
+		deleteBatch:         deleteBatch,
+		generation:          newGeneration(prefix, config.Generations, config.GenerationRefresh),
+		invalidationChannel: channel,
+	}
+}
+
+// WithPrefix returns a view of the cache whose keys live under an extra
+// prefix segment, e.g. "user:". The view shares the Redis client, so it is
+// cheap to create, and Clear, Scan and tags only see the view's own keys.
+// Invalidations go to the view's own channel, <prefix>invalidations.
+// Include a separator in prefix ("user:", not "user"), or Clear on "user"
+// would also match the "users" namespace.
+func (r *RedisCache) WithPrefix(prefix string) *RedisCache {
+	return &RedisCache{
+		client:              r.client,
+		prefix:              r.prefix + prefix,
+		tagPrefix:           r.tagPrefix + prefix,
+		ctx:                 r.ctx,
+		maxValueSize:        r.maxValueSize,
+		trackAge:            r.trackAge,
+		defaultTTL:          r.defaultTTL,
+		strictTTL:           r.strictTTL,
+		ttlJitter:           r.ttlJitter,
+		deleteBatch:         r.deleteBatch,
+		generation:          r.generation.forPrefix(r.prefix + prefix),
+		tracer:              r.tracer,
+		invalidationChannel: r.prefix + prefix + "invalidations",
+	}
 }
 
 // Get retrieves a value from cache
 func (r *RedisCache) Get(key string, dest interface{}) error {
-	fullKey := r.prefix + key
+	return r.GetCtx(r.ctx, key, dest)
+}
+
+// GetCtx retrieves a value from cache using ctx
+func (r *RedisCache) GetCtx(ctx context.Context, key string, dest interface{}) (err error) {
+	ctx, span := r.startSpan(ctx, "cache.Get", key)
+	defer func() { endSpan(span, err) }()
 
-	data, err := r.client.Get(r.ctx, fullKey).Bytes()
+	fullKey := r.key(key)
+
+	data, err := r.client.Get(ctx, fullKey).Bytes()
 	if err == redis.Nil {
 		return ErrCacheMiss
 	}
@@ -89,12 +364,16 @@ func (r *RedisCache) Get(key string, dest interface{}) error {
 		return err
 	}
 
+	setHit(span)
+	if isNegative(data) {
+		return ErrNotFound
+	}
 	return json.Unmarshal(data, dest)
 }
 
 // GetString retrieves a string value from cache
 func (r *RedisCache) GetString(key string) (string, error) {
-	fullKey := r.prefix + key
+	fullKey := r.key(key)
 	result, err := r.client.Get(r.ctx, fullKey).Result()
 	if err == redis.Nil {
 		return "", ErrCacheMiss
@@ -104,7 +383,7 @@ func (r *RedisCache) GetString(key string) (string, error) {
 
 // GetBytes retrieves raw bytes from cache
 func (r *RedisCache) GetBytes(key string) ([]byte, error) {
-	fullKey := r.prefix + key
+	fullKey := r.key(key)
 	result, err := r.client.Get(r.ctx, fullKey).Bytes()
 	if err == redis.Nil {
 		return nil, ErrCacheMiss
@@ -112,69 +391,421 @@ func (r *RedisCache) GetBytes(key string) ([]byte, error) {
 	return result, err
 }
 
-// Set stores a value in cache
+// GetEx retrieves a value from cache and resets its TTL in the same command.
+// The TTL is resolved and jittered like a write's, except that NoExpiration
+// leaves the key's TTL as it is instead of making a sliding key permanent.
+// With TrackAge on, the store time's TTL is reset in the same round-trip.
+// Like Get, it returns ErrNotFound for a cached negative entry, whose TTL is
+// reset as well.
+func (r *RedisCache) GetEx(key string, dest interface{}, ttl time.Duration) error {
+	ttl, err := r.resolveTTL(ttl)
+	if err != nil {
+		return err
+	}
+	ttl = jitterTTL(ttl, r.ttlJitter)
+
+	fullKey := r.key(key)
+
+	var data []byte
+	switch {
+	case ttl == NoExpiration:
+		data, err = r.client.Get(r.ctx, fullKey).Bytes()
+	case r.trackAge:
+		pipe := r.client.TxPipeline()
+		valueCmd := pipe.GetEx(r.ctx, fullKey, ttl)
+		pipe.PExpire(r.ctx, r.metaKey(key), ttl)
+		if _, err := pipe.Exec(r.ctx); err != nil && err != redis.Nil {
+			return err
+		}
+		data, err = valueCmd.Bytes()
+	default:
+		data, err = r.client.GetEx(r.ctx, fullKey, ttl).Bytes()
+	}
+	if err == redis.Nil {
+		return ErrCacheMiss
+	}
+	if err != nil {
+		return err
+	}
+
+	if isNegative(data) {
+		return ErrNotFound
+	}
+	return json.Unmarshal(data, dest)
+}
+
+// GetDel retrieves a value from cache and deletes it atomically,
+// so single-use values can only be consumed once. Like Get, it returns
+// ErrNotFound for a cached negative entry, which is deleted as well.
+func (r *RedisCache) GetDel(key string, dest interface{}) error {
+	fullKey := r.key(key)
+
+	data, err := r.client.GetDel(r.ctx, fullKey).Bytes()
+	if err == redis.Nil {
+		return ErrCacheMiss
+	}
+	if err != nil {
+		return err
+	}
+
+	if isNegative(data) {
+		return ErrNotFound
+	}
+	return json.Unmarshal(data, dest)
+}
+
+// GetMulti retrieves several values with a single MGET. dest must be a
+// non-nil map[string]T; every key found is decoded into a new T and stored
+// in it. The keys that missed are returned in the order given, so callers
+// can load just those and backfill the cache. Cached negative entries are
+// neither stored in dest nor reported missing.
+func (r *RedisCache) GetMulti(keys []string, dest interface{}) ([]string, error) {
+	destMap := reflect.ValueOf(dest)
+	if destMap.Kind() != reflect.Map || destMap.IsNil() || destMap.Type().Key().Kind() != reflect.String {
+		return nil, errors.New("cache: GetMulti dest must be a non-nil map[string]T")
+	}
+
+	if len(keys) == 0 {
+		return nil, nil
+	}
+
+	fullKeys := make([]string, len(keys))
+	for i, key := range keys {
+		fullKeys[i] = r.key(key)
+	}
+
+	values, err := r.client.MGet(r.ctx, fullKeys...).Result()
+	if err != nil {
+		return nil, err
+	}
+
+	var missing []string
+	elemType := destMap.Type().Elem()
+	for i, value := range values {
+		data, ok := value.(string)
+		if !ok {
+			missing = append(missing, keys[i])
+			continue
+		}
+		if isNegative([]byte(data)) {
+			continue
+		}
+
+		elem := reflect.New(elemType)
+		if err := json.Unmarshal([]byte(data), elem.Interface()); err != nil {
+			return nil, err
+		}
+		destMap.SetMapIndex(reflect.ValueOf(keys[i]).Convert(destMap.Type().Key()), elem.Elem())
+	}
+
+	return missing, nil
+}
+
+// Set stores a value in cache. A ttl of NoExpiration (0) keeps the value until
+// it is deleted, cleared or evicted by Redis' maxmemory policy (unless
+// StrictTTL is on), and DefaultExpiration uses RedisConfig.DefaultTTL.
+// Other negative TTLs return ErrInvalidTTL.
 func (r *RedisCache) Set(key string, value interface{}, ttl time.Duration) error {
-	fullKey := r.prefix + key
+	return r.SetCtx(r.ctx, key, value, ttl)
+}
+
+// SetPermanent stores a value without expiry, even when StrictTTL is on
+func (r *RedisCache) SetPermanent(key string, value interface{}) error {
+	return r.SetCtx(r.ctx, key, value, permanentTTL)
+}
+
+// SetCtx stores a value in cache using ctx
+func (r *RedisCache) SetCtx(ctx context.Context, key string, value interface{}, ttl time.Duration) (err error) {
+	ctx, span := r.startSpan(ctx, "cache.Set", key)
+	defer func() { endSpan(span, err) }()
 
 	data, err := json.Marshal(value)
 	if err != nil {
 		return err
 	}
 
-	return r.client.Set(r.ctx, fullKey, data, ttl).Err()
+	if err := r.checkSize(key, len(data)); err != nil {
+		return err
+	}
+
+	return r.write(ctx, key, data, ttl)
 }
 
 // SetString stores a string value in cache
 func (r *RedisCache) SetString(key string, value string, ttl time.Duration) error {
-	fullKey := r.prefix + key
-	return r.client.Set(r.ctx, fullKey, value, ttl).Err()
+	if err := r.checkSize(key, len(value)); err != nil {
+		return err
+	}
+
+	return r.write(r.ctx, key, value, ttl)
 }
 
 // SetBytes stores raw bytes in cache
 func (r *RedisCache) SetBytes(key string, value []byte, ttl time.Duration) error {
-	fullKey := r.prefix + key
-	return r.client.Set(r.ctx, fullKey, value, ttl).Err()
+	if err := r.checkSize(key, len(value)); err != nil {
+		return err
+	}
+
+	return r.write(r.ctx, key, value, ttl)
+}
+
+// CompareAndSwap stores newValue only if the value under key still equals
+// oldValue, comparing JSON encodings as written by Set. It returns false when
+// the value is missing or changed concurrently, so the caller can reload and retry.
+func (r *RedisCache) CompareAndSwap(key string, oldValue, newValue interface{}, ttl time.Duration) (bool, error) {
+	fullKey := r.key(key)
+
+	oldData, err := json.Marshal(oldValue)
+	if err != nil {
+		return false, err
+	}
+
+	newData, err := json.Marshal(newValue)
+	if err != nil {
+		return false, err
+	}
+
+	if err := r.checkSize(key, len(newData)); err != nil {
+		return false, err
+	}
+
+	ttl, err = r.resolveTTL(ttl)
+	if err != nil {
+		return false, err
+	}
+	ttl = jitterTTL(ttl, r.ttlJitter)
+
+	swapped := false
+	err = r.client.Watch(r.ctx, func(tx *redis.Tx) error {
+		current, err := tx.Get(r.ctx, fullKey).Bytes()
+		if err == redis.Nil {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if !bytes.Equal(current, oldData) {
+			return nil
+		}
+
+		// EXEC fails with TxFailedErr if the key changed since WATCH
+		_, err = tx.TxPipelined(r.ctx, func(pipe redis.Pipeliner) error {
+			pipe.Set(r.ctx, fullKey, newData, ttl)
+			if r.trackAge {
+				pipe.Set(r.ctx, r.metaKey(key), time.Now().UnixMilli(), ttl)
+			}
+			return nil
+		})
+		swapped = err == nil
+		return err
+	}, fullKey)
+
+	if err == redis.TxFailedErr {
+		return false, nil
+	}
+	return swapped, err
+}
+
+// checkSize rejects values larger than MaxValueSize, logging and counting each rejection
+func (r *RedisCache) checkSize(key string, size int) error {
+	if r.maxValueSize <= 0 || size <= r.maxValueSize {
+		return nil
+	}
+
+	atomic.AddInt64(&r.rejectedWrites, 1)
+	log.Printf("cache: rejected %d byte value for key %q (max %d)", size, key, r.maxValueSize)
+	return fmt.Errorf("%w: %d bytes for key %q (max %d)", ErrValueTooLarge, size, key, r.maxValueSize)
+}
+
+// resolveTTL replaces DefaultExpiration with the configured default TTL and
+// rejects TTLs that would silently create a key that never expires
+func (r *RedisCache) resolveTTL(ttl time.Duration) (time.Duration, error) {
+	switch {
+	case ttl == DefaultExpiration:
+		return r.defaultTTL, nil
+	case ttl == permanentTTL:
+		return NoExpiration, nil
+	case ttl < 0:
+		return 0, fmt.Errorf("%w: %v", ErrInvalidTTL, ttl)
+	case ttl == NoExpiration && r.strictTTL:
+		return 0, fmt.Errorf("%w: NoExpiration with StrictTTL, use SetPermanent", ErrInvalidTTL)
+	}
+	return ttl, nil
+}
+
+// jitterTTL moves ttl by a random amount of up to ±jitter. TTLs of
+// NoExpiration, and TTLs the jitter could push to zero, are left as they are.
+func jitterTTL(ttl, jitter time.Duration) time.Duration {
+	if ttl <= 0 || jitter <= 0 {
+		return ttl
+	}
+
+	jittered := ttl + time.Duration(rand.Int63n(int64(2*jitter)+1)) - jitter
+	if jittered <= 0 {
+		return ttl
+	}
+	return jittered
+}
+
+// jitteredKey marks a context whose writes carry an already jittered TTL
+type jitteredKey struct{}
+
+// withJitteredTTL marks ctx so writes made with it aren't jittered again, for
+// callers such as the middleware that apply a TTLJitter of their own
+func withJitteredTTL(ctx context.Context) context.Context {
+	return context.WithValue(ctx, jitteredKey{}, true)
+}
+
+// ttlJittered reports whether ctx was marked by withJitteredTTL
+func ttlJittered(ctx context.Context) bool {
+	return ctx.Value(jitteredKey{}) != nil
+}
+
+// RejectedWrites returns how many writes were rejected for exceeding MaxValueSize
+func (r *RedisCache) RejectedWrites() int64 {
+	return atomic.LoadInt64(&r.rejectedWrites)
 }
 
 // Delete removes a value from cache
 func (r *RedisCache) Delete(key string) error {
-	fullKey := r.prefix + key
-	return r.client.Del(r.ctx, fullKey).Err()
+	return r.DeleteMany(key)
 }
 
 // DeleteMany removes multiple keys from cache
 func (r *RedisCache) DeleteMany(keys ...string) error {
-	fullKeys := make([]string, len(keys))
-	for i, key := range keys {
-		fullKeys[i] = r.prefix + key
+	fullKeys := make([]string, 0, len(keys))
+	for _, key := range keys {
+		fullKeys = append(fullKeys, r.key(key))
+		if r.trackAge {
+			fullKeys = append(fullKeys, r.metaKey(key))
+		}
 	}
-	return r.client.Del(r.ctx, fullKeys...).Err()
+	return r.del(fullKeys)
+}
+
+// del deletes full keys, splitting them into pipelined DELs of at most
+// deleteBatch keys so a huge deletion doesn't stall Redis
+func (r *RedisCache) del(keys []string) error {
+	if len(keys) == 0 {
+		return nil
+	}
+
+	if len(keys) <= r.deleteBatch {
+		return r.client.Del(r.ctx, keys...).Err()
+	}
+
+	pipe := r.client.Pipeline()
+	for start := 0; start < len(keys); start += r.deleteBatch {
+		end := start + r.deleteBatch
+		if end > len(keys) {
+			end = len(keys)
+		}
+		pipe.Del(r.ctx, keys[start:end]...)
+	}
+	_, err := pipe.Exec(r.ctx)
+	return err
 }
 
 // Exists checks if a key exists
 func (r *RedisCache) Exists(key string) (bool, error) {
-	fullKey := r.prefix + key
+	fullKey := r.key(key)
 	result, err := r.client.Exists(r.ctx, fullKey).Result()
 	return result > 0, err
 }
 
-// Clear removes all cached items with the prefix
+// ExistsMany reports which of keys exist, checking them all in one
+// pipelined round-trip. Every key is present in the result.
+func (r *RedisCache) ExistsMany(keys ...string) (map[string]bool, error) {
+	found := make(map[string]bool, len(keys))
+	if len(keys) == 0 {
+		return found, nil
+	}
+
+	pipe := r.client.Pipeline()
+	cmds := make([]*redis.IntCmd, len(keys))
+	for i, key := range keys {
+		cmds[i] = pipe.Exists(r.ctx, r.key(key))
+	}
+	if _, err := pipe.Exec(r.ctx); err != nil {
+		return nil, err
+	}
+
+	for i, key := range keys {
+		found[key] = cmds[i].Val() > 0
+	}
+	return found, nil
+}
+
+// Clear removes all cached items with the prefix, of every generation. It
+// lists the keys and then deletes them, so items written while it runs may
+// or may not survive. ClearLazy invalidates atomically.
 func (r *RedisCache) Clear() error {
 	keys, err := r.client.Keys(r.ctx, r.prefix+"*").Result()
 	if err != nil {
 		return err
 	}
 
-	if len(keys) > 0 {
-		return r.client.Del(r.ctx, keys...).Err()
+	if r.trackAge {
+		ageKeys, err := r.client.Keys(r.ctx, ageKeyPrefix+r.prefix+"*").Result()
+		if err != nil {
+			return err
+		}
+		keys = append(keys, ageKeys...)
 	}
 
-	return nil
+	// Keep counting generations, so instances that cached the current one
+	// don't go back to keys of older ones
+	if r.generation != nil {
+		for i, key := range keys {
+			if key == r.generation.key {
+				keys = append(keys[:i], keys[i+1:]...)
+				break
+			}
+		}
+	}
+
+	return r.del(keys)
+}
+
+// Scan calls fn for every cached key matching the pattern, without the prefix.
+// Keys are iterated with SCAN so Redis is never blocked; iteration stops at
+// the first error returned by fn.
+func (r *RedisCache) Scan(match string, fn func(key string) error) error {
+	if match == "" {
+		match = "*"
+	}
+
+	prefix := r.keyPrefix()
+	iter := r.client.Scan(r.ctx, 0, prefix+match, 100).Iterator()
+	for iter.Next(r.ctx) {
+		if err := fn(strings.TrimPrefix(iter.Val(), prefix)); err != nil {
+			return err
+		}
+	}
+	return iter.Err()
 }
 
-// Close closes the Redis connection
+// Close stops the invalidation subscriber and closes the Redis connection.
+// It may be called more than once; commands made afterwards fail with
+// ErrClosed. Clients passed to NewRedisCacheWithClient are left open.
 func (r *RedisCache) Close() error {
-	return r.client.Close()
+	r.StopInvalidations()
+	if !r.ownsClient {
+		return nil
+	}
+	return r.closer.close(r.client)
+}
+
+// Ping checks that Redis is reachable, giving up after pingTimeout
+func (r *RedisCache) Ping(ctx context.Context) error {
+	ctx, cancel := context.WithTimeout(ctx, pingTimeout)
+	defer cancel()
+	return r.client.Ping(ctx).Err()
+}
+
+// Stats returns connection pool statistics
+func (r *RedisCache) Stats() *redis.PoolStats {
+	return r.client.PoolStats()
 }
 
 // GetClient returns the underlying Redis client
@@ -184,39 +815,83 @@ func (r *RedisCache) GetClient() *redis.Client {
 
 // Increment increments a numeric value
 func (r *RedisCache) Increment(key string) (int64, error) {
-	fullKey := r.prefix + key
+	fullKey := r.key(key)
 	return r.client.Incr(r.ctx, fullKey).Result()
 }
 
 // Decrement decrements a numeric value
 func (r *RedisCache) Decrement(key string) (int64, error) {
-	fullKey := r.prefix + key
+	fullKey := r.key(key)
 	return r.client.Decr(r.ctx, fullKey).Result()
 }
 
 // IncrementBy increments by a specific amount
 func (r *RedisCache) IncrementBy(key string, value int64) (int64, error) {
-	fullKey := r.prefix + key
+	fullKey := r.key(key)
 	return r.client.IncrBy(r.ctx, fullKey, value).Result()
 }
 
+// IncrementByFloat increments by a floating point amount and returns the new value
+func (r *RedisCache) IncrementByFloat(key string, value float64) (float64, error) {
+	fullKey := r.key(key)
+	return r.client.IncrByFloat(r.ctx, fullKey, value).Result()
+}
+
+// incrementWithTTLScript increments a counter and sets its expiry only when it is created
+var incrementWithTTLScript = redis.NewScript(`
+local count = redis.call("INCR", KEYS[1])
+if count == 1 then
+	redis.call("PEXPIRE", KEYS[1], ARGV[1])
+end
+return count
+`)
+
+// IncrementWithTTL increments a numeric value, expiring it ttl after it was
+// first created. A ttl <= 0 returns ErrInvalidTTL, as a counter that never
+// expires (or is deleted at once) is never what a window counter wants.
+func (r *RedisCache) IncrementWithTTL(key string, ttl time.Duration) (int64, error) {
+	if ttl <= 0 {
+		return 0, fmt.Errorf("%w: %v", ErrInvalidTTL, ttl)
+	}
+	fullKey := r.key(key)
+	return incrementWithTTLScript.Run(r.ctx, r.client, []string{fullKey}, ttl.Milliseconds()).Int64()
+}
+
 // TTL returns the remaining time to live for a key
 func (r *RedisCache) TTL(key string) (time.Duration, error) {
-	fullKey := r.prefix + key
+	fullKey := r.key(key)
 	return r.client.TTL(r.ctx, fullKey).Result()
 }
 
 // Expire sets a timeout on a key
 func (r *RedisCache) Expire(key string, ttl time.Duration) error {
-	fullKey := r.prefix + key
+	fullKey := r.key(key)
 	return r.client.Expire(r.ctx, fullKey, ttl).Err()
 }
 
 // Remember retrieves from cache or executes a function and stores the result
 func (r *RedisCache) Remember(key string, ttl time.Duration, fn func() (interface{}, error), dest interface{}) error {
+	return r.RememberCtx(r.ctx, key, ttl, func(context.Context) (interface{}, error) {
+		return fn()
+	}, dest)
+}
+
+// RememberForever is like Remember but stores the result without expiry,
+// even when StrictTTL is on
+func (r *RedisCache) RememberForever(key string, fn func() (interface{}, error), dest interface{}) error {
+	return r.Remember(key, permanentTTL, fn, dest)
+}
+
+// RememberCtx is like Remember but passes ctx to Redis and to the loader,
+// so the work stops when the originating request is cancelled
+func (r *RedisCache) RememberCtx(ctx context.Context, key string, ttl time.Duration, fn func(context.Context) (interface{}, error), dest interface{}) (err error) {
+	ctx, span := r.startSpan(ctx, "cache.Remember", key)
+	defer func() { endSpan(span, err) }()
+
 	// Try to get from cache
-	err := r.Get(key, dest)
+	err = r.GetCtx(ctx, key, dest)
 	if err == nil {
+		setHit(span)
 		return nil
 	}
 
@@ -224,14 +899,19 @@ func (r *RedisCache) Remember(key string, ttl time.Duration, fn func() (interfac
 		return err
 	}
 
+	// Don't start the loader for a request that is already gone
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
 	// Execute function
-	value, err := fn()
+	value, err := fn(ctx)
 	if err != nil {
 		return err
 	}
 
 	// Store in cache
-	if err := r.Set(key, value, ttl); err != nil {
+	if err := r.SetCtx(ctx, key, value, ttl); err != nil {
 		return err
 	}
 
@@ -244,6 +924,13 @@ func (r *RedisCache) Remember(key string, ttl time.Duration, fn func() (interfac
 	return json.Unmarshal(data, dest)
 }
 
+const (
+	// tagFlushBatchSize is how many tag members are scanned before unlinking them
+	tagFlushBatchSize = 1000
+	// tagUnlinkChunkSize is the number of keys per UNLINK command
+	tagUnlinkChunkSize = 100
+)
+
 // Tags support for cache invalidation
 type TaggedCache struct {
 	cache  *RedisCache
@@ -256,54 +943,151 @@ func (r *RedisCache) Tags(tags ...string) *TaggedCache {
 	return &TaggedCache{
 		cache:  r,
 		tags:   tags,
-		prefix: "tag:",
+		prefix: r.tagPrefix,
 	}
 }
 
 // Set stores a value with tags
 func (t *TaggedCache) Set(key string, value interface{}, ttl time.Duration) error {
+	return t.setCtx(t.cache.ctx, key, value, ttl)
+}
+
+// setCtx stores a value with tags, writing the value using ctx
+func (t *TaggedCache) setCtx(ctx context.Context, key string, value interface{}, ttl time.Duration) error {
 	// Store the actual value
-	if err := t.cache.Set(key, value, ttl); err != nil {
+	if err := t.cache.SetCtx(ctx, key, value, ttl); err != nil {
+		return err
+	}
+
+	ttl, err := t.cache.resolveTTL(ttl)
+	if err != nil {
 		return err
 	}
 
-	// Store tag references
+	// Store tag references in a single round-trip
+	pipe := t.cache.client.Pipeline()
 	for _, tag := range t.tags {
 		tagKey := t.prefix + tag
 		// Add key to tag's set
-		t.cache.client.SAdd(t.cache.ctx, tagKey, key)
-		// Set expiration on tag key if ttl is specified
+		pipe.SAdd(t.cache.ctx, tagKey, key)
+		// Set expiration on tag key if ttl is specified (plus the jitter, so
+		// it outlives the value), otherwise keep the tag around as long as
+		// the value so Flush can still find it
 		if ttl > 0 {
-			t.cache.client.Expire(t.cache.ctx, tagKey, ttl)
+			pipe.Expire(t.cache.ctx, tagKey, ttl+t.cache.ttlJitter)
+		} else {
+			pipe.Persist(t.cache.ctx, tagKey)
+		}
+	}
+
+	_, err = pipe.Exec(t.cache.ctx)
+	return err
+}
+
+// Get retrieves a tagged value from cache
+func (t *TaggedCache) Get(key string, dest interface{}) error {
+	return t.cache.Get(key, dest)
+}
+
+// Remember retrieves from cache or executes a function and stores the result under the tags
+func (t *TaggedCache) Remember(key string, ttl time.Duration, fn func() (interface{}, error), dest interface{}) error {
+	// Try to get from cache
+	err := t.Get(key, dest)
+	if err == nil {
+		return nil
+	}
+
+	if err != ErrCacheMiss {
+		return err
+	}
+
+	// Execute function
+	value, err := fn()
+	if err != nil {
+		return err
+	}
+
+	// Store in cache and register with tags
+	if err := t.Set(key, value, ttl); err != nil {
+		return err
+	}
+
+	// Marshal and unmarshal to populate dest
+	data, err := json.Marshal(value)
+	if err != nil {
+		return err
+	}
+
+	return json.Unmarshal(data, dest)
+}
+
+// Forget removes a single key from cache and from each tag
+func (t *TaggedCache) Forget(key string) error {
+	if err := t.cache.Delete(key); err != nil {
+		return err
+	}
+
+	for _, tag := range t.tags {
+		if err := t.cache.client.SRem(t.cache.ctx, t.prefix+tag, key).Err(); err != nil {
+			return err
 		}
 	}
 
 	return nil
 }
 
-// Flush removes all cached items with the specified tags
+// Flush removes all cached items with the specified tags.
+// Tag members are streamed with SSCAN and unlinked in pipelined batches,
+// so large tags never have to be loaded at once.
 func (t *TaggedCache) Flush() error {
 	for _, tag := range t.tags {
 		tagKey := t.prefix + tag
-		
-		// Get all keys associated with this tag
-		keys, err := t.cache.client.SMembers(t.cache.ctx, tagKey).Result()
-		if err != nil {
-			return err
-		}
 
-		// Delete all keys
-		if len(keys) > 0 {
-			fullKeys := make([]string, len(keys))
-			for i, key := range keys {
-				fullKeys[i] = t.cache.prefix + key
+		iter := t.cache.client.SScan(t.cache.ctx, tagKey, 0, "", tagFlushBatchSize).Iterator()
+		batch := make([]string, 0, tagFlushBatchSize)
+		for iter.Next(t.cache.ctx) {
+			batch = append(batch, t.cache.key(iter.Val()))
+			if t.cache.trackAge {
+				batch = append(batch, t.cache.metaKey(iter.Val()))
+			}
+			if len(batch) >= tagFlushBatchSize {
+				if err := t.unlink(batch); err != nil {
+					return err
+				}
+				batch = batch[:0]
 			}
-			t.cache.client.Del(t.cache.ctx, fullKeys...)
+		}
+		if err := iter.Err(); err != nil {
+			return err
+		}
+		if err := t.unlink(batch); err != nil {
+			return err
 		}
 
 		// Delete the tag key itself
-		t.cache.client.Del(t.cache.ctx, tagKey)
+		if err := t.cache.client.Unlink(t.cache.ctx, tagKey).Err(); err != nil {
+			return err
+		}
 	}
 
 	return nil
 }
+
+// unlink removes keys in pipelined UNLINK commands of at most tagUnlinkChunkSize keys
+func (t *TaggedCache) unlink(keys []string) error {
+	if len(keys) == 0 {
+		return nil
+	}
+
+	pipe := t.cache.client.Pipeline()
+	for start := 0; start < len(keys); start += tagUnlinkChunkSize {
+		end := start + tagUnlinkChunkSize
+		if end > len(keys) {
+			end = len(keys)
+		}
+		pipe.Unlink(t.cache.ctx, keys[start:end]...)
+	}
+
+	_, err := pipe.Exec(t.cache.ctx)
+	return err
+}
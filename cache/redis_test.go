@@ -0,0 +1,434 @@
+package cache
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/redis/go-redis/v9"
+)
+
+// newTestRedisCache returns a RedisCache backed by an in-memory Redis server
+func newTestRedisCache(t *testing.T, config RedisConfig) (*RedisCache, *miniredis.Miniredis) {
+	t.Helper()
+
+	server := miniredis.RunT(t)
+	client := redis.NewClient(&redis.Options{Addr: server.Addr()})
+	t.Cleanup(func() { client.Close() })
+
+	return NewRedisCacheWithClient(client, config), server
+}
+
+// scanKeys returns every key Scan reports for match
+func scanKeys(t *testing.T, c *RedisCache, match string) []string {
+	t.Helper()
+	var keys []string
+	if err := c.Scan(match, func(key string) error {
+		keys = append(keys, key)
+		return nil
+	}); err != nil {
+		t.Fatalf("Scan: %v", err)
+	}
+	return keys
+}
+
+// commandLog is a go-redis hook recording every command sent, pipelined or not
+type commandLog struct {
+	mu   sync.Mutex
+	cmds []redis.Cmder
+}
+
+// logCommands starts recording the commands c sends
+func logCommands(c *RedisCache) *commandLog {
+	l := &commandLog{}
+	c.GetClient().AddHook(l)
+	return l
+}
+
+func (l *commandLog) DialHook(next redis.DialHook) redis.DialHook {
+	return next
+}
+
+func (l *commandLog) ProcessHook(next redis.ProcessHook) redis.ProcessHook {
+	return func(ctx context.Context, cmd redis.Cmder) error {
+		l.record(cmd)
+		return next(ctx, cmd)
+	}
+}
+
+func (l *commandLog) ProcessPipelineHook(next redis.ProcessPipelineHook) redis.ProcessPipelineHook {
+	return func(ctx context.Context, cmds []redis.Cmder) error {
+		l.record(cmds...)
+		return next(ctx, cmds)
+	}
+}
+
+func (l *commandLog) record(cmds ...redis.Cmder) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.cmds = append(l.cmds, cmds...)
+}
+
+// named returns the recorded commands called name, e.g. "del"
+func (l *commandLog) named(name string) []redis.Cmder {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	var cmds []redis.Cmder
+	for _, cmd := range l.cmds {
+		if cmd.Name() == name {
+			cmds = append(cmds, cmd)
+		}
+	}
+	return cmds
+}
+
+func TestIncrementByFloat(t *testing.T) {
+	c, server := newTestRedisCache(t, RedisConfig{Prefix: "app:"})
+
+	// Decimal steps come back rounded the way Redis prints them, rather
+	// than accumulating binary floating point error
+	var total float64
+	for i := 0; i < 10; i++ {
+		var err error
+		if total, err = c.IncrementByFloat("total", 0.1); err != nil {
+			t.Fatalf("IncrementByFloat: %v", err)
+		}
+	}
+	if total != 1 {
+		t.Errorf("total = %v, want 1", total)
+	}
+
+	total, err := c.IncrementByFloat("total", -0.25)
+	if err != nil {
+		t.Fatalf("IncrementByFloat: %v", err)
+	}
+	if total != 0.75 {
+		t.Errorf("total = %v, want 0.75", total)
+	}
+
+	if got, err := server.Get("app:total"); err != nil || got != "0.75" {
+		t.Errorf("stored value = %q, %v; want 0.75 under the prefix", got, err)
+	}
+}
+
+func TestIncrementWithTTL(t *testing.T) {
+	c, server := newTestRedisCache(t, RedisConfig{})
+
+	for _, ttl := range []time.Duration{0, DefaultExpiration, -time.Second} {
+		if _, err := c.IncrementWithTTL("hits", ttl); !errors.Is(err, ErrInvalidTTL) {
+			t.Errorf("IncrementWithTTL(%v) = %v, want ErrInvalidTTL", ttl, err)
+		}
+	}
+	if server.Exists("cache:hits") {
+		t.Fatal("rejected increments created the counter")
+	}
+
+	// The window starts at the first increment and isn't extended by later ones
+	for want := int64(1); want <= 2; want++ {
+		count, err := c.IncrementWithTTL("hits", time.Minute)
+		if err != nil || count != want {
+			t.Fatalf("IncrementWithTTL = %d, %v; want %d", count, err, want)
+		}
+		server.FastForward(10 * time.Second)
+	}
+	if ttl := server.TTL("cache:hits"); ttl != 40*time.Second {
+		t.Errorf("TTL = %v, want 40s", ttl)
+	}
+}
+
+func TestGetExTTL(t *testing.T) {
+	c, server := newTestRedisCache(t, RedisConfig{DefaultTTL: 10 * time.Minute, TrackAge: true})
+	if err := c.Set("k", "v", time.Minute); err != nil {
+		t.Fatalf("Set: %v", err)
+	}
+
+	var value string
+	if err := c.GetEx("k", &value, -time.Second); !errors.Is(err, ErrInvalidTTL) {
+		t.Errorf("GetEx with a negative TTL = %v, want ErrInvalidTTL", err)
+	}
+
+	// DefaultExpiration slides to the default TTL, the store time along with it
+	if err := c.GetEx("k", &value, DefaultExpiration); err != nil || value != "v" {
+		t.Fatalf("GetEx = %q, %v; want v", value, err)
+	}
+	for _, key := range []string{"cache:k", "age:cache:k"} {
+		if ttl := server.TTL(key); ttl != 10*time.Minute {
+			t.Errorf("TTL of %s = %v, want 10m", key, ttl)
+		}
+	}
+
+	// NoExpiration reads without making the key permanent
+	server.FastForward(time.Minute)
+	if err := c.GetEx("k", &value, NoExpiration); err != nil {
+		t.Fatalf("GetEx with NoExpiration: %v", err)
+	}
+	if ttl := server.TTL("cache:k"); ttl != 9*time.Minute {
+		t.Errorf("TTL after GetEx with NoExpiration = %v, want 9m", ttl)
+	}
+
+	strict, _ := newTestRedisCache(t, RedisConfig{StrictTTL: true})
+	if err := strict.GetEx("k", &value, NoExpiration); !errors.Is(err, ErrInvalidTTL) {
+		t.Errorf("GetEx with NoExpiration and StrictTTL = %v, want ErrInvalidTTL", err)
+	}
+}
+
+func TestWithPrefixIsolation(t *testing.T) {
+	c, server := newTestRedisCache(t, RedisConfig{Prefix: "cache:"})
+	users := c.WithPrefix("user:")
+	products := c.WithPrefix("product:")
+
+	for _, view := range []*RedisCache{users, products} {
+		if err := view.Set("1", "one", time.Minute); err != nil {
+			t.Fatalf("Set: %v", err)
+		}
+	}
+	if !server.Exists("cache:user:1") || !server.Exists("cache:product:1") {
+		t.Fatalf("keys = %v, want one per namespace", server.Keys())
+	}
+
+	var value string
+	if err := users.Get("1", &value); err != nil || value != "one" {
+		t.Errorf("users.Get = %q, %v", value, err)
+	}
+	if keys := scanKeys(t, users, "*"); len(keys) != 1 || keys[0] != "1" {
+		t.Errorf("users.Scan = %v, want [1]", keys)
+	}
+
+	// Clearing one namespace leaves the other alone
+	if err := users.Clear(); err != nil {
+		t.Fatalf("Clear: %v", err)
+	}
+	if server.Exists("cache:user:1") {
+		t.Error("users.Clear left its own key")
+	}
+	if err := products.Get("1", &value); err != nil {
+		t.Errorf("products.Get after users.Clear: %v", err)
+	}
+}
+
+func TestDeleteManyEmpty(t *testing.T) {
+	c, _ := newTestRedisCache(t, RedisConfig{})
+	sent := logCommands(c)
+
+	if err := c.DeleteMany(); err != nil {
+		t.Fatalf("DeleteMany(): %v", err)
+	}
+	if len(sent.cmds) != 0 {
+		t.Errorf("DeleteMany() sent %v, want nothing", sent.cmds)
+	}
+}
+
+func TestDeleteManyBatches(t *testing.T) {
+	c, server := newTestRedisCache(t, RedisConfig{Prefix: "app:"})
+	keys := make([]string, 5000)
+	for i := range keys {
+		keys[i] = strconv.Itoa(i)
+		if err := server.Set("app:"+keys[i], "v"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := server.Set("other", "v"); err != nil {
+		t.Fatal(err)
+	}
+
+	sent := logCommands(c)
+	if err := c.DeleteMany(keys...); err != nil {
+		t.Fatalf("DeleteMany: %v", err)
+	}
+
+	// The default batch size of 1000 splits them into five DELs
+	dels := sent.named("del")
+	if len(dels) != 5 {
+		t.Errorf("sent %d DELs, want 5", len(dels))
+	}
+	for _, cmd := range dels {
+		if n := len(cmd.Args()) - 1; n != 1000 {
+			t.Errorf("DEL of %d keys, want 1000", n)
+		}
+	}
+	if keys := server.Keys(); len(keys) != 1 || keys[0] != "other" {
+		t.Errorf("keys left = %d, want only the unrelated one", len(keys))
+	}
+
+	// A smaller configured batch size makes more DELs
+	c2, _ := newTestRedisCache(t, RedisConfig{DeleteBatchSize: 2})
+	sent = logCommands(c2)
+	if err := c2.DeleteMany("a", "b", "c"); err != nil {
+		t.Fatalf("DeleteMany: %v", err)
+	}
+	if dels := sent.named("del"); len(dels) != 2 {
+		t.Errorf("sent %d DELs with DeleteBatchSize 2, want 2", len(dels))
+	}
+}
+
+func TestSetTTLValidation(t *testing.T) {
+	tests := []struct {
+		name    string
+		config  RedisConfig
+		ttl     time.Duration
+		wantErr bool
+		wantTTL time.Duration // 0 means stored without expiry
+	}{
+		{"positive", RedisConfig{}, time.Minute, false, time.Minute},
+		{"negative", RedisConfig{}, -time.Second, true, 0},
+		{"no expiration", RedisConfig{}, NoExpiration, false, 0},
+		{"no expiration strict", RedisConfig{StrictTTL: true}, NoExpiration, true, 0},
+		{"default", RedisConfig{DefaultTTL: time.Hour}, DefaultExpiration, false, time.Hour},
+		{"default unset", RedisConfig{}, DefaultExpiration, false, 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c, server := newTestRedisCache(t, tt.config)
+
+			err := c.Set("k", "v", tt.ttl)
+			if tt.wantErr {
+				if !errors.Is(err, ErrInvalidTTL) {
+					t.Errorf("Set error = %v, want ErrInvalidTTL", err)
+				}
+				if server.Exists("cache:k") {
+					t.Error("rejected value was stored")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Set: %v", err)
+			}
+			if got := server.TTL("cache:k"); got != tt.wantTTL {
+				t.Errorf("TTL = %v, want %v", got, tt.wantTTL)
+			}
+		})
+	}
+}
+
+func TestSetPermanent(t *testing.T) {
+	c, server := newTestRedisCache(t, RedisConfig{StrictTTL: true})
+
+	if err := c.SetPermanent("k", "v"); err != nil {
+		t.Fatalf("SetPermanent: %v", err)
+	}
+	if !server.Exists("cache:k") || server.TTL("cache:k") != 0 {
+		t.Errorf("exists = %v, TTL = %v; want stored without expiry", server.Exists("cache:k"), server.TTL("cache:k"))
+	}
+}
+
+func TestTTLJitter(t *testing.T) {
+	c, server := newTestRedisCache(t, RedisConfig{TTLJitter: time.Minute})
+
+	ttls := make(map[time.Duration]bool)
+	for _, key := range []string{"a", "b", "c"} {
+		if err := c.Set(key, "v", 10*time.Minute); err != nil {
+			t.Fatalf("Set: %v", err)
+		}
+		ttl := server.TTL("cache:" + key)
+		if ttl < 9*time.Minute || ttl > 11*time.Minute {
+			t.Errorf("TTL of %s = %v, want 10m ±1m", key, ttl)
+		}
+		ttls[ttl] = true
+	}
+	if len(ttls) == 1 {
+		t.Error("keys set with the same TTL got identical TTLs")
+	}
+
+	// Keys without expiry stay that way
+	if err := c.Set("forever", "v", NoExpiration); err != nil {
+		t.Fatalf("Set: %v", err)
+	}
+	if ttl := server.TTL("cache:forever"); ttl != 0 {
+		t.Errorf("TTL of a NoExpiration key = %v, want none", ttl)
+	}
+}
+
+func TestJitterTTLBounds(t *testing.T) {
+	for i := 0; i < 1000; i++ {
+		if ttl := jitterTTL(time.Minute, 10*time.Second); ttl < 50*time.Second || ttl > 70*time.Second {
+			t.Fatalf("jitterTTL = %v, want 1m ±10s", ttl)
+		}
+		// Jitter larger than the TTL never makes it expire immediately
+		if ttl := jitterTTL(time.Second, time.Minute); ttl <= 0 {
+			t.Fatalf("jitterTTL = %v, want a positive TTL", ttl)
+		}
+	}
+}
+
+// blackhole is a TCP proxy to a Redis server that, once cut, swallows
+// everything sent to it without answering, like a network partition
+type blackhole struct {
+	net.Listener
+	cut atomic.Bool
+}
+
+// newBlackhole starts a proxy to addr, closed when the test ends
+func newBlackhole(t *testing.T, addr string) *blackhole {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	b := &blackhole{Listener: ln}
+	t.Cleanup(func() { ln.Close() })
+
+	go func() {
+		for {
+			client, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			server, err := net.Dial("tcp", addr)
+			if err != nil {
+				client.Close()
+				continue
+			}
+			t.Cleanup(func() { client.Close(); server.Close() })
+			go io.Copy(client, server)
+			go b.forward(server, client)
+		}
+	}()
+	return b
+}
+
+// forward copies src to dst until the proxy is cut, then drops the data
+func (b *blackhole) forward(dst, src net.Conn) {
+	buf := make([]byte, 4096)
+	for {
+		n, err := src.Read(buf)
+		if err != nil {
+			return
+		}
+		if !b.cut.Load() {
+			dst.Write(buf[:n])
+		}
+	}
+}
+
+func TestOpTimeout(t *testing.T) {
+	server := miniredis.RunT(t)
+	proxy := newBlackhole(t, server.Addr())
+
+	c, err := NewRedisCache(RedisConfig{
+		Addr:      proxy.Addr().String(),
+		OpTimeout: 50 * time.Millisecond,
+	})
+	if err != nil {
+		t.Fatalf("NewRedisCache: %v", err)
+	}
+	defer c.Close()
+
+	proxy.cut.Store(true)
+
+	start := time.Now()
+	var value string
+	err = c.Get("k", &value)
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("Get = %v, want context.DeadlineExceeded", err)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("Get took %v, want about 50ms", elapsed)
+	}
+}
@@ -0,0 +1,54 @@
+package cache
+
+import (
+	"encoding/json"
+	"log"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// RememberRefreshAhead is like Remember, but when a hit has less than
+// refreshAhead of its TTL left, fn runs in the background to store a fresh
+// value while the cached one is returned, so hot keys never go cold.
+// Simultaneous refreshes of a key within this process share one call to fn.
+func (r *RedisCache) RememberRefreshAhead(key string, ttl, refreshAhead time.Duration, fn func() (interface{}, error), dest interface{}) error {
+	fullKey := r.key(key)
+
+	pipe := r.client.Pipeline()
+	get := pipe.Get(r.ctx, fullKey)
+	pttl := pipe.PTTL(r.ctx, fullKey)
+	_, err := pipe.Exec(r.ctx)
+	if err == redis.Nil {
+		return r.Remember(key, ttl, fn, dest)
+	}
+	if err != nil {
+		return err
+	}
+
+	data, _ := get.Bytes()
+	if isNegative(data) {
+		return ErrNotFound
+	}
+
+	// A key without expiry reports a negative TTL and is never refreshed
+	if remaining := pttl.Val(); remaining > 0 && remaining < refreshAhead {
+		go r.refresh(key, ttl, fn)
+	}
+
+	return json.Unmarshal(data, dest)
+}
+
+// refresh recomputes and stores key, logging failures since nobody waits for it
+func (r *RedisCache) refresh(key string, ttl time.Duration, fn func() (interface{}, error)) {
+	_, err, _ := r.refreshes.Do(r.prefix+key, func() (interface{}, error) {
+		value, err := fn()
+		if err != nil {
+			return nil, err
+		}
+		return nil, r.Set(key, value, ttl)
+	})
+	if err != nil {
+		log.Printf("cache: refresh %q: %v", key, err)
+	}
+}
@@ -0,0 +1,48 @@
+package cache
+
+import "github.com/abreed05/goexpress"
+
+// SkipIfHeader returns a SkipFunc that bypasses the cache for requests
+// carrying any of the given headers with a non-empty value
+func SkipIfHeader(names ...string) func(*goexpress.Context) bool {
+	return func(c *goexpress.Context) bool {
+		for _, name := range names {
+			if c.Header(name) != "" {
+				return true
+			}
+		}
+		return false
+	}
+}
+
+// SkipIfCookie returns a SkipFunc that bypasses the cache for requests
+// carrying any of the given cookies with a non-empty value
+func SkipIfCookie(names ...string) func(*goexpress.Context) bool {
+	return func(c *goexpress.Context) bool {
+		for _, name := range names {
+			if cookie, err := c.GetCookie(name); err == nil && cookie.Value != "" {
+				return true
+			}
+		}
+		return false
+	}
+}
+
+// SkipAuthenticated returns a SkipFunc that bypasses the cache for requests
+// that may be answered per user: those with the session cookie or an
+// Authorization header. Caching them could serve one user's data to others.
+func SkipAuthenticated(sessionCookieName string) func(*goexpress.Context) bool {
+	return SkipAny(SkipIfCookie(sessionCookieName), SkipIfHeader("Authorization"))
+}
+
+// SkipAny returns a SkipFunc that bypasses the cache when any of funcs does
+func SkipAny(funcs ...func(*goexpress.Context) bool) func(*goexpress.Context) bool {
+	return func(c *goexpress.Context) bool {
+		for _, skip := range funcs {
+			if skip(c) {
+				return true
+			}
+		}
+		return false
+	}
+}
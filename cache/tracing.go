@@ -0,0 +1,57 @@
+package cache
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// tracerName identifies spans created by this package
+const tracerName = "github.com/abreed05/goexpress-redis/cache"
+
+// startSpan starts a span for a cache operation, or does nothing when tracing is disabled
+func (r *RedisCache) startSpan(ctx context.Context, name, key string) (context.Context, trace.Span) {
+	if r.tracer == nil {
+		return ctx, nil
+	}
+
+	return r.tracer.Start(ctx, name,
+		trace.WithSpanKind(trace.SpanKindClient),
+		trace.WithAttributes(
+			attribute.String("db.system", "redis"),
+			attribute.String("cache.key_hash", hashKey(key)),
+		),
+	)
+}
+
+// endSpan records the outcome of a cache operation and ends its span
+func endSpan(span trace.Span, err error) {
+	if span == nil {
+		return
+	}
+
+	if err == ErrCacheMiss {
+		span.SetAttributes(attribute.Bool("cache.hit", false))
+	} else if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	span.End()
+}
+
+// setHit marks a span as a cache hit
+func setHit(span trace.Span) {
+	if span != nil {
+		span.SetAttributes(attribute.Bool("cache.hit", true))
+	}
+}
+
+// hashKey hashes a cache key so span attributes don't leak key contents
+func hashKey(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return hex.EncodeToString(sum[:8])
+}
@@ -0,0 +1,71 @@
+package cache
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// WarmConfig holds cache warming configuration
+type WarmConfig struct {
+	TTL         time.Duration
+	Concurrency int // Maximum loaders running at once (default 4)
+}
+
+// Warm computes and stores every entry, e.g. on deploy so the first visitors
+// don't all pay for a cold cache. See WarmWithConfig.
+func Warm(ctx context.Context, cache Cache, entries map[string]func() (interface{}, error), ttl time.Duration) map[string]error {
+	return WarmWithConfig(ctx, cache, entries, WarmConfig{TTL: ttl})
+}
+
+// WarmWithConfig computes and stores every entry with at most
+// config.Concurrency loaders running at once, overwriting existing values.
+// It returns the errors of the keys that failed, or nil if all were stored.
+// Once ctx is cancelled, the keys not yet started fail with ctx.Err().
+func WarmWithConfig(ctx context.Context, cache Cache, entries map[string]func() (interface{}, error), config WarmConfig) map[string]error {
+	if config.Concurrency <= 0 {
+		config.Concurrency = 4
+	}
+
+	var (
+		mu     sync.Mutex
+		errs   map[string]error
+		wg     sync.WaitGroup
+		tokens = make(chan struct{}, config.Concurrency)
+	)
+
+	fail := func(key string, err error) {
+		mu.Lock()
+		defer mu.Unlock()
+		if errs == nil {
+			errs = make(map[string]error)
+		}
+		errs[key] = err
+	}
+
+	for key, fn := range entries {
+		select {
+		case tokens <- struct{}{}:
+		case <-ctx.Done():
+			fail(key, ctx.Err())
+			continue
+		}
+
+		wg.Add(1)
+		go func(key string, fn func() (interface{}, error)) {
+			defer wg.Done()
+			defer func() { <-tokens }()
+
+			value, err := fn()
+			if err == nil {
+				err = setCtx(ctx, cache, key, value, config.TTL)
+			}
+			if err != nil {
+				fail(key, err)
+			}
+		}(key, fn)
+	}
+
+	wg.Wait()
+	return errs
+}
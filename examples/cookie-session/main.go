@@ -0,0 +1,98 @@
+package main
+
+import (
+	"log"
+	"time"
+
+	"github.com/abreed05/goexpress"
+	"github.com/abreed05/goexpress/middleware"
+	"github.com/abreed05/goexpress-redis/session"
+)
+
+func main() {
+	app := goexpress.New(&goexpress.Config{
+		Port: "3000",
+	})
+
+	// Global middleware
+	app.Use(middleware.Logger())
+	app.Use(middleware.Recovery())
+
+	// Cookie store: the whole session lives in the signed (and here
+	// encrypted) cookie, so there is nothing to run or clean up server-side
+	sessionStore := session.NewCookieStoreWithConfig(session.CookieConfig{
+		MaxAge:        time.Hour,
+		SecretKey:     []byte("change-me-to-a-long-random-secret"),
+		EncryptionKey: []byte("change-me-32-byte-encryption-key"),
+	})
+
+	// Session middleware
+	sessionConfig := session.DefaultConfig(sessionStore)
+	sessionConfig.MaxAge = time.Hour
+	sessionConfig.SecretKey = []byte("change-me-to-a-long-random-secret")
+	app.Use(session.Middleware(sessionConfig))
+
+	// Routes
+	app.GET("/", func(c *goexpress.Context) error {
+		sess, err := session.GetSession(c)
+		if err != nil {
+			return err
+		}
+
+		visits, _ := sess.GetInt("visits")
+		sess.Set("visits", visits+1)
+
+		return c.JSON(map[string]interface{}{
+			"message": "Cookie Session Example",
+			"visits":  visits + 1,
+		})
+	})
+
+	app.POST("/login", func(c *goexpress.Context) error {
+		var creds struct {
+			Username string `json:"username"`
+		}
+
+		if err := c.BodyParser(&creds); err != nil {
+			return goexpress.NewHTTPError(400, "Invalid request")
+		}
+
+		if err := session.Login(c, sessionConfig, map[string]interface{}{
+			"username": creds.Username,
+		}); err != nil {
+			return err
+		}
+
+		return c.JSON(map[string]interface{}{
+			"message":  "Login successful",
+			"username": creds.Username,
+		})
+	})
+
+	app.GET("/profile", func(c *goexpress.Context) error {
+		sess, err := session.GetSession(c)
+		if err != nil {
+			return goexpress.ErrUnauthorized
+		}
+
+		username, ok := sess.GetString("username")
+		if !ok {
+			return goexpress.NewHTTPError(401, "Not logged in")
+		}
+
+		return c.JSON(map[string]interface{}{
+			"username":   username,
+			"expires_at": sess.ExpiresAt,
+		})
+	})
+
+	app.POST("/logout", func(c *goexpress.Context) error {
+		return session.DestroySession(c, sessionConfig)
+	})
+
+	log.Println("🚀 Server starting on http://localhost:3000")
+	log.Println("🍪 Sessions are stored entirely in the cookie")
+	if err := app.Listen(); err != nil {
+		log.Fatal(err)
+	}
+}
@@ -6,6 +6,7 @@ import (
 
 	"github.com/abreed05/goexpress"
 	"github.com/abreed05/goexpress/middleware"
+	"github.com/abreed05/goexpress-redis/cache"
 	"github.com/abreed05/goexpress-redis/session"
 )
 
@@ -26,8 +27,16 @@ func main() {
 	// Session middleware
 	sessionConfig := session.DefaultConfig(sessionStore)
 	sessionConfig.MaxAge = 30 * time.Minute
+	sessionConfig.SecretKey = []byte("change-me-to-a-long-random-secret")
 	app.Use(session.Middleware(sessionConfig))
 
+	// In-memory cache, also without Redis
+	memoryCache := cache.NewMemoryCache(time.Minute) // Cleanup every minute
+	defer memoryCache.Close()
+
+	cacheConfig := cache.DefaultCacheConfig(memoryCache)
+	cacheConfig.TTL = 10 * time.Second
+
 	// Routes
 	app.GET("/", func(c *goexpress.Context) error {
 		return c.JSON(map[string]string{
@@ -62,7 +71,7 @@ func main() {
 			return goexpress.ErrUnauthorized
 		}
 
-		username, ok := sess.Get("username")
+		username, ok := sess.GetString("username")
 		if !ok {
 			return goexpress.NewHTTPError(401, "Not logged in")
 		}
@@ -79,8 +88,15 @@ func main() {
 		return session.DestroySession(c, sessionConfig)
 	})
 
+	// Cached for 10 seconds, check the X-Cache header
+	app.GET("/time", func(c *goexpress.Context) error {
+		return c.JSON(map[string]interface{}{
+			"time": time.Now(),
+		})
+	}, cache.Middleware(cacheConfig))
+
 	log.Println("🚀 Server starting on http://localhost:3000")
-	log.Println("💾 Using in-memory sessions (no Redis needed)")
+	log.Println("💾 Using in-memory sessions and cache (no Redis needed)")
 	if err := app.Listen(); err != nil {
 		log.Fatal(err)
 	}
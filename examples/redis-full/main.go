@@ -2,6 +2,7 @@ package main
 
 import (
 	"log"
+	"os"
 	"time"
 
 	"github.com/abreed05/goexpress"
@@ -36,6 +37,7 @@ func main() {
 	sessionConfig := session.DefaultConfig(sessionStore)
 	sessionConfig.MaxAge = 24 * time.Hour
 	sessionConfig.Secure = false // Set to true in production with HTTPS
+	sessionConfig.SecretKey = []byte("change-me-to-a-long-random-secret")
 	app.Use(session.Middleware(sessionConfig))
 
 	// Initialize Redis cache
@@ -55,14 +57,20 @@ func main() {
 
 	// Session examples
 	app.POST("/login", loginHandler)
-	app.GET("/profile", profileHandler)
+	app.GET("/profile", profileHandler, session.AuthRequired(session.DefaultAuthConfig(), loadUser))
 	app.POST("/logout", func(c *goexpress.Context) error {
 		return session.DestroySession(c, sessionConfig)
 	})
 
-	// Cache examples
-	cacheConfig := cache.DefaultCacheConfig(redisCache)
+	// Cache examples. Set DISABLE_CACHE=1 to run the same routes uncached.
+	var responseCache cache.Cache = redisCache
+	if os.Getenv("DISABLE_CACHE") != "" {
+		responseCache = cache.NoopCache{}
+	}
+	cacheConfig := cache.DefaultCacheConfig(responseCache)
 	cacheConfig.TTL = 5 * time.Minute
+	// Never serve a logged in user's response to others
+	cacheConfig.SkipFunc = cache.SkipAuthenticated(sessionConfig.CookieName)
 
 	// Cached route - will cache for 5 minutes
 	app.GET("/users", usersHandler, cache.Middleware(cacheConfig))
@@ -149,23 +157,30 @@ func loginHandler(c *goexpress.Context) error {
 	})
 }
 
+// User is the logged in user loaded by AuthRequired
+type User struct {
+	ID string `json:"id"`
+}
+
+// loadUser looks up a user by ID (use your database in production)
+func loadUser(userID string) (interface{}, error) {
+	return &User{ID: userID}, nil
+}
+
 func profileHandler(c *goexpress.Context) error {
+	// AuthRequired already rejected anonymous requests and loaded the user
+	user := c.MustGet("user").(*User)
+
 	sess, err := session.GetSession(c)
 	if err != nil {
-		return goexpress.ErrUnauthorized
-	}
-
-	loggedIn, ok := sess.Get("logged_in")
-	if !ok || !loggedIn.(bool) {
-		return goexpress.ErrUnauthorized
+		return err
 	}
 
-	username, _ := sess.Get("username")
-	userID, _ := sess.Get("user_id")
-	loginTime, _ := sess.Get("login_time")
+	username, _ := sess.GetString("username")
+	loginTime, _ := sess.GetString("login_time")
 
 	return c.JSON(map[string]interface{}{
-		"user_id":    userID,
+		"user_id":    user.ID,
 		"username":   username,
 		"login_time": loginTime,
 		"session_id": sess.ID,
@@ -264,7 +279,7 @@ func submitHandler(c *goexpress.Context) error {
 func resultHandler(c *goexpress.Context) error {
 	// Get and remove flash messages
 	success, hasSuccess := session.GetFlash(c, "success")
-	data, hasData := session.GetFlash(c, "data")
+	data, _ := session.GetFlash(c, "data")
 
 	if !hasSuccess {
 		return c.JSON(map[string]interface{}{
@@ -286,10 +301,7 @@ func counterHandler(c *goexpress.Context) error {
 	}
 
 	// Get current counter value
-	counter := 0
-	if val, ok := sess.Get("counter"); ok {
-		counter = int(val.(float64))
-	}
+	counter, _ := sess.GetInt("counter")
 
 	// Increment
 	counter++
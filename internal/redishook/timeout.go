@@ -0,0 +1,42 @@
+// Package redishook holds go-redis hooks shared by the cache and session
+// packages.
+package redishook
+
+import (
+	"context"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// Timeout returns a hook running every Redis command under a context timeout
+// of d, so a client without one can't hang on an unresponsive server
+func Timeout(d time.Duration) redis.Hook {
+	return timeoutHook(d)
+}
+
+// timeoutHook runs every Redis command under a context timeout
+type timeoutHook time.Duration
+
+// DialHook leaves dialing to the client's DialTimeout
+func (h timeoutHook) DialHook(next redis.DialHook) redis.DialHook {
+	return next
+}
+
+// ProcessHook bounds a single command
+func (h timeoutHook) ProcessHook(next redis.ProcessHook) redis.ProcessHook {
+	return func(ctx context.Context, cmd redis.Cmder) error {
+		ctx, cancel := context.WithTimeout(ctx, time.Duration(h))
+		defer cancel()
+		return next(ctx, cmd)
+	}
+}
+
+// ProcessPipelineHook bounds a whole pipeline or transaction
+func (h timeoutHook) ProcessPipelineHook(next redis.ProcessPipelineHook) redis.ProcessPipelineHook {
+	return func(ctx context.Context, cmds []redis.Cmder) error {
+		ctx, cancel := context.WithTimeout(ctx, time.Duration(h))
+		defer cancel()
+		return next(ctx, cmds)
+	}
+}
@@ -0,0 +1,26 @@
+module github.com/abreed05/goexpress-redis/metrics
+
+go 1.23
+
+require (
+	github.com/abreed05/goexpress-redis v0.0.0-20261017043430-e06b91ac6dd1
+	github.com/alicebob/miniredis/v2 v2.35.0
+	github.com/prometheus/client_golang v1.19.0
+	github.com/prometheus/client_model v0.5.0
+	github.com/redis/go-redis/v9 v9.4.0
+)
+
+require (
+	github.com/abreed05/goexpress v0.0.3 // indirect
+	github.com/beorn7/perks v1.0.1 // indirect
+	github.com/cespare/xxhash/v2 v2.2.0 // indirect
+	github.com/dgryski/go-rendezvous v0.0.0-20200823014737-9f7001d12a5f // indirect
+	github.com/prometheus/common v0.48.0 // indirect
+	github.com/prometheus/procfs v0.12.0 // indirect
+	github.com/yuin/gopher-lua v1.1.1 // indirect
+	go.opentelemetry.io/otel v1.24.0 // indirect
+	go.opentelemetry.io/otel/trace v1.24.0 // indirect
+	golang.org/x/sync v0.10.0 // indirect
+	golang.org/x/sys v0.16.0 // indirect
+	google.golang.org/protobuf v1.32.0 // indirect
+)
@@ -0,0 +1,240 @@
+package metrics
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/abreed05/goexpress-redis/cache"
+	"github.com/abreed05/goexpress-redis/session"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"github.com/redis/go-redis/v9"
+)
+
+// Metrics collects Prometheus metrics for caches and session stores
+type Metrics struct {
+	namespace string
+	registry  *prometheus.Registry
+
+	cacheHits       *prometheus.CounterVec
+	cacheMisses     *prometheus.CounterVec
+	errors          *prometheus.CounterVec
+	commandDuration *prometheus.HistogramVec
+	sessionsCreated prometheus.Counter
+	sessionsDeleted prometheus.Counter
+}
+
+// New creates a Metrics instance with its own registry.
+// Metric names are prefixed with namespace (default "goexpress_redis").
+func New(namespace string) *Metrics {
+	if namespace == "" {
+		namespace = "goexpress_redis"
+	}
+
+	m := &Metrics{
+		namespace: namespace,
+		registry:  prometheus.NewRegistry(),
+		cacheHits: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "cache_hits_total",
+			Help:      "Number of cache reads that found a value.",
+		}, []string{"operation"}),
+		cacheMisses: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "cache_misses_total",
+			Help:      "Number of cache reads that found no value.",
+		}, []string{"operation"}),
+		errors: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "errors_total",
+			Help:      "Number of failed Redis commands.",
+		}, []string{"component", "operation"}),
+		commandDuration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Namespace: namespace,
+			Name:      "command_duration_seconds",
+			Help:      "Latency of Redis commands.",
+			Buckets:   prometheus.ExponentialBuckets(0.0001, 2, 16),
+		}, []string{"component", "operation"}),
+		sessionsCreated: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "sessions_created_total",
+			Help:      "Number of sessions created.",
+		}),
+		sessionsDeleted: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "sessions_destroyed_total",
+			Help:      "Number of sessions destroyed.",
+		}),
+	}
+
+	m.registry.MustRegister(
+		m.cacheHits,
+		m.cacheMisses,
+		m.errors,
+		m.commandDuration,
+		m.sessionsCreated,
+		m.sessionsDeleted,
+	)
+
+	return m
+}
+
+// Registry returns the registry holding all collectors, e.g. to merge into your own
+func (m *Metrics) Registry() *prometheus.Registry {
+	return m.registry
+}
+
+// MetricsHandler returns an http.Handler serving the metrics in Prometheus format
+func (m *Metrics) MetricsHandler() http.Handler {
+	return promhttp.HandlerFor(m.registry, promhttp.HandlerOpts{})
+}
+
+// InstrumentCache records hits, misses, errors and latency for a Redis cache
+func (m *Metrics) InstrumentCache(c *cache.RedisCache) {
+	c.GetClient().AddHook(&redisHook{metrics: m, component: "cache", countHits: true})
+}
+
+// InstrumentStore records errors and latency for a Redis session store and
+// exposes the number of active sessions.
+// The active count runs Count on every scrape, which SCANs the session keys.
+// A failed count is recorded in errors_total and the last count is reported.
+func (m *Metrics) InstrumentStore(s *session.RedisStore) {
+	s.GetClient().AddHook(&redisHook{metrics: m, component: "session"})
+
+	var (
+		mu   sync.Mutex
+		last float64
+	)
+	m.registry.MustRegister(prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+		Namespace: m.namespace,
+		Name:      "sessions_active",
+		Help:      "Number of sessions currently stored.",
+	}, func() float64 {
+		mu.Lock()
+		defer mu.Unlock()
+
+		count, err := s.Count()
+		if err != nil {
+			m.errors.WithLabelValues("session", "count").Inc()
+			return last
+		}
+		last = float64(count)
+		return last
+	}))
+}
+
+// InstrumentSessions counts session creation and destruction through the
+// config's lifecycle hooks, keeping any hooks already set
+func (m *Metrics) InstrumentSessions(config *session.Config) {
+	onCreate, onDestroy := config.OnCreate, config.OnDestroy
+
+	config.OnCreate = func(s *session.Session) {
+		m.sessionsCreated.Inc()
+		if onCreate != nil {
+			onCreate(s)
+		}
+	}
+
+	config.OnDestroy = func(id string) {
+		m.sessionsDeleted.Inc()
+		if onDestroy != nil {
+			onDestroy(id)
+		}
+	}
+}
+
+// redisHook observes Redis commands for one component
+type redisHook struct {
+	metrics   *Metrics
+	component string
+	countHits bool
+}
+
+// DialHook passes dials through unchanged
+func (h *redisHook) DialHook(next redis.DialHook) redis.DialHook {
+	return func(ctx context.Context, network, addr string) (net.Conn, error) {
+		return next(ctx, network, addr)
+	}
+}
+
+// ProcessHook observes a single command
+func (h *redisHook) ProcessHook(next redis.ProcessHook) redis.ProcessHook {
+	return func(ctx context.Context, cmd redis.Cmder) error {
+		start := time.Now()
+		err := next(ctx, cmd)
+		h.observe(cmd, err, time.Since(start))
+		return err
+	}
+}
+
+// ProcessPipelineHook observes every command of a pipeline
+func (h *redisHook) ProcessPipelineHook(next redis.ProcessPipelineHook) redis.ProcessPipelineHook {
+	return func(ctx context.Context, cmds []redis.Cmder) error {
+		start := time.Now()
+		err := next(ctx, cmds)
+		elapsed := time.Since(start)
+		for _, cmd := range cmds {
+			h.observe(cmd, cmd.Err(), elapsed)
+		}
+		return err
+	}
+}
+
+// observe records latency, errors and cache hits for a finished command.
+// err is passed in because a single command only gets its error set on cmd
+// after the hooks have returned.
+func (h *redisHook) observe(cmd redis.Cmder, err error, elapsed time.Duration) {
+	op := cmd.Name()
+	h.metrics.commandDuration.WithLabelValues(h.component, op).Observe(elapsed.Seconds())
+
+	if err != nil && err != redis.Nil {
+		h.metrics.errors.WithLabelValues(h.component, op).Inc()
+		return
+	}
+
+	if !h.countHits {
+		return
+	}
+
+	switch op {
+	case "get", "getex", "getdel":
+		if !dataKey(cmd) {
+			return
+		}
+		if err == redis.Nil {
+			h.metrics.cacheMisses.WithLabelValues(op).Inc()
+		} else {
+			h.metrics.cacheHits.WithLabelValues(op).Inc()
+		}
+	}
+}
+
+// dataKey reports whether a read command targets a cached item rather than
+// one of the cache's own keys: the age: meta keys of TrackAge and the
+// "<prefix>generation" counter of Generations. With generations on, data keys
+// carry a "g<N>:" segment, so an item named "generation" is still counted.
+func dataKey(cmd redis.Cmder) bool {
+	args := cmd.Args()
+	if len(args) < 2 {
+		return false
+	}
+	key, ok := args[1].(string)
+	if !ok {
+		return true
+	}
+	if strings.HasPrefix(key, "age:") {
+		return false
+	}
+	rest, found := strings.CutSuffix(key, ":generation")
+	return !found || generationSegment(rest)
+}
+
+// generationSegment reports whether s ends with a "g<N>" key generation
+func generationSegment(s string) bool {
+	digits := strings.TrimRight(s, "0123456789")
+	return len(digits) < len(s) && strings.HasSuffix(digits, "g")
+}
@@ -0,0 +1,105 @@
+package metrics
+
+import (
+	"testing"
+	"time"
+
+	"github.com/abreed05/goexpress-redis/cache"
+	"github.com/abreed05/goexpress-redis/session"
+	"github.com/alicebob/miniredis/v2"
+	dto "github.com/prometheus/client_model/go"
+	"github.com/redis/go-redis/v9"
+)
+
+// gather returns the metric family named name, or nil
+func gather(t *testing.T, m *Metrics, name string) *dto.MetricFamily {
+	t.Helper()
+	families, err := m.Registry().Gather()
+	if err != nil {
+		t.Fatalf("Gather: %v", err)
+	}
+	for _, family := range families {
+		if family.GetName() == name {
+			return family
+		}
+	}
+	return nil
+}
+
+func TestSessionsActive(t *testing.T) {
+	server := miniredis.RunT(t)
+	client := redis.NewClient(&redis.Options{Addr: server.Addr(), MaxRetries: -1})
+	defer client.Close()
+
+	store := session.NewRedisStoreWithClient(client, session.RedisConfig{})
+	for i := 0; i < 3; i++ {
+		if err := store.Set(session.NewSession(time.Hour)); err != nil {
+			t.Fatalf("Set: %v", err)
+		}
+	}
+
+	m := New("test")
+	m.InstrumentStore(store)
+
+	active := gather(t, m, "test_sessions_active")
+	if got := active.GetMetric()[0].GetGauge().GetValue(); got != 3 {
+		t.Fatalf("sessions_active = %v, want 3", got)
+	}
+
+	// A failed count keeps the last value and is counted as an error
+	server.Close()
+	active = gather(t, m, "test_sessions_active")
+	if got := active.GetMetric()[0].GetGauge().GetValue(); got != 3 {
+		t.Errorf("sessions_active after a failure = %v, want 3", got)
+	}
+
+	// Read the counter directly, gathering again would count once more
+	var countErrors dto.Metric
+	if err := m.errors.WithLabelValues("session", "count").Write(&countErrors); err != nil {
+		t.Fatal(err)
+	}
+	if got := countErrors.GetCounter().GetValue(); got != 1 {
+		t.Errorf("errors_total{operation=\"count\"} = %v, want 1", got)
+	}
+}
+
+func TestCacheHitsCountDataKeysOnly(t *testing.T) {
+	server := miniredis.RunT(t)
+	client := redis.NewClient(&redis.Options{Addr: server.Addr(), MaxRetries: -1})
+	defer client.Close()
+
+	// Every Get also reads the generation counter and GetWithAge the age: key
+	c := cache.NewRedisCacheWithClient(client, cache.RedisConfig{
+		TrackAge:          true,
+		Generations:       true,
+		GenerationRefresh: time.Nanosecond,
+	})
+	m := New("test")
+	m.InstrumentCache(c)
+
+	if err := c.Set("generation", "v", time.Minute); err != nil {
+		t.Fatalf("Set: %v", err)
+	}
+	var value string
+	if _, err := c.GetWithAge("generation", &value); err != nil {
+		t.Fatalf("GetWithAge: %v", err)
+	}
+	if err := c.Get("missing", &value); err != cache.ErrCacheMiss {
+		t.Fatalf("Get(missing) = %v, want ErrCacheMiss", err)
+	}
+
+	for name, want := range map[string]float64{
+		"test_cache_hits_total":   1,
+		"test_cache_misses_total": 1,
+	} {
+		var got float64
+		if family := gather(t, m, name); family != nil {
+			for _, metric := range family.GetMetric() {
+				got += metric.GetCounter().GetValue()
+			}
+		}
+		if got != want {
+			t.Errorf("%s = %v, want %v", name, got, want)
+		}
+	}
+}
@@ -0,0 +1,161 @@
+package ratelimit
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/abreed05/goexpress"
+	"github.com/redis/go-redis/v9"
+)
+
+// Config holds rate limiting middleware configuration
+type Config struct {
+	Client  *redis.Client                   // Redis client, e.g. from RedisCache.GetClient()
+	Limit   int                             // Maximum requests per window
+	Window  time.Duration                   // Length of the window
+	Prefix  string                          // Key prefix for counters (default "ratelimit:")
+	KeyFunc func(*goexpress.Context) string // Identifies the client (default RemoteIP)
+	Handler goexpress.HandlerFunc           // Called when the limit is exceeded
+
+	// TrustProxy makes the default KeyFunc c.IP(), which reads the client
+	// address from X-Forwarded-For or X-Real-IP. Only enable it behind a proxy
+	// that sets those headers, since clients can send any value themselves.
+	TrustProxy bool
+}
+
+// DefaultConfig returns a default rate limiting configuration
+func DefaultConfig(client *redis.Client) Config {
+	return Config{
+		Client: client,
+		Limit:  100,
+		Window: time.Minute,
+		Prefix: "ratelimit:",
+	}
+}
+
+// RemoteIP returns the IP address of the connection the request came in on,
+// ignoring client-supplied forwarding headers
+func RemoteIP(c *goexpress.Context) string {
+	host, _, err := net.SplitHostPort(c.Request.RemoteAddr)
+	if err != nil {
+		return c.Request.RemoteAddr
+	}
+	return host
+}
+
+// result is the outcome of checking one request against a limit
+type result struct {
+	allowed    bool
+	remaining  int64
+	reset      time.Duration // Until the limit is fully restored
+	retryAfter time.Duration // Until a rejected request would be allowed
+}
+
+// limiter checks a request for key against the limit and records it
+type limiter func(ctx context.Context, key string) (result, error)
+
+// fixedWindowScript increments the window counter, starting the window on the
+// first hit, and returns the count and the window's remaining time in ms
+var fixedWindowScript = redis.NewScript(`
+local count = redis.call("INCR", KEYS[1])
+if count == 1 then
+	redis.call("PEXPIRE", KEYS[1], ARGV[1])
+end
+return {count, redis.call("PTTL", KEYS[1])}
+`)
+
+// Middleware returns a Redis-backed fixed-window rate limiting middleware
+func Middleware(config Config) goexpress.Middleware {
+	config = withDefaults(config)
+
+	return newMiddleware(config, func(ctx context.Context, key string) (result, error) {
+		counts, err := fixedWindowScript.Run(ctx, config.Client, []string{key}, config.Window.Milliseconds()).Int64Slice()
+		if err != nil {
+			return result{}, err
+		}
+		count, ttl := counts[0], time.Duration(counts[1])*time.Millisecond
+
+		return result{
+			allowed:    count <= int64(config.Limit),
+			remaining:  int64(config.Limit) - count,
+			reset:      ttl,
+			retryAfter: ttl,
+		}, nil
+	})
+}
+
+// withDefaults validates config and fills in defaults
+func withDefaults(config Config) Config {
+	if config.Client == nil {
+		panic("redis client is required")
+	}
+
+	if config.Limit <= 0 {
+		panic("rate limit must be positive")
+	}
+
+	if config.Window <= 0 {
+		config.Window = time.Minute
+	}
+
+	if config.Prefix == "" {
+		config.Prefix = "ratelimit:"
+	}
+
+	if config.KeyFunc == nil {
+		if config.TrustProxy {
+			config.KeyFunc = (*goexpress.Context).IP
+		} else {
+			config.KeyFunc = RemoteIP
+		}
+	}
+
+	if config.Handler == nil {
+		config.Handler = func(c *goexpress.Context) error {
+			return c.Status(http.StatusTooManyRequests).JSON(map[string]interface{}{
+				"error": "Too many requests",
+			})
+		}
+	}
+
+	return config
+}
+
+// newMiddleware returns a middleware that checks every request with check
+// and reports the outcome in X-RateLimit-* headers
+func newMiddleware(config Config, check limiter) goexpress.Middleware {
+	return func(next goexpress.HandlerFunc) goexpress.HandlerFunc {
+		return func(c *goexpress.Context) error {
+			res, err := check(c.Request.Context(), config.Prefix+config.KeyFunc(c))
+			if err != nil {
+				return err
+			}
+
+			if res.remaining < 0 {
+				res.remaining = 0
+			}
+
+			c.SetHeader("X-RateLimit-Limit", strconv.Itoa(config.Limit))
+			c.SetHeader("X-RateLimit-Remaining", strconv.FormatInt(res.remaining, 10))
+			c.SetHeader("X-RateLimit-Reset", strconv.Itoa(retryAfterSeconds(res.reset)))
+
+			if !res.allowed {
+				c.SetHeader("Retry-After", strconv.Itoa(retryAfterSeconds(res.retryAfter)))
+				return config.Handler(c)
+			}
+
+			return next(c)
+		}
+	}
+}
+
+// retryAfterSeconds rounds a remaining window up to whole seconds
+func retryAfterSeconds(ttl time.Duration) int {
+	if ttl <= 0 {
+		return 1
+	}
+	return int((ttl + time.Second - 1) / time.Second)
+}
@@ -0,0 +1,108 @@
+package ratelimit
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/abreed05/goexpress"
+	"github.com/alicebob/miniredis/v2"
+	"github.com/redis/go-redis/v9"
+)
+
+// newTestClient returns a client for an in-memory Redis server
+func newTestClient(t *testing.T) *redis.Client {
+	t.Helper()
+	server := miniredis.RunT(t)
+	client := redis.NewClient(&redis.Options{Addr: server.Addr()})
+	t.Cleanup(func() { client.Close() })
+	return client
+}
+
+// request runs r through mw and returns the response status
+func request(t *testing.T, mw goexpress.Middleware, r *http.Request) int {
+	t.Helper()
+	rec := httptest.NewRecorder()
+	c := goexpress.NewContext(rec, r)
+	err := mw(func(c *goexpress.Context) error {
+		return c.String("ok")
+	})(c)
+	if err != nil {
+		t.Fatalf("middleware: %v", err)
+	}
+	return rec.Code
+}
+
+// spoofedRequest comes from one connection but claims a different client
+func spoofedRequest(i int) *http.Request {
+	r := httptest.NewRequest("GET", "/", nil)
+	r.RemoteAddr = "203.0.113.7:51234"
+	r.Header.Set("X-Forwarded-For", "198.51.100."+strconv.Itoa(i))
+	return r
+}
+
+func TestForwardedForIgnoredByDefault(t *testing.T) {
+	limiters := map[string]goexpress.Middleware{}
+
+	config := DefaultConfig(newTestClient(t))
+	config.Limit = 2
+	limiters["fixed"] = Middleware(config)
+	limiters["sliding"] = SlidingWindow(newTestClient(t), 2, time.Minute, nil)
+	limiters["bucket"] = TokenBucket(newTestClient(t), 1, 2, nil)
+
+	for name, mw := range limiters {
+		t.Run(name, func(t *testing.T) {
+			var codes []int
+			for i := 0; i < 3; i++ {
+				codes = append(codes, request(t, mw, spoofedRequest(i)))
+			}
+			if codes[2] != http.StatusTooManyRequests {
+				t.Errorf("statuses = %v, rotating X-Forwarded-For got around the limit", codes)
+			}
+		})
+	}
+}
+
+func TestTrustProxy(t *testing.T) {
+	config := DefaultConfig(newTestClient(t))
+	config.Limit = 2
+	config.TrustProxy = true
+	mw := Middleware(config)
+
+	for i := 0; i < 3; i++ {
+		if code := request(t, mw, spoofedRequest(i)); code != http.StatusOK {
+			t.Fatalf("request %d: status %d, want each forwarded client limited separately", i, code)
+		}
+	}
+}
+
+func TestRemoteIP(t *testing.T) {
+	tests := map[string]string{
+		"203.0.113.7:51234": "203.0.113.7",
+		"[2001:db8::1]:443": "2001:db8::1",
+		"unix-socket":       "unix-socket",
+	}
+	for addr, want := range tests {
+		r := httptest.NewRequest("GET", "/", nil)
+		r.RemoteAddr = addr
+		if got := RemoteIP(goexpress.NewContext(httptest.NewRecorder(), r)); got != want {
+			t.Errorf("RemoteIP(%q) = %q, want %q", addr, got, want)
+		}
+	}
+}
+
+func TestUsesRequestContext(t *testing.T) {
+	mw := Middleware(DefaultConfig(newTestClient(t)))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	r := httptest.NewRequest("GET", "/", nil).WithContext(ctx)
+
+	err := mw(func(c *goexpress.Context) error { return nil })(goexpress.NewContext(httptest.NewRecorder(), r))
+	if err != context.Canceled {
+		t.Errorf("err = %v, want context.Canceled", err)
+	}
+}
@@ -0,0 +1,86 @@
+package ratelimit
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"time"
+
+	"github.com/abreed05/goexpress"
+	"github.com/redis/go-redis/v9"
+)
+
+// slidingWindowScript keeps a sorted set of request timestamps per key. It
+// drops entries older than the window, records the request if the limit
+// allows it, and returns {allowed, count, ms until the oldest entry expires}.
+// Time comes from the Redis server so all nodes share one clock.
+var slidingWindowScript = redis.NewScript(`
+local time = redis.call("TIME")
+local now = tonumber(time[1]) * 1000 + math.floor(tonumber(time[2]) / 1000)
+local window = tonumber(ARGV[1])
+local limit = tonumber(ARGV[2])
+
+redis.call("ZREMRANGEBYSCORE", KEYS[1], "-inf", now - window)
+local count = redis.call("ZCARD", KEYS[1])
+
+local allowed = 0
+if count < limit then
+	redis.call("ZADD", KEYS[1], now, now .. "-" .. ARGV[3])
+	count = count + 1
+	allowed = 1
+end
+redis.call("PEXPIRE", KEYS[1], window)
+
+local reset = 0
+local oldest = redis.call("ZRANGE", KEYS[1], 0, 0, "WITHSCORES")
+if oldest[2] then
+	reset = tonumber(oldest[2]) + window - now
+end
+return {allowed, count, reset}
+`)
+
+// SlidingWindow returns a middleware allowing at most limit requests in any
+// window-long span, avoiding the double burst a fixed window allows around
+// its boundaries. Each request is logged in a Redis sorted set, so memory
+// grows with limit. A nil keyFunc limits by RemoteIP; pass
+// (*goexpress.Context).IP to trust X-Forwarded-For behind a proxy.
+func SlidingWindow(client *redis.Client, limit int, window time.Duration, keyFunc func(*goexpress.Context) string) goexpress.Middleware {
+	config := DefaultConfig(client)
+	config.Limit = limit
+	config.Window = window
+	config.Prefix = "ratelimit:sliding:"
+	if keyFunc != nil {
+		config.KeyFunc = keyFunc
+	}
+	config = withDefaults(config)
+
+	return newMiddleware(config, func(ctx context.Context, key string) (result, error) {
+		member, err := randomMember()
+		if err != nil {
+			return result{}, err
+		}
+
+		values, err := slidingWindowScript.Run(ctx, config.Client, []string{key},
+			config.Window.Milliseconds(), config.Limit, member).Int64Slice()
+		if err != nil {
+			return result{}, err
+		}
+		allowed, count, reset := values[0] == 1, values[1], time.Duration(values[2])*time.Millisecond
+
+		return result{
+			allowed:    allowed,
+			remaining:  int64(config.Limit) - count,
+			reset:      reset,
+			retryAfter: reset,
+		}, nil
+	})
+}
+
+// randomMember makes sorted set members unique when requests share a millisecond
+func randomMember() (string, error) {
+	b := make([]byte, 8)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
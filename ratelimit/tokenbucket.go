@@ -0,0 +1,74 @@
+package ratelimit
+
+import (
+	"context"
+	"strconv"
+	"time"
+
+	"github.com/abreed05/goexpress"
+	"github.com/redis/go-redis/v9"
+)
+
+// tokenBucketScript refills the bucket for the time elapsed since the last
+// request, then takes a token if one is available. ARGV holds the refill rate
+// in tokens per ms and the capacity. It returns {allowed, tokens left,
+// ms until full, ms until the next token}, using the Redis server clock.
+var tokenBucketScript = redis.NewScript(`
+local time = redis.call("TIME")
+local now = tonumber(time[1]) * 1000 + math.floor(tonumber(time[2]) / 1000)
+local rate = tonumber(ARGV[1])
+local burst = tonumber(ARGV[2])
+
+local state = redis.call("HMGET", KEYS[1], "tokens", "ts")
+local tokens = tonumber(state[1]) or burst
+local ts = tonumber(state[2]) or now
+tokens = math.min(burst, tokens + math.max(0, now - ts) * rate)
+
+local allowed = 0
+local wait = 0
+if tokens >= 1 then
+	tokens = tokens - 1
+	allowed = 1
+else
+	wait = math.ceil((1 - tokens) / rate)
+end
+
+local full = math.ceil((burst - tokens) / rate)
+redis.call("HSET", KEYS[1], "tokens", tostring(tokens), "ts", now)
+redis.call("PEXPIRE", KEYS[1], full + 1000)
+return {allowed, math.floor(tokens), full, wait}
+`)
+
+// TokenBucket returns a middleware that refills rate tokens per second up to
+// burst and lets each request spend one, allowing short bursts while holding
+// clients to a steady average rate. A nil keyFunc limits by RemoteIP; pass
+// (*goexpress.Context).IP to trust X-Forwarded-For behind a proxy.
+func TokenBucket(client *redis.Client, rate float64, burst int, keyFunc func(*goexpress.Context) string) goexpress.Middleware {
+	if rate <= 0 {
+		panic("token bucket rate must be positive")
+	}
+
+	config := DefaultConfig(client)
+	config.Limit = burst
+	config.Prefix = "ratelimit:bucket:"
+	if keyFunc != nil {
+		config.KeyFunc = keyFunc
+	}
+	config = withDefaults(config)
+
+	perMs := strconv.FormatFloat(rate/1000, 'g', -1, 64)
+
+	return newMiddleware(config, func(ctx context.Context, key string) (result, error) {
+		values, err := tokenBucketScript.Run(ctx, config.Client, []string{key}, perMs, config.Limit).Int64Slice()
+		if err != nil {
+			return result{}, err
+		}
+
+		return result{
+			allowed:    values[0] == 1,
+			remaining:  values[1],
+			reset:      time.Duration(values[2]) * time.Millisecond,
+			retryAfter: time.Duration(values[3]) * time.Millisecond,
+		}, nil
+	})
+}
@@ -0,0 +1,75 @@
+package ratelimit
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/abreed05/goexpress"
+	"github.com/alicebob/miniredis/v2"
+	"github.com/redis/go-redis/v9"
+)
+
+func TestTokenBucket(t *testing.T) {
+	server := miniredis.RunT(t)
+	client := redis.NewClient(&redis.Options{Addr: server.Addr()})
+	t.Cleanup(func() { client.Close() })
+
+	// The script reads the clock from Redis, so the test can move it
+	now := time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)
+	server.SetTime(now)
+	advance := func(d time.Duration) {
+		now = now.Add(d)
+		server.SetTime(now)
+	}
+
+	mw := TokenBucket(client, 2, 4, nil) // 2 tokens/s, bursts of 4
+	hit := func() *httptest.ResponseRecorder {
+		t.Helper()
+		rec := httptest.NewRecorder()
+		err := mw(func(c *goexpress.Context) error {
+			return c.String("ok")
+		})(goexpress.NewContext(rec, httptest.NewRequest("GET", "/", nil)))
+		if err != nil {
+			t.Fatalf("middleware: %v", err)
+		}
+		return rec
+	}
+
+	// A full bucket absorbs a burst, then the client has to wait
+	for i := 0; i < 4; i++ {
+		if rec := hit(); rec.Code != http.StatusOK {
+			t.Fatalf("burst request %d: status %d", i+1, rec.Code)
+		}
+	}
+	rec := hit()
+	if rec.Code != http.StatusTooManyRequests {
+		t.Fatalf("request past the burst: status %d, want 429", rec.Code)
+	}
+	if got := rec.Header().Get("Retry-After"); got != "1" {
+		t.Errorf("Retry-After = %q, want 1 (one token in 500ms, rounded up)", got)
+	}
+
+	// Afterwards requests pass at the refill rate and no faster
+	for i := 0; i < 5; i++ {
+		advance(500 * time.Millisecond)
+		if rec := hit(); rec.Code != http.StatusOK {
+			t.Fatalf("sustained request %d: status %d", i+1, rec.Code)
+		}
+		if rec := hit(); rec.Code != http.StatusTooManyRequests {
+			t.Fatalf("extra request %d: status %d, want 429", i+1, rec.Code)
+		}
+	}
+
+	// An idle bucket refills up to the burst size only
+	advance(time.Minute)
+	for i := 0; i < 4; i++ {
+		if rec := hit(); rec.Code != http.StatusOK {
+			t.Fatalf("burst after idling, request %d: status %d", i+1, rec.Code)
+		}
+	}
+	if rec := hit(); rec.Code != http.StatusTooManyRequests {
+		t.Errorf("request past the refilled burst: status %d, want 429", rec.Code)
+	}
+}
@@ -0,0 +1,103 @@
+package session
+
+import (
+	"strconv"
+
+	"github.com/abreed05/goexpress"
+)
+
+// AuthConfig holds authentication middleware configuration
+type AuthConfig struct {
+	SessionKey   string                // Session key holding the user ID (default "user_id")
+	ContextKey   string                // Context key the loaded user is stored under (default "user")
+	Unauthorized goexpress.HandlerFunc // Called when no user is logged in (default responds 401)
+}
+
+// DefaultAuthConfig returns a default authentication configuration
+func DefaultAuthConfig() AuthConfig {
+	return AuthConfig{
+		SessionKey: "user_id",
+		ContextKey: "user",
+	}
+}
+
+// AuthRequired returns a middleware that loads the logged in user with loader
+// and stores it in the context, so handlers can read it with c.Get("user").
+// The user ID may be stored as a string or a number. Requests without one,
+// or whose loader returns nil, get config.Unauthorized; loader errors are
+// returned as they are.
+// It must be registered after the session middleware.
+func AuthRequired(config AuthConfig, loader func(userID string) (interface{}, error)) goexpress.Middleware {
+	if loader == nil {
+		panic("user loader is required")
+	}
+
+	if config.SessionKey == "" {
+		config.SessionKey = "user_id"
+	}
+
+	if config.ContextKey == "" {
+		config.ContextKey = "user"
+	}
+
+	if config.Unauthorized == nil {
+		config.Unauthorized = func(c *goexpress.Context) error {
+			return goexpress.ErrUnauthorized
+		}
+	}
+
+	return func(next goexpress.HandlerFunc) goexpress.HandlerFunc {
+		return func(c *goexpress.Context) error {
+			session, err := GetSession(c)
+			if err != nil {
+				return config.Unauthorized(c)
+			}
+
+			value, ok := session.Get(config.SessionKey)
+			if !ok || value == nil {
+				return config.Unauthorized(c)
+			}
+
+			userID, ok := formatUserID(value)
+			if !ok || userID == "" {
+				return config.Unauthorized(c)
+			}
+
+			user, err := loader(userID)
+			if err != nil {
+				return err
+			}
+			if user == nil {
+				return config.Unauthorized(c)
+			}
+
+			c.Set(config.ContextKey, user)
+			return next(c)
+		}
+	}
+}
+
+// formatUserID converts a stored user ID to a string. IDs stored as numbers
+// come back as float64 from JSON stores, so floats are printed in full
+// rather than in exponent form. Other types are rejected.
+func formatUserID(value interface{}) (string, bool) {
+	switch v := value.(type) {
+	case string:
+		return v, true
+	case float64:
+		return strconv.FormatFloat(v, 'f', -1, 64), true
+	case int:
+		return strconv.FormatInt(int64(v), 10), true
+	case int32:
+		return strconv.FormatInt(int64(v), 10), true
+	case int64:
+		return strconv.FormatInt(v, 10), true
+	case uint:
+		return strconv.FormatUint(uint64(v), 10), true
+	case uint32:
+		return strconv.FormatUint(uint64(v), 10), true
+	case uint64:
+		return strconv.FormatUint(v, 10), true
+	}
+	return "", false
+}
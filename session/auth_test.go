@@ -0,0 +1,54 @@
+package session
+
+import (
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/abreed05/goexpress"
+)
+
+func TestAuthRequiredUserID(t *testing.T) {
+	tests := []struct {
+		name  string
+		value interface{}
+		want  string // "" means unauthorized
+	}{
+		{"string", "abc123", "abc123"},
+		{"json number", float64(1234567), "1234567"},
+		{"large json number", float64(1e15), "1000000000000000"},
+		{"int", 42, "42"},
+		{"int64", int64(1) << 53, "9007199254740992"},
+		{"unsupported type", true, ""},
+		{"empty string", "", ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var got string
+			mw := AuthRequired(DefaultAuthConfig(), func(userID string) (interface{}, error) {
+				got = userID
+				return userID, nil
+			})
+
+			c := goexpress.NewContext(httptest.NewRecorder(), httptest.NewRequest("GET", "/", nil))
+			sess := NewSession(time.Hour)
+			sess.Set("user_id", tt.value)
+			c.Set("session", sess)
+
+			err := mw(func(c *goexpress.Context) error { return nil })(c)
+			if tt.want == "" {
+				if err != goexpress.ErrUnauthorized {
+					t.Fatalf("err = %v, want ErrUnauthorized", err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("err = %v", err)
+			}
+			if got != tt.want {
+				t.Errorf("loader got %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
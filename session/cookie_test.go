@@ -0,0 +1,92 @@
+package session
+
+import (
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/abreed05/goexpress"
+)
+
+func TestCookieStoreMiddleware(t *testing.T) {
+	store := NewCookieStore(time.Hour, testSecret)
+	// The store signs the cookie itself, so the config needs no SecretKey
+	config := DefaultConfig(store)
+
+	// The first request stores the whole session in the cookie
+	rec := httptest.NewRecorder()
+	err := serve(t, config, rec, httptest.NewRequest("GET", "/", nil), func(c *goexpress.Context) error {
+		sess, _ := GetSession(c)
+		sess.Set("user", "alice")
+		return c.String("ok")
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	cookie := sessionCookie(rec, config.CookieName)
+	if cookie == nil {
+		t.Fatal("no session cookie on the response")
+	}
+	if _, err := store.Get(cookie.Value); err != nil {
+		t.Fatalf("cookie does not hold an encoded session: %v", err)
+	}
+
+	// The next request reads it back from the cookie
+	r := httptest.NewRequest("GET", "/", nil)
+	r.AddCookie(cookie)
+	var user string
+	err = serve(t, config, httptest.NewRecorder(), r, func(c *goexpress.Context) error {
+		sess, _ := GetSession(c)
+		user, _ = sess.GetString("user")
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if user != "alice" {
+		t.Errorf("user = %q, want alice", user)
+	}
+
+	// A tampered cookie starts a fresh session
+	r = httptest.NewRequest("GET", "/", nil)
+	cookie.Value = "x" + cookie.Value
+	r.AddCookie(cookie)
+	err = serve(t, config, httptest.NewRecorder(), r, func(c *goexpress.Context) error {
+		sess, _ := GetSession(c)
+		if !sess.IsNew() {
+			t.Error("tampered cookie was accepted")
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestSecretKeyRequiredForServerSideStores(t *testing.T) {
+	defer func() {
+		if recover() == nil {
+			t.Error("Middleware accepted a MemoryStore without a SecretKey")
+		}
+	}()
+	Middleware(DefaultConfig(newTestMemoryStore(t)))
+}
+
+func TestCookieStoreRejectsFallback(t *testing.T) {
+	memory := newTestMemoryStore(t)
+	cookies := NewCookieStore(time.Hour, testSecret)
+
+	for _, pair := range [][2]Store{{cookies, memory}, {memory, cookies}} {
+		config := testConfig(pair[0])
+		config.FallbackStore = pair[1]
+
+		func() {
+			defer func() {
+				if recover() == nil {
+					t.Errorf("Middleware accepted a %T with a %T fallback", pair[0], pair[1])
+				}
+			}()
+			Middleware(config)
+		}()
+	}
+}
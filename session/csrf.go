@@ -0,0 +1,119 @@
+package session
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/base64"
+	"net/http"
+
+	"github.com/abreed05/goexpress"
+)
+
+// csrfSessionKey is the session data key holding the CSRF token
+const csrfSessionKey = "_csrf_token"
+
+// CSRFConfig holds CSRF middleware configuration
+type CSRFConfig struct {
+	HeaderName string // Request header carrying the token (default "X-CSRF-Token")
+	FormField  string // Form field carrying the token (default "_csrf")
+	ContextKey string // Context key the token is exposed under (default "csrf_token")
+	SkipFunc   func(*goexpress.Context) bool
+}
+
+// DefaultCSRFConfig returns a default CSRF configuration
+func DefaultCSRFConfig() CSRFConfig {
+	return CSRFConfig{
+		HeaderName: "X-CSRF-Token",
+		FormField:  "_csrf",
+		ContextKey: "csrf_token",
+	}
+}
+
+// CSRF returns a middleware that protects unsafe methods with a per-session token.
+// It must be registered after the session middleware.
+func CSRF(config CSRFConfig) goexpress.Middleware {
+	if config.HeaderName == "" {
+		config.HeaderName = "X-CSRF-Token"
+	}
+
+	if config.FormField == "" {
+		config.FormField = "_csrf"
+	}
+
+	if config.ContextKey == "" {
+		config.ContextKey = "csrf_token"
+	}
+
+	return func(next goexpress.HandlerFunc) goexpress.HandlerFunc {
+		return func(c *goexpress.Context) error {
+			// Skip if skip function returns true
+			if config.SkipFunc != nil && config.SkipFunc(c) {
+				return next(c)
+			}
+
+			session, err := GetSession(c)
+			if err != nil {
+				return err
+			}
+
+			// Generate a token for the session if it doesn't have one yet
+			token, ok := session.GetString(csrfSessionKey)
+			if !ok || token == "" {
+				token, err = generateCSRFToken()
+				if err != nil {
+					return err
+				}
+				session.Set(csrfSessionKey, token)
+			}
+
+			// Expose token for templates
+			c.Set(config.ContextKey, token)
+			c.Set("csrf_context_key", config.ContextKey)
+
+			switch c.Method() {
+			case http.MethodPost, http.MethodPut, http.MethodPatch, http.MethodDelete:
+				sent := c.Header(config.HeaderName)
+				if sent == "" {
+					sent = c.FormValue(config.FormField)
+				}
+
+				if subtle.ConstantTimeCompare([]byte(sent), []byte(token)) != 1 {
+					return goexpress.NewHTTPError(http.StatusForbidden, "Invalid CSRF token")
+				}
+			}
+
+			return next(c)
+		}
+	}
+}
+
+// rotateCSRFToken replaces the CSRF token of a session that already has one
+func rotateCSRFToken(c *goexpress.Context, session *Session) error {
+	if _, ok := session.GetString(csrfSessionKey); !ok {
+		return nil
+	}
+
+	token, err := generateCSRFToken()
+	if err != nil {
+		return err
+	}
+	session.Set(csrfSessionKey, token)
+
+	// Keep the token exposed to templates in sync
+	if key, ok := c.Get("csrf_context_key"); ok {
+		if contextKey, ok := key.(string); ok {
+			c.Set(contextKey, token)
+		}
+	}
+
+	return nil
+}
+
+// generateCSRFToken generates a random CSRF token
+func generateCSRFToken() (string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
@@ -0,0 +1,45 @@
+package session
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"errors"
+)
+
+var (
+	// ErrDecryption is returned when an encrypted payload can't be decrypted with any key
+	ErrDecryption = errors.New("session payload decryption failed")
+)
+
+// newAEAD creates an AES-GCM cipher for key
+func newAEAD(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// encrypt seals plaintext with a random nonce, returning nonce || ciphertext
+func encrypt(plaintext []byte, aead cipher.AEAD) ([]byte, error) {
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	return aead.Seal(nonce, nonce, plaintext, nil), nil
+}
+
+// decrypt opens data sealed by encrypt, trying each key in turn
+func decrypt(data []byte, aeads []cipher.AEAD) ([]byte, error) {
+	for _, aead := range aeads {
+		if len(data) < aead.NonceSize() {
+			continue
+		}
+		nonce, ciphertext := data[:aead.NonceSize()], data[aead.NonceSize():]
+		if plaintext, err := aead.Open(nil, nonce, ciphertext, nil); err == nil {
+			return plaintext, nil
+		}
+	}
+	return nil, ErrDecryption
+}
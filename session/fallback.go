@@ -0,0 +1,224 @@
+package session
+
+import (
+	"context"
+	"errors"
+	"log"
+	"sync"
+	"time"
+)
+
+// Pinger is implemented by stores that can report whether their backend is reachable
+type Pinger interface {
+	Ping(ctx context.Context) error
+}
+
+// fallbackStore serves sessions from a fallback store while the primary is failing
+type fallbackStore struct {
+	primary       Store
+	fallback      Store
+	retryInterval time.Duration
+
+	mu       sync.RWMutex
+	degraded bool
+
+	stop      chan struct{}  // Closed by Close to end the probe
+	probing   sync.WaitGroup // Running retryPrimary
+	closeOnce sync.Once
+}
+
+// newFallbackStore wraps primary so backend errors switch traffic to fallback
+func newFallbackStore(primary, fallback Store, retryInterval time.Duration) *fallbackStore {
+	return &fallbackStore{
+		primary:       primary,
+		fallback:      fallback,
+		retryInterval: retryInterval,
+		stop:          make(chan struct{}),
+	}
+}
+
+// Get retrieves a session
+func (f *fallbackStore) Get(id string) (*Session, error) {
+	var session *Session
+	err := f.do(func(s Store) error {
+		var err error
+		session, err = s.Get(id)
+		return err
+	})
+	return session, err
+}
+
+// Set stores a session
+func (f *fallbackStore) Set(session *Session) error {
+	return f.do(func(s Store) error { return s.Set(session) })
+}
+
+// GetCtx retrieves a session using ctx
+func (f *fallbackStore) GetCtx(ctx context.Context, id string) (*Session, error) {
+	var session *Session
+	err := f.do(func(s Store) error {
+		var err error
+		session, err = getCtx(ctx, s, id)
+		return err
+	})
+	return session, err
+}
+
+// GetAndTouchCtx retrieves a session and extends its expiration by ttl,
+// in one round-trip when the active store supports it
+func (f *fallbackStore) GetAndTouchCtx(ctx context.Context, id string, ttl time.Duration) (*Session, error) {
+	var session *Session
+	err := f.do(func(s Store) error {
+		if ts, ok := s.(touchingStore); ok {
+			var err error
+			session, err = ts.GetAndTouchCtx(ctx, id, ttl)
+			return err
+		}
+
+		loaded, err := getCtx(ctx, s, id)
+		if err != nil {
+			return err
+		}
+		if err := touchCtx(ctx, s, id, ttl); err != nil {
+			return err
+		}
+		loaded.ExpiresAt = time.Now().Add(ttl)
+		session = loaded
+		return nil
+	})
+	return session, err
+}
+
+// SetCtx stores a session using ctx
+func (f *fallbackStore) SetCtx(ctx context.Context, session *Session) error {
+	return f.do(func(s Store) error { return setCtx(ctx, s, session) })
+}
+
+// DeleteCtx removes a session using ctx
+func (f *fallbackStore) DeleteCtx(ctx context.Context, id string) error {
+	return f.do(func(s Store) error { return deleteCtx(ctx, s, id) })
+}
+
+// TouchCtx extends a session's expiration by ttl using ctx
+func (f *fallbackStore) TouchCtx(ctx context.Context, id string, ttl time.Duration) error {
+	return f.do(func(s Store) error { return touchCtx(ctx, s, id, ttl) })
+}
+
+// Close stops probing the primary store. It may be called more than once.
+// Both stores are left open for their owner to close.
+func (f *fallbackStore) Close() error {
+	f.closeOnce.Do(func() {
+		// Under mu, so degrade can't start a probe after the stop
+		f.mu.Lock()
+		close(f.stop)
+		f.mu.Unlock()
+	})
+	f.probing.Wait()
+	return nil
+}
+
+// Delete removes a session
+func (f *fallbackStore) Delete(id string) error {
+	return f.do(func(s Store) error { return s.Delete(id) })
+}
+
+// Cleanup removes expired sessions
+func (f *fallbackStore) Cleanup() error {
+	return f.do(func(s Store) error { return s.Cleanup() })
+}
+
+// Touch updates the last access time and extends the expiration by ttl
+func (f *fallbackStore) Touch(id string, ttl time.Duration) error {
+	return f.do(func(s Store) error { return s.Touch(id, ttl) })
+}
+
+// do runs op against the active store, failing over on backend errors
+func (f *fallbackStore) do(op func(Store) error) error {
+	f.mu.RLock()
+	degraded := f.degraded
+	f.mu.RUnlock()
+
+	if degraded {
+		return op(f.fallback)
+	}
+
+	err := op(f.primary)
+	if !isBackendError(err) {
+		return err
+	}
+
+	f.degrade(err)
+	return op(f.fallback)
+}
+
+// degrade switches to the fallback store and starts probing the primary
+func (f *fallbackStore) degrade(cause error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if f.degraded {
+		return
+	}
+
+	f.degraded = true
+	log.Printf("session: primary store unavailable, using fallback store: %v", cause)
+
+	select {
+	case <-f.stop:
+		return
+	default:
+	}
+	f.probing.Add(1)
+	go f.retryPrimary()
+}
+
+// retryPrimary switches back to the primary store once it is reachable
+// again, or gives up when the store is closed
+func (f *fallbackStore) retryPrimary() {
+	defer f.probing.Done()
+
+	ticker := time.NewTicker(f.retryInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-f.stop:
+			return
+		case <-ticker.C:
+		}
+
+		if !f.primaryReachable() {
+			continue
+		}
+
+		f.mu.Lock()
+		f.degraded = false
+		f.mu.Unlock()
+
+		log.Printf("session: primary store recovered, leaving fallback store")
+		return
+	}
+}
+
+// primaryReachable pings the primary store, giving up after one retry
+// interval so a hanging backend can't stall the probe. Stores that can't be
+// pinged are simply retried after one interval.
+func (f *fallbackStore) primaryReachable() bool {
+	pinger, ok := f.primary.(Pinger)
+	if !ok {
+		return true
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), f.retryInterval)
+	defer cancel()
+	return pinger.Ping(ctx) == nil
+}
+
+// isBackendError reports whether err is a storage failure rather than a normal lookup result
+func isBackendError(err error) bool {
+	return err != nil &&
+		err != ErrSessionNotFound &&
+		err != ErrSessionExpired &&
+		err != ErrStoreFull &&
+		!errors.Is(err, ErrSessionTooLarge)
+}
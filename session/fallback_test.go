@@ -0,0 +1,119 @@
+package session
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+)
+
+// hangingStore is a primary store whose backend is down: reads fail and
+// pings hang until their context ends
+type hangingStore struct {
+	Store
+
+	mu    sync.Mutex
+	pings []context.Context
+}
+
+func (s *hangingStore) Get(id string) (*Session, error) {
+	return nil, errors.New("connection refused")
+}
+
+func (s *hangingStore) Ping(ctx context.Context) error {
+	s.mu.Lock()
+	s.pings = append(s.pings, ctx)
+	s.mu.Unlock()
+
+	<-ctx.Done()
+	return ctx.Err()
+}
+
+func TestFallbackProbeStopsOnClose(t *testing.T) {
+	primary := &hangingStore{Store: newTestMemoryStore(t)}
+	f := newFallbackStore(primary, newTestMemoryStore(t), 10*time.Millisecond)
+
+	if _, err := f.Get("id"); err != ErrSessionNotFound {
+		t.Fatalf("Get = %v, want ErrSessionNotFound from the fallback", err)
+	}
+
+	// Pings time out after one interval instead of hanging the probe
+	time.Sleep(50 * time.Millisecond)
+	primary.mu.Lock()
+	pings := len(primary.pings)
+	_, hasDeadline := primary.pings[0].Deadline()
+	primary.mu.Unlock()
+	if pings < 2 {
+		t.Errorf("primary pinged %d times, want a ping per interval", pings)
+	}
+	if !hasDeadline {
+		t.Error("ping context has no deadline")
+	}
+
+	done := make(chan struct{})
+	go func() {
+		f.Close()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("Close didn't stop the probe")
+	}
+	if err := f.Close(); err != nil {
+		t.Errorf("second Close = %v", err)
+	}
+}
+
+// fallbackCtxKey marks the context passed through the fallback store
+type fallbackCtxKey struct{}
+
+// ctxStore records the contexts of its GetCtx and SetCtx calls
+type ctxStore struct {
+	Store
+	ctxs []context.Context
+}
+
+func (s *ctxStore) GetCtx(ctx context.Context, id string) (*Session, error) {
+	s.ctxs = append(s.ctxs, ctx)
+	return s.Store.Get(id)
+}
+
+func (s *ctxStore) SetCtx(ctx context.Context, session *Session) error {
+	s.ctxs = append(s.ctxs, ctx)
+	return s.Store.Set(session)
+}
+
+func TestFallbackForwardsContext(t *testing.T) {
+	primary := &ctxStore{Store: newTestMemoryStore(t)}
+	f := newFallbackStore(primary, newTestMemoryStore(t), time.Minute)
+	defer f.Close()
+
+	ctx := context.WithValue(context.Background(), fallbackCtxKey{}, "request")
+	sess := NewSession(time.Minute)
+	if err := f.SetCtx(ctx, sess); err != nil {
+		t.Fatalf("SetCtx: %v", err)
+	}
+	if _, err := f.GetCtx(ctx, sess.ID); err != nil {
+		t.Fatalf("GetCtx: %v", err)
+	}
+
+	// The primary can't touch on load, so it gets a GetCtx and a Touch
+	loaded, err := f.GetAndTouchCtx(ctx, sess.ID, time.Hour)
+	if err != nil {
+		t.Fatalf("GetAndTouchCtx: %v", err)
+	}
+	if until := time.Until(loaded.ExpiresAt); until < 59*time.Minute {
+		t.Errorf("GetAndTouchCtx expiry in %v, want about 1h", until)
+	}
+
+	if len(primary.ctxs) != 3 {
+		t.Fatalf("primary got %d context calls, want 3", len(primary.ctxs))
+	}
+	for _, got := range primary.ctxs {
+		if got.Value(fallbackCtxKey{}) != "request" {
+			t.Error("primary called without the caller's context")
+		}
+	}
+}
@@ -0,0 +1,153 @@
+package session
+
+import (
+	"github.com/abreed05/goexpress"
+)
+
+const (
+	// flashKey holds flash messages readable during the current request
+	flashKey = "_flash"
+	// flashNewKey holds flash messages written during the current request
+	flashNewKey = "_flash_new"
+)
+
+// Flash adds a one-time message to the session.
+// The message is available until the end of the next request, whether it is read or not.
+func Flash(c *goexpress.Context, key string, value interface{}) error {
+	session, err := GetSession(c)
+	if err != nil {
+		return err
+	}
+
+	messages := flashMessages(session, flashNewKey)
+	messages[key] = value
+	session.Set(flashNewKey, messages)
+	return nil
+}
+
+// GetFlash retrieves and removes a flash message
+func GetFlash(c *goexpress.Context, key string) (interface{}, bool) {
+	session, err := GetSession(c)
+	if err != nil {
+		return nil, false
+	}
+
+	for _, bucket := range []string{flashKey, flashNewKey} {
+		messages := flashMessages(session, bucket)
+		value, ok := messages[key]
+		if !ok {
+			continue
+		}
+
+		delete(messages, key)
+		if len(messages) == 0 {
+			session.Delete(bucket)
+		} else {
+			session.Set(bucket, messages)
+		}
+		return value, true
+	}
+
+	return nil, false
+}
+
+// FlashAppend adds a message to the list of flash messages stored under key
+func FlashAppend(c *goexpress.Context, key string, value interface{}) error {
+	session, err := GetSession(c)
+	if err != nil {
+		return err
+	}
+
+	messages := flashMessages(session, flashNewKey)
+	var values []interface{}
+	switch existing := messages[key].(type) {
+	case nil:
+	case []interface{}:
+		values = existing
+	default:
+		values = []interface{}{existing}
+	}
+	messages[key] = append(values, value)
+	session.Set(flashNewKey, messages)
+	return nil
+}
+
+// GetFlashes retrieves and removes all flash messages stored under key, oldest first
+func GetFlashes(c *goexpress.Context, key string) ([]interface{}, bool) {
+	session, err := GetSession(c)
+	if err != nil {
+		return nil, false
+	}
+
+	var values []interface{}
+	found := false
+	for _, bucket := range []string{flashKey, flashNewKey} {
+		messages := flashMessages(session, bucket)
+		value, ok := messages[key]
+		if !ok {
+			continue
+		}
+
+		if list, ok := value.([]interface{}); ok {
+			values = append(values, list...)
+		} else {
+			values = append(values, value)
+		}
+		found = true
+
+		delete(messages, key)
+		if len(messages) == 0 {
+			session.Delete(bucket)
+		} else {
+			session.Set(bucket, messages)
+		}
+	}
+
+	return values, found
+}
+
+// GetAllFlash retrieves and removes all pending flash messages
+func GetAllFlash(c *goexpress.Context) map[string]interface{} {
+	session, err := GetSession(c)
+	if err != nil {
+		return nil
+	}
+
+	all := make(map[string]interface{})
+	for _, bucket := range []string{flashKey, flashNewKey} {
+		if _, ok := session.Get(bucket); !ok {
+			continue
+		}
+		for key, value := range flashMessages(session, bucket) {
+			all[key] = value
+		}
+		session.Delete(bucket)
+	}
+
+	return all
+}
+
+// sweepFlash discards the previous request's flash messages and makes the
+// ones written during the previous request readable
+func sweepFlash(session *Session) {
+	_, hasCurrent := session.Get(flashKey)
+	newMessages, hasNew := session.Get(flashNewKey)
+
+	if hasCurrent {
+		session.Delete(flashKey)
+	}
+	if hasNew {
+		session.Delete(flashNewKey)
+		session.Set(flashKey, newMessages)
+	}
+}
+
+// flashMessages returns the flash messages stored under bucket
+func flashMessages(session *Session, bucket string) map[string]interface{} {
+	if messages, ok := session.Get(bucket); ok {
+		if m, ok := messages.(map[string]interface{}); ok {
+			return m
+		}
+	}
+	return make(map[string]interface{})
+}
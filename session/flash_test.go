@@ -0,0 +1,67 @@
+package session
+
+import (
+	"net/http/httptest"
+	"reflect"
+	"testing"
+
+	"github.com/abreed05/goexpress"
+)
+
+func TestFlashAppend(t *testing.T) {
+	store := newTestMemoryStore(t)
+	config := testConfig(store)
+
+	rec := httptest.NewRecorder()
+	err := serve(t, config, rec, httptest.NewRequest("POST", "/signup", nil), func(c *goexpress.Context) error {
+		for _, msg := range []string{"name is required", "email is invalid", "password is too short"} {
+			if err := FlashAppend(c, "error", msg); err != nil {
+				return err
+			}
+		}
+		return c.String("redirect")
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The next request reads all three, in order, and they are gone afterwards
+	cookie := sessionCookie(rec, config.CookieName)
+	err = serve(t, config, httptest.NewRecorder(), withCookie("/signup", cookie), func(c *goexpress.Context) error {
+		got, ok := GetFlashes(c, "error")
+		want := []interface{}{"name is required", "email is invalid", "password is too short"}
+		if !ok || !reflect.DeepEqual(got, want) {
+			t.Errorf("GetFlashes = %v, %v; want %v", got, ok, want)
+		}
+		if got, ok := GetFlashes(c, "error"); ok {
+			t.Errorf("second GetFlashes = %v, want none", got)
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestFlashAppendAfterFlash(t *testing.T) {
+	store := newTestMemoryStore(t)
+	config := testConfig(store)
+
+	err := serve(t, config, httptest.NewRecorder(), httptest.NewRequest("GET", "/", nil), func(c *goexpress.Context) error {
+		// A single-value flash becomes the first of the list
+		if err := Flash(c, "notice", "saved"); err != nil {
+			return err
+		}
+		if err := FlashAppend(c, "notice", "emailed"); err != nil {
+			return err
+		}
+		got, ok := GetFlashes(c, "notice")
+		if want := []interface{}{"saved", "emailed"}; !ok || !reflect.DeepEqual(got, want) {
+			t.Errorf("GetFlashes = %v, %v; want %v", got, ok, want)
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+}
@@ -1,7 +1,13 @@
 package session
 
 import (
+	"bufio"
+	"context"
+	"fmt"
+	"log"
+	"net"
 	"net/http"
+	"strings"
 	"time"
 
 	"github.com/abreed05/goexpress"
@@ -17,20 +23,66 @@ type Config struct {
 	Secure       bool
 	HttpOnly     bool
 	SameSite     http.SameSite
+	Partitioned  bool // Partitioned (CHIPS) cookie for cross-site embeds, requires Secure and SameSite=None
 	ContextKey   string
+	SecretKey    []byte                 // Key used to HMAC-sign the session cookie (not needed with a CookieStore)
+	IDGenerator  func() (string, error) // Generates new session IDs (default 32 random bytes, base64-URL)
+
+	// FallbackStore (optional) serves sessions while Store returns backend errors.
+	// The primary store is retried every FallbackRetryInterval (default 5s).
+	// Neither store may be a CookieStore.
+	FallbackStore         Store
+	FallbackRetryInterval time.Duration
+
+	// TouchOnLoad extends the session's expiration while loading it, when the
+	// store supports it (RedisStore), so unmodified sessions need a single
+	// round-trip per request instead of a load followed by a Touch.
+	TouchOnLoad bool
+
+	// FailOpen starts a fresh session, logging the error, when loading one
+	// fails with a backend error such as Redis being unreachable. By default
+	// the error is returned, so an outage isn't mistaken for every user
+	// having logged out. Missing and expired sessions always start fresh.
+	FailOpen bool
+
+	// TouchInterval skips refreshing the expiration of an unmodified session
+	// that was refreshed less than this long ago, so read-mostly sessions are
+	// written at most once per interval. The stored expiry may then lag the
+	// last access by up to the interval. Must be shorter than MaxAge.
+	TouchInterval time.Duration
+
+	// RegenerateOnChange gives an existing session a new ID whenever a request
+	// modifies its data, so privilege changes can't be ridden with an ID that
+	// was known before them. Use Login to rotate only where it matters.
+	RegenerateOnChange bool
+
+	// RollingID gives an existing session a new ID on every response, so a
+	// stolen cookie is only valid until the victim's next request
+	RollingID bool
+
+	// RememberMaxAge is how long sessions marked persistent with
+	// SetPersistent ("remember me") last (default 30 days)
+	RememberMaxAge time.Duration
+
+	// Lifecycle hooks. They run synchronously on the request path,
+	// so hand slow work (network calls, heavy logging) off to a goroutine.
+	OnCreate  func(*Session)  // Called after a new session is first stored
+	OnLoad    func(*Session)  // Called after an existing session is loaded
+	OnDestroy func(id string) // Called after a session is deleted
 }
 
 // DefaultConfig returns a default session configuration
 func DefaultConfig(store Store) Config {
 	return Config{
-		Store:      store,
-		CookieName: "session_id",
-		CookiePath: "/",
-		MaxAge:     24 * time.Hour,
-		HttpOnly:   true,
-		Secure:     false,
-		SameSite:   http.SameSiteLaxMode,
-		ContextKey: "session",
+		Store:       store,
+		CookieName:  "session_id",
+		CookiePath:  "/",
+		MaxAge:      24 * time.Hour,
+		HttpOnly:    true,
+		Secure:      false,
+		SameSite:    http.SameSiteLaxMode,
+		ContextKey:  "session",
+		IDGenerator: generateSessionID,
 	}
 }
 
@@ -40,10 +92,23 @@ func Middleware(config Config) goexpress.Middleware {
 		panic("session store is required")
 	}
 
+	// Cookie stores sign the session with their own key
+	if _, ok := config.Store.(cookieEncoder); !ok && len(config.SecretKey) == 0 {
+		panic("session secret key is required")
+	}
+
 	if config.CookieName == "" {
 		config.CookieName = "session_id"
 	}
 
+	if strings.HasPrefix(config.CookieName, "__Host-") && config.CookiePath == "" {
+		config.CookiePath = "/"
+	}
+
+	if err := validateCookie(config); err != nil {
+		panic(err.Error())
+	}
+
 	if config.ContextKey == "" {
 		config.ContextKey = "session"
 	}
@@ -52,70 +117,521 @@ func Middleware(config Config) goexpress.Middleware {
 		config.MaxAge = 24 * time.Hour
 	}
 
+	if config.TouchInterval >= config.MaxAge {
+		panic("session touch interval must be shorter than MaxAge")
+	}
+
+	if config.IDGenerator == nil {
+		config.IDGenerator = generateSessionID
+	}
+
+	if config.FallbackStore != nil {
+		// Cookie store cookies hold the session itself rather than an ID,
+		// so they can't fail over to or from a server-side store
+		_, primaryCookies := config.Store.(cookieEncoder)
+		_, fallbackCookies := config.FallbackStore.(cookieEncoder)
+		if primaryCookies || fallbackCookies {
+			panic("session FallbackStore can't be used with a cookie store")
+		}
+
+		if config.FallbackRetryInterval <= 0 {
+			config.FallbackRetryInterval = 5 * time.Second
+		}
+		config.Store = newFallbackStore(config.Store, config.FallbackStore, config.FallbackRetryInterval)
+	}
+
 	return func(next goexpress.HandlerFunc) goexpress.HandlerFunc {
 		return func(c *goexpress.Context) error {
 			var session *Session
 
 			// Try to get existing session from cookie
 			cookie, err := c.GetCookie(config.CookieName)
-			if err == nil && cookie.Value != "" {
-				session, err = config.Store.Get(cookie.Value)
-				if err != nil && err != ErrSessionNotFound && err != ErrSessionExpired {
-					// Log error but continue with new session
+			if _, ok := config.Store.(cookieEncoder); ok && err == nil && cookie.Value != "" {
+				// Cookie stores verify and decode the cookie themselves.
+				// A cookie that fails is treated as no session.
+				if session, err = config.Store.Get(cookie.Value); err != nil {
 					session = nil
 				}
+			} else if err == nil && cookie.Value != "" {
+				// Cookies that fail verification are treated as no session
+				if id, verr := verifyValue(cookie.Value, config.SecretKey); verr == nil {
+					session, err = loadSession(c.Request.Context(), config, id)
+					if err != nil && err != ErrSessionNotFound && err != ErrSessionExpired {
+						if !config.FailOpen {
+							return err
+						}
+						log.Printf("session: failed to load session, starting a new one: %v", err)
+						session = nil
+					}
+				}
 			}
 
-			// Create new session if none exists
+			// Create new session if none exists. It is only persisted
+			// once the handler stores something in it.
 			if session == nil {
-				session = NewSession(config.MaxAge)
-				if err := config.Store.Set(session); err != nil {
+				session, err = createSession(config)
+				if err != nil {
 					return err
 				}
+				session.isNew = true
 			} else {
-				// Touch existing session to update last access time
-				config.Store.Touch(session.ID)
+				// Age flash messages by one request
+				sweepFlash(session)
+				if config.OnLoad != nil {
+					config.OnLoad(session)
+				}
 			}
 
-			// Store session in context
+			// Store session in context, recording the key so GetSession finds it
+			manager := &sessionManager{config: config}
 			c.Set(config.ContextKey, session)
+			c.Set(config.ContextKey+managerKeySuffix, manager)
 			c.Set("session_id", session.ID)
+			c.Set("session_context_key", config.ContextKey)
+
+			// Save the session and set the cookie right before the response is
+			// written, since headers can't be changed afterwards. Mutations made
+			// by every middleware and the handler until then are coalesced into
+			// this single write.
+			var saveErr error
+			saved := false
+			save := func() {
+				if !saved {
+					saved = true
+					saveErr = manager.save(c, false)
+				}
+			}
+			c.Response = &sessionWriter{ResponseWriter: c.Response, beforeWrite: save}
 
 			// Execute handler
 			err = next(c)
 
-			// Save session after handler execution
-			if sessionData, ok := c.Get(config.ContextKey); ok {
-				if sess, ok := sessionData.(*Session); ok {
-					// Update expiration time
-					sess.ExpiresAt = time.Now().Add(config.MaxAge)
-					
-					if err := config.Store.Set(sess); err != nil {
-						return err
+			if saved {
+				// Persist changes made after the response was written
+				if sess := contextSession(c, config); sess != nil && !sess.isNew && sess.IsModified() {
+					if serr := setCtx(c.Request.Context(), config.Store, sess); serr != nil && saveErr == nil {
+						saveErr = serr
 					}
-
-					// Set cookie
-					c.Cookie(&http.Cookie{
-						Name:     config.CookieName,
-						Value:    sess.ID,
-						Path:     config.CookiePath,
-						Domain:   config.CookieDomain,
-						MaxAge:   int(config.MaxAge.Seconds()),
-						Secure:   config.Secure,
-						HttpOnly: config.HttpOnly,
-						SameSite: config.SameSite,
-					})
+					sess.modified = false
 				}
+			} else {
+				save()
+			}
+
+			if err != nil {
+				return err
 			}
+			return saveErr
+		}
+	}
+}
+
+// cookieEncoder is implemented by stores that keep the whole session in the
+// cookie (CookieStore). Their Get takes the cookie value instead of an ID.
+type cookieEncoder interface {
+	Encode(session *Session) (string, error)
+}
+
+// cookieValue returns the session cookie's value: the signed session ID, or
+// the encoded session for a cookie store
+func cookieValue(config Config, sess *Session) (string, error) {
+	if ce, ok := config.Store.(cookieEncoder); ok {
+		return ce.Encode(sess)
+	}
+	return signValue(sess.ID, config.SecretKey), nil
+}
+
+// touchedRecently reports whether a session expiring at expiresAt had its
+// expiration set to ttl from now less than interval ago
+func touchedRecently(expiresAt time.Time, ttl, interval time.Duration) bool {
+	return interval > 0 && time.Until(expiresAt) > ttl-interval
+}
+
+// managerKeySuffix is appended to a middleware's ContextKey to store its sessionManager
+const managerKeySuffix = ":manager"
+
+// sessionManager tracks what a middleware already flushed during a request,
+// so an early Save and the final save don't repeat work
+type sessionManager struct {
+	config       Config
+	rotated      bool   // ID already rotated for RollingID
+	cookieValue  string // Value the cookie was last set to
+	cookieMaxAge int    // Max-Age the cookie was last set with
+}
+
+// Save flushes the session to the store right away, e.g. before a long
+// running operation, instead of waiting for the response to be written.
+// Changes made afterwards are still saved with the response.
+// With several session scopes it saves the innermost one, see SaveByKey.
+func Save(c *goexpress.Context) error {
+	key := "session"
+	if k, ok := c.Get("session_context_key"); ok {
+		if contextKey, ok := k.(string); ok {
+			key = contextKey
+		}
+	}
+	return SaveByKey(c, key)
+}
+
+// SaveByKey is like Save for the session a middleware stored under contextKey
+func SaveByKey(c *goexpress.Context, contextKey string) error {
+	manager, err := managerByKey(c, contextKey)
+	if err != nil {
+		return err
+	}
+	return manager.save(c, false)
+}
 
+// Refresh extends the expiration of the session of config's scope, in the
+// store and in its cookie, right away and regardless of TouchInterval, e.g.
+// for a heartbeat endpoint. Its data is left as it is, and sessions that were
+// never stored are skipped.
+func Refresh(c *goexpress.Context, config Config) error {
+	manager, err := managerByKey(c, contextKey(config))
+	if err != nil {
+		return err
+	}
+	return manager.save(c, true)
+}
+
+// managerByKey returns the sessionManager of the middleware that stored its
+// session under contextKey
+func managerByKey(c *goexpress.Context, contextKey string) (*sessionManager, error) {
+	m, ok := c.Get(contextKey + managerKeySuffix)
+	if !ok {
+		return nil, ErrSessionNotFound
+	}
+	manager, ok := m.(*sessionManager)
+	if !ok {
+		return nil, ErrSessionNotFound
+	}
+	return manager, nil
+}
+
+// save persists the session in the context and sets its cookie, touching an
+// unmodified session even if it was touched already when refresh is set.
+// New sessions that were never written to are skipped entirely.
+func (m *sessionManager) save(c *goexpress.Context, refresh bool) error {
+	config := m.config
+
+	sess := contextSession(c, config)
+	if sess == nil || (sess.isNew && !sess.IsModified()) {
+		return nil
+	}
+
+	// Move the session to a new ID when configured
+	var oldID string
+	rolling := config.RollingID && !m.rotated
+	if !sess.isNew && (rolling || (config.RegenerateOnChange && sess.IsModified())) {
+		rotated, err := rotateSession(c, config, sess)
+		if err != nil {
+			return err
+		}
+		oldID, sess = sess.ID, rotated
+		m.rotated = true
+	}
+
+	// Update expiration time
+	ttl, cookieMaxAge := lifetime(config, sess)
+	expiresAt := sess.ExpiresAt
+	sess.ExpiresAt = time.Now().Add(ttl)
+
+	if sess.IsModified() {
+		if err := setCtx(c.Request.Context(), config.Store, sess); err != nil {
+			return err
+		}
+		sess.modified = false
+		sess.touched = true
+
+		if sess.isNew {
+			sess.isNew = false
+			if config.OnCreate != nil {
+				config.OnCreate(sess)
+			}
+		}
+	} else if !refresh && !sess.touched && touchedRecently(expiresAt, ttl, config.TouchInterval) {
+		// Refreshed within TouchInterval, keep the stored expiration
+		sess.ExpiresAt = expiresAt
+	} else if refresh || !sess.touched || ttl != config.MaxAge {
+		// Nothing changed, only refresh the sliding expiration. TouchOnLoad
+		// used MaxAge, which is too short for a remembered session.
+		err := touchCtx(c.Request.Context(), config.Store, sess.ID, ttl)
+		if err == ErrSessionNotFound {
+			// Store lost the session mid-request, write it back
+			err = setCtx(c.Request.Context(), config.Store, sess)
+		}
+		if err != nil {
 			return err
 		}
+		sess.touched = true
+	}
+
+	if oldID != "" {
+		if err := deleteCtx(c.Request.Context(), config.Store, oldID); err == nil && config.OnDestroy != nil {
+			config.OnDestroy(oldID)
+		}
+	}
+
+	value, err := cookieValue(config, sess)
+	if err != nil {
+		return err
+	}
+
+	if m.cookieValue == value && m.cookieMaxAge == cookieMaxAge {
+		return nil
+	}
+	m.cookieValue, m.cookieMaxAge = value, cookieMaxAge
+
+	// Set cookie
+	c.Cookie(&http.Cookie{
+		Name:        config.CookieName,
+		Value:       value,
+		Path:        config.CookiePath,
+		Domain:      config.CookieDomain,
+		MaxAge:      cookieMaxAge,
+		Secure:      config.Secure,
+		HttpOnly:    config.HttpOnly,
+		SameSite:    config.SameSite,
+		Partitioned: config.Partitioned,
+	})
+
+	return nil
+}
+
+// rememberKey records a SetPersistent choice in the session data
+const rememberKey = "_remember"
+
+// SetPersistent chooses how long the current session lasts. Persistent
+// sessions ("remember me") get a cookie and store TTL of RememberMaxAge.
+// Otherwise the cookie is a browser session cookie, dropped when the
+// browser closes, while the store still expires the session after MaxAge.
+// Sessions without a choice keep MaxAge for both.
+func SetPersistent(c *goexpress.Context, config Config, persistent bool) error {
+	session, err := GetSessionByKey(c, contextKey(config))
+	if err != nil {
+		return err
+	}
+
+	session.Set(rememberKey, persistent)
+	return nil
+}
+
+// lifetime returns the store TTL and cookie Max-Age for sess, following SetPersistent
+func lifetime(config Config, sess *Session) (time.Duration, int) {
+	persistent, ok := sess.GetBool(rememberKey)
+	switch {
+	case !ok:
+		return config.MaxAge, int(config.MaxAge.Seconds())
+	case persistent:
+		maxAge := config.RememberMaxAge
+		if maxAge <= 0 {
+			maxAge = 30 * 24 * time.Hour
+		}
+		return maxAge, int(maxAge.Seconds())
+	default:
+		// No Max-Age makes a session cookie
+		return config.MaxAge, 0
 	}
 }
 
-// GetSession retrieves the session from the context
+// contextKey returns the context key sessions of config are stored under,
+// so helpers given a config without ContextKey agree with the middleware
+func contextKey(config Config) string {
+	if config.ContextKey == "" {
+		return "session"
+	}
+	return config.ContextKey
+}
+
+// contextSession returns the session stored in the context, if any
+func contextSession(c *goexpress.Context, config Config) *Session {
+	if sessionData, ok := c.Get(contextKey(config)); ok {
+		if sess, ok := sessionData.(*Session); ok {
+			return sess
+		}
+	}
+	return nil
+}
+
+// sessionWriter calls beforeWrite once, right before the response headers are sent
+type sessionWriter struct {
+	http.ResponseWriter
+	beforeWrite func()
+	committed   bool
+}
+
+// WriteHeader commits the session and sends the status code
+func (w *sessionWriter) WriteHeader(code int) {
+	w.commit()
+	w.ResponseWriter.WriteHeader(code)
+}
+
+// Write commits the session and writes the body
+func (w *sessionWriter) Write(b []byte) (int, error) {
+	w.commit()
+	return w.ResponseWriter.Write(b)
+}
+
+// Flush commits the session and flushes buffered data to the client
+func (w *sessionWriter) Flush() {
+	w.commit()
+	if f, ok := w.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// Hijack commits the session and hands the connection over to the caller,
+// e.g. to upgrade it to a WebSocket
+func (w *sessionWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	w.commit()
+	h, ok := w.ResponseWriter.(http.Hijacker)
+	if !ok {
+		return nil, nil, fmt.Errorf("session: %T does not support hijacking", w.ResponseWriter)
+	}
+	return h.Hijack()
+}
+
+// Unwrap returns the wrapped ResponseWriter for http.ResponseController
+func (w *sessionWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+// commit runs beforeWrite the first time the response is touched
+func (w *sessionWriter) commit() {
+	if !w.committed {
+		w.committed = true
+		w.beforeWrite()
+	}
+}
+
+// validateCookie checks the config against browser rules that would
+// otherwise silently drop the cookie: SameSite=None and the __Secure- and
+// __Host- name prefixes all require Secure, and Partitioned cookies are only
+// useful cross-site, which needs SameSite=None
+func validateCookie(config Config) error {
+	if config.SameSite == http.SameSiteNoneMode && !config.Secure {
+		return fmt.Errorf("session cookie %q with SameSite=None requires Secure", config.CookieName)
+	}
+
+	if config.Partitioned && (!config.Secure || config.SameSite != http.SameSiteNoneMode) {
+		return fmt.Errorf("partitioned session cookie %q requires Secure and SameSite=None", config.CookieName)
+	}
+
+	switch {
+	case strings.HasPrefix(config.CookieName, "__Host-"):
+		if !config.Secure {
+			return fmt.Errorf("session cookie %q requires Secure", config.CookieName)
+		}
+		if config.CookieDomain != "" {
+			return fmt.Errorf("session cookie %q must not set a Domain", config.CookieName)
+		}
+		if config.CookiePath != "/" {
+			return fmt.Errorf("session cookie %q requires Path \"/\"", config.CookieName)
+		}
+	case strings.HasPrefix(config.CookieName, "__Secure-"):
+		if !config.Secure {
+			return fmt.Errorf("session cookie %q requires Secure", config.CookieName)
+		}
+	}
+	return nil
+}
+
+// contextStore is implemented by stores that accept a request context
+type contextStore interface {
+	GetCtx(ctx context.Context, id string) (*Session, error)
+	SetCtx(ctx context.Context, session *Session) error
+}
+
+// contextUpdater is implemented by stores that delete and touch sessions
+// with a request context
+type contextUpdater interface {
+	DeleteCtx(ctx context.Context, id string) error
+	TouchCtx(ctx context.Context, id string, ttl time.Duration) error
+}
+
+// touchingStore is implemented by stores that can extend a session's
+// expiration in the same round-trip that loads it
+type touchingStore interface {
+	GetAndTouchCtx(ctx context.Context, id string, ttl time.Duration) (*Session, error)
+}
+
+// loadSession loads a session, touching it on the way when configured
+func loadSession(ctx context.Context, config Config, id string) (*Session, error) {
+	if ts, ok := config.Store.(touchingStore); ok && config.TouchOnLoad {
+		session, err := ts.GetAndTouchCtx(ctx, id, config.MaxAge)
+		if err != nil {
+			return nil, err
+		}
+		session.touched = true
+		return session, nil
+	}
+	return getCtx(ctx, config.Store, id)
+}
+
+// getCtx loads a session, passing ctx along when the store supports it
+func getCtx(ctx context.Context, store Store, id string) (*Session, error) {
+	if cs, ok := store.(contextStore); ok {
+		return cs.GetCtx(ctx, id)
+	}
+	return store.Get(id)
+}
+
+// setCtx saves a session, passing ctx along when the store supports it
+func setCtx(ctx context.Context, store Store, session *Session) error {
+	if cs, ok := store.(contextStore); ok {
+		return cs.SetCtx(ctx, session)
+	}
+	return store.Set(session)
+}
+
+// deleteCtx deletes a session, passing ctx along when the store supports it
+func deleteCtx(ctx context.Context, store Store, id string) error {
+	if cu, ok := store.(contextUpdater); ok {
+		return cu.DeleteCtx(ctx, id)
+	}
+	return store.Delete(id)
+}
+
+// touchCtx extends a session's expiration, passing ctx along when the store
+// supports it
+func touchCtx(ctx context.Context, store Store, id string, ttl time.Duration) error {
+	if cu, ok := store.(contextUpdater); ok {
+		return cu.TouchCtx(ctx, id, ttl)
+	}
+	return store.Touch(id, ttl)
+}
+
+// createSession creates a session using the configured ID generator
+func createSession(config Config) (*Session, error) {
+	generate := config.IDGenerator
+	if generate == nil {
+		generate = generateSessionID
+	}
+
+	id, err := generate()
+	if err != nil {
+		return nil, err
+	}
+
+	return NewSessionWithID(id, config.MaxAge), nil
+}
+
+// GetSession retrieves the session from the context, under whatever
+// ContextKey the middleware was configured with. With several session
+// scopes this is the innermost middleware's session.
 func GetSession(c *goexpress.Context) (*Session, error) {
-	if session, ok := c.Get("session"); ok {
+	if key, ok := c.Get("session_context_key"); ok {
+		if contextKey, ok := key.(string); ok {
+			return GetSessionByKey(c, contextKey)
+		}
+	}
+	return GetSessionByKey(c, "session")
+}
+
+// GetSessionByKey retrieves the session a middleware stored under contextKey,
+// for apps running several session scopes (e.g. user and admin) side by side
+func GetSessionByKey(c *goexpress.Context, contextKey string) (*Session, error) {
+	if session, ok := c.Get(contextKey); ok {
 		if sess, ok := session.(*Session); ok {
 			return sess, nil
 		}
@@ -125,89 +641,135 @@ func GetSession(c *goexpress.Context) (*Session, error) {
 
 // DestroySession removes the session
 func DestroySession(c *goexpress.Context, config Config) error {
-	session, err := GetSession(c)
+	session, err := GetSessionByKey(c, contextKey(config))
 	if err != nil {
 		return err
 	}
 
 	// Delete from store
-	if err := config.Store.Delete(session.ID); err != nil {
+	if err := deleteCtx(c.Request.Context(), config.Store, session.ID); err != nil {
 		return err
 	}
 
+	if config.OnDestroy != nil {
+		config.OnDestroy(session.ID)
+	}
+
+	// Remove from context so the middleware doesn't save it again
+	c.Set(contextKey(config), nil)
+
 	// Clear cookie
 	c.Cookie(&http.Cookie{
-		Name:     config.CookieName,
-		Value:    "",
-		Path:     config.CookiePath,
-		MaxAge:   -1,
-		HttpOnly: true,
+		Name:        config.CookieName,
+		Value:       "",
+		Path:        config.CookiePath,
+		Domain:      config.CookieDomain,
+		MaxAge:      -1,
+		Secure:      config.Secure,
+		HttpOnly:    true,
+		SameSite:    config.SameSite,
+		Partitioned: config.Partitioned,
 	})
 
 	return nil
 }
 
+// UserSessionStore is implemented by stores that index sessions per user
+type UserSessionStore interface {
+	AddUserSession(userID, sessionID string) error
+	DeleteUserSessions(userID string) error
+}
+
+// DestroyUserSessions removes all sessions belonging to a user,
+// e.g. after a password change or "log out everywhere"
+func DestroyUserSessions(store UserSessionStore, userID string) error {
+	return store.DeleteUserSessions(userID)
+}
+
 // RegenerateSession creates a new session ID and migrates data
 func RegenerateSession(c *goexpress.Context, config Config) error {
-	oldSession, err := GetSession(c)
+	oldSession, err := GetSessionByKey(c, contextKey(config))
 	if err != nil {
 		return err
 	}
 
 	// Create new session with old data
-	newSession := NewSession(config.MaxAge)
-	newSession.Data = oldSession.Data
+	newSession, err := rotateSession(c, config, oldSession)
+	if err != nil {
+		return err
+	}
+
+	// Rotate the CSRF token along with the session ID
+	if err := rotateCSRFToken(c, newSession); err != nil {
+		return err
+	}
 
 	// Save new session
-	if err := config.Store.Set(newSession); err != nil {
+	ttl, cookieMaxAge := lifetime(config, newSession)
+	newSession.ExpiresAt = time.Now().Add(ttl)
+	if err := setCtx(c.Request.Context(), config.Store, newSession); err != nil {
 		return err
 	}
+	newSession.isNew = false
+	newSession.modified = false
 
-	// Delete old session
-	config.Store.Delete(oldSession.ID)
+	if config.OnCreate != nil {
+		config.OnCreate(newSession)
+	}
 
-	// Update context
-	c.Set(config.ContextKey, newSession)
-	c.Set("session_id", newSession.ID)
+	// Delete old session
+	if err := deleteCtx(c.Request.Context(), config.Store, oldSession.ID); err == nil && config.OnDestroy != nil {
+		config.OnDestroy(oldSession.ID)
+	}
 
 	// Set new cookie
+	value, err := cookieValue(config, newSession)
+	if err != nil {
+		return err
+	}
 	c.Cookie(&http.Cookie{
-		Name:     config.CookieName,
-		Value:    newSession.ID,
-		Path:     config.CookiePath,
-		Domain:   config.CookieDomain,
-		MaxAge:   int(config.MaxAge.Seconds()),
-		Secure:   config.Secure,
-		HttpOnly: config.HttpOnly,
-		SameSite: config.SameSite,
+		Name:        config.CookieName,
+		Value:       value,
+		Path:        config.CookiePath,
+		Domain:      config.CookieDomain,
+		MaxAge:      cookieMaxAge,
+		Secure:      config.Secure,
+		HttpOnly:    config.HttpOnly,
+		SameSite:    config.SameSite,
+		Partitioned: config.Partitioned,
 	})
 
 	return nil
 }
 
-// Flash adds a one-time message to the session
-func Flash(c *goexpress.Context, key string, value interface{}) error {
-	session, err := GetSession(c)
+// Login stores data in the session and moves it to a new ID in one call.
+// Rotating the ID on login defeats session fixation: an attacker who planted
+// a session ID before the user signed in can't use it afterwards.
+func Login(c *goexpress.Context, config Config, data map[string]interface{}) error {
+	session, err := GetSessionByKey(c, contextKey(config))
 	if err != nil {
 		return err
 	}
 
-	flashKey := "_flash_" + key
-	session.Set(flashKey, value)
-	return nil
+	for key, value := range data {
+		session.Set(key, value)
+	}
+
+	return RegenerateSession(c, config)
 }
 
-// GetFlash retrieves and removes a flash message
-func GetFlash(c *goexpress.Context, key string) (interface{}, bool) {
-	session, err := GetSession(c)
+// rotateSession copies old into a new unsaved session with a fresh ID and
+// puts it in the context in place of old
+func rotateSession(c *goexpress.Context, config Config, old *Session) (*Session, error) {
+	session, err := createSession(config)
 	if err != nil {
-		return nil, false
+		return nil, err
 	}
+	session.Data = copyData(old.Data)
+	session.isNew = true
+	session.modified = true
 
-	flashKey := "_flash_" + key
-	value, ok := session.Get(flashKey)
-	if ok {
-		session.Delete(flashKey)
-	}
-	return value, ok
+	c.Set(contextKey(config), session)
+	c.Set("session_id", session.ID)
+	return session, nil
 }
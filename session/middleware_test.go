@@ -0,0 +1,962 @@
+package session
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/abreed05/goexpress"
+)
+
+var testSecret = []byte("test-secret")
+
+// newTestMemoryStore returns a MemoryStore closed when the test ends
+func newTestMemoryStore(t testing.TB) *MemoryStore {
+	t.Helper()
+	store := NewMemoryStore(time.Hour)
+	t.Cleanup(func() { store.Close() })
+	return store
+}
+
+// testConfig returns a middleware config for store signed with testSecret
+func testConfig(store Store) Config {
+	config := DefaultConfig(store)
+	config.SecretKey = testSecret
+	return config
+}
+
+// serve runs handler behind the session middleware for config, writing to w
+func serve(t testing.TB, config Config, w http.ResponseWriter, r *http.Request, handler goexpress.HandlerFunc) error {
+	t.Helper()
+	return Middleware(config)(handler)(goexpress.NewContext(w, r))
+}
+
+// sessionCookie returns the cookie named name set on the response, or nil
+func sessionCookie(rec *httptest.ResponseRecorder, name string) *http.Cookie {
+	for _, cookie := range rec.Result().Cookies() {
+		if cookie.Name == name {
+			return cookie
+		}
+	}
+	return nil
+}
+
+func TestMiddlewareLazySave(t *testing.T) {
+	store := newTestMemoryStore(t)
+	config := testConfig(store)
+
+	// An untouched new session is neither stored nor sent
+	rec := httptest.NewRecorder()
+	err := serve(t, config, rec, httptest.NewRequest("GET", "/", nil), func(c *goexpress.Context) error {
+		return c.String("ok")
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if store.Len() != 0 {
+		t.Errorf("store has %d sessions, want 0", store.Len())
+	}
+	if sessionCookie(rec, config.CookieName) != nil {
+		t.Error("cookie set for an unused session")
+	}
+
+	// Writing to it saves it before the body, and later changes still persist
+	rec = httptest.NewRecorder()
+	var id string
+	err = serve(t, config, rec, httptest.NewRequest("GET", "/", nil), func(c *goexpress.Context) error {
+		sess, _ := GetSession(c)
+		id = sess.ID
+		sess.Set("user", "alice")
+		if err := c.String("ok"); err != nil {
+			return err
+		}
+		sess.Set("after", true)
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if sessionCookie(rec, config.CookieName) == nil {
+		t.Fatal("no session cookie on the response")
+	}
+
+	stored, err := store.Get(id)
+	if err != nil {
+		t.Fatalf("Get: %v", err)
+	}
+	if v, _ := stored.GetString("user"); v != "alice" {
+		t.Errorf("user = %q, want alice", v)
+	}
+	if v, _ := stored.GetBool("after"); !v {
+		t.Error("change made after the response was written was not saved")
+	}
+}
+
+func TestMiddlewareFlushCommitsSession(t *testing.T) {
+	store := newTestMemoryStore(t)
+	config := testConfig(store)
+
+	rec := httptest.NewRecorder()
+	err := serve(t, config, rec, httptest.NewRequest("GET", "/", nil), func(c *goexpress.Context) error {
+		sess, _ := GetSession(c)
+		sess.Set("user", "alice")
+
+		flusher, ok := c.Response.(http.Flusher)
+		if !ok {
+			t.Fatal("response does not implement http.Flusher")
+		}
+		flusher.Flush()
+
+		if store.Len() != 1 {
+			t.Errorf("store has %d sessions after Flush, want 1", store.Len())
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !rec.Flushed {
+		t.Error("Flush was not passed on")
+	}
+	// The recorder snapshots headers at the first flush
+	if sessionCookie(rec, config.CookieName) == nil {
+		t.Error("cookie was not set before the flush")
+	}
+}
+
+// hijackRecorder is a ResponseRecorder that can be hijacked
+type hijackRecorder struct {
+	*httptest.ResponseRecorder
+	hijacked bool
+}
+
+func (h *hijackRecorder) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	h.hijacked = true
+	server, client := net.Pipe()
+	client.Close()
+	return server, bufio.NewReadWriter(bufio.NewReader(server), bufio.NewWriter(server)), nil
+}
+
+func TestMiddlewareHijack(t *testing.T) {
+	store := newTestMemoryStore(t)
+	config := testConfig(store)
+
+	w := &hijackRecorder{ResponseRecorder: httptest.NewRecorder()}
+	err := serve(t, config, w, httptest.NewRequest("GET", "/ws", nil), func(c *goexpress.Context) error {
+		sess, _ := GetSession(c)
+		sess.Set("user", "alice")
+
+		hijacker, ok := c.Response.(http.Hijacker)
+		if !ok {
+			t.Fatal("response does not implement http.Hijacker")
+		}
+		conn, _, err := hijacker.Hijack()
+		if err != nil {
+			return err
+		}
+		defer conn.Close()
+
+		if store.Len() != 1 {
+			t.Errorf("store has %d sessions after Hijack, want 1", store.Len())
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !w.hijacked {
+		t.Error("Hijack was not passed on")
+	}
+
+	// Writers that can't be hijacked report an error
+	err = serve(t, config, httptest.NewRecorder(), httptest.NewRequest("GET", "/ws", nil), func(c *goexpress.Context) error {
+		_, _, err := c.Response.(http.Hijacker).Hijack()
+		return err
+	})
+	if err == nil {
+		t.Error("Hijack on a writer without http.Hijacker returned no error")
+	}
+}
+
+func TestCustomIDGenerator(t *testing.T) {
+	store := newTestMemoryStore(t)
+	config := testConfig(store)
+	config.IDGenerator = func() (string, error) {
+		return "custom-id", nil
+	}
+
+	rec := httptest.NewRecorder()
+	err := serve(t, config, rec, httptest.NewRequest("GET", "/", nil), func(c *goexpress.Context) error {
+		sess, _ := GetSession(c)
+		sess.Set("user", "alice")
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := store.Get("custom-id"); err != nil {
+		t.Errorf("session not stored under the generated ID: %v", err)
+	}
+	cookie := sessionCookie(rec, config.CookieName)
+	if cookie == nil {
+		t.Fatal("no session cookie on the response")
+	}
+	if id, err := verifyValue(cookie.Value, testSecret); err != nil || id != "custom-id" {
+		t.Errorf("cookie carries ID %q (%v), want custom-id", id, err)
+	}
+}
+
+func TestIDGeneratorFailure(t *testing.T) {
+	store := newTestMemoryStore(t)
+	config := testConfig(store)
+	errEntropy := errors.New("entropy source failed")
+	config.IDGenerator = func() (string, error) {
+		return "", errEntropy
+	}
+
+	// No session, and no cookie, is created from a failed read
+	rec := httptest.NewRecorder()
+	err := serve(t, config, rec, httptest.NewRequest("GET", "/", nil), func(c *goexpress.Context) error {
+		t.Error("handler ran without a session")
+		return nil
+	})
+	if err != errEntropy {
+		t.Errorf("middleware err = %v, want the generator's error", err)
+	}
+	if sessionCookie(rec, config.CookieName) != nil || store.Len() != 0 {
+		t.Error("a session was created despite the generator failing")
+	}
+
+	// Rotating an existing session keeps it when no new ID can be made
+	calls := 0
+	config.IDGenerator = func() (string, error) {
+		calls++
+		if calls > 1 {
+			return "", errEntropy
+		}
+		return generateSessionID()
+	}
+	err = serve(t, config, httptest.NewRecorder(), httptest.NewRequest("GET", "/", nil), func(c *goexpress.Context) error {
+		sess, _ := GetSession(c)
+		if err := RegenerateSession(c, config); err != errEntropy {
+			t.Errorf("RegenerateSession err = %v, want the generator's error", err)
+		}
+		if current, _ := GetSession(c); current != sess {
+			t.Error("session was replaced despite the generator failing")
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+// withCookie returns a GET request for path carrying cookie
+func withCookie(path string, cookie *http.Cookie) *http.Request {
+	req := httptest.NewRequest("GET", path, nil)
+	if cookie != nil {
+		req.AddCookie(cookie)
+	}
+	return req
+}
+
+func TestLifecycleHooks(t *testing.T) {
+	store := newTestMemoryStore(t)
+	config := testConfig(store)
+	var created, loaded, destroyed []string
+	config.OnCreate = func(sess *Session) { created = append(created, sess.ID) }
+	config.OnLoad = func(sess *Session) { loaded = append(loaded, sess.ID) }
+	config.OnDestroy = func(id string) { destroyed = append(destroyed, id) }
+
+	// Storing a new session creates it
+	rec := httptest.NewRecorder()
+	var id string
+	err := serve(t, config, rec, httptest.NewRequest("GET", "/", nil), func(c *goexpress.Context) error {
+		sess, _ := GetSession(c)
+		id = sess.ID
+		sess.Set("user", "alice")
+		return c.String("ok")
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(created) != 1 || created[0] != id || len(loaded) != 0 || len(destroyed) != 0 {
+		t.Fatalf("after create: created=%v loaded=%v destroyed=%v", created, loaded, destroyed)
+	}
+	cookie := sessionCookie(rec, config.CookieName)
+
+	// Coming back loads it
+	err = serve(t, config, httptest.NewRecorder(), withCookie("/", cookie), func(c *goexpress.Context) error {
+		return c.String("ok")
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(created) != 1 || len(loaded) != 1 || loaded[0] != id || len(destroyed) != 0 {
+		t.Fatalf("after load: created=%v loaded=%v destroyed=%v", created, loaded, destroyed)
+	}
+
+	// Logging out destroys it
+	err = serve(t, config, httptest.NewRecorder(), withCookie("/logout", cookie), func(c *goexpress.Context) error {
+		return DestroySession(c, config)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(created) != 1 || len(loaded) != 2 || len(destroyed) != 1 || destroyed[0] != id {
+		t.Fatalf("after destroy: created=%v loaded=%v destroyed=%v", created, loaded, destroyed)
+	}
+}
+
+func TestRegenerateSessionCopiesData(t *testing.T) {
+	store := newTestMemoryStore(t)
+	config := testConfig(store)
+
+	err := serve(t, config, httptest.NewRecorder(), httptest.NewRequest("GET", "/", nil), func(c *goexpress.Context) error {
+		old, _ := GetSession(c)
+		old.Set("user", "alice")
+		old.Set("prefs", map[string]interface{}{"theme": "dark"})
+
+		if err := RegenerateSession(c, config); err != nil {
+			return err
+		}
+		sess, _ := GetSession(c)
+		if sess == old || sess.ID == old.ID {
+			t.Fatal("RegenerateSession did not replace the session")
+		}
+
+		sess.Set("user", "bob")
+		sess.Data["prefs"].(map[string]interface{})["theme"] = "light"
+
+		if v, _ := old.GetString("user"); v != "alice" {
+			t.Errorf("old session user = %q, want alice", v)
+		}
+		if theme := old.Data["prefs"].(map[string]interface{})["theme"]; theme != "dark" {
+			t.Errorf("old session theme = %v, want dark", theme)
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+// newStoredSession runs a request that writes to a new session and returns
+// the session's ID and cookie
+func newStoredSession(t testing.TB, config Config) (string, *http.Cookie) {
+	t.Helper()
+	rec := httptest.NewRecorder()
+	var id string
+	err := serve(t, config, rec, httptest.NewRequest("GET", "/", nil), func(c *goexpress.Context) error {
+		sess, _ := GetSession(c)
+		id = sess.ID
+		sess.Set("visits", 1)
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	cookie := sessionCookie(rec, config.CookieName)
+	if cookie == nil {
+		t.Fatal("no session cookie on the response")
+	}
+	return id, cookie
+}
+
+func TestLoginRotatesID(t *testing.T) {
+	store := newTestMemoryStore(t)
+	config := testConfig(store)
+	oldID, cookie := newStoredSession(t, config)
+
+	rec := httptest.NewRecorder()
+	var newID string
+	err := serve(t, config, rec, withCookie("/login", cookie), func(c *goexpress.Context) error {
+		if err := Login(c, config, map[string]interface{}{"user_id": "42"}); err != nil {
+			return err
+		}
+		sess, _ := GetSession(c)
+		newID = sess.ID
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	newCookie := sessionCookie(rec, config.CookieName)
+	if newCookie == nil || newCookie.Value == cookie.Value {
+		t.Fatalf("cookie = %v, want a new value after Login", newCookie)
+	}
+	if newID == oldID {
+		t.Error("session ID unchanged after Login")
+	}
+	if _, err := store.Get(oldID); err != ErrSessionNotFound {
+		t.Errorf("pre-login session still stored: %v", err)
+	}
+	sess, err := store.Get(newID)
+	if err != nil {
+		t.Fatalf("Get: %v", err)
+	}
+	if v, _ := sess.GetString("user_id"); v != "42" {
+		t.Errorf("user_id = %q, want 42", v)
+	}
+	if v, _ := sess.GetInt("visits"); v != 1 {
+		t.Errorf("visits = %d, data from before Login was lost", v)
+	}
+}
+
+func TestRegenerateOnChange(t *testing.T) {
+	store := newTestMemoryStore(t)
+	config := testConfig(store)
+	config.RegenerateOnChange = true
+	oldID, cookie := newStoredSession(t, config)
+
+	// Reading leaves the ID alone
+	rec := httptest.NewRecorder()
+	err := serve(t, config, rec, withCookie("/", cookie), func(c *goexpress.Context) error {
+		sess, _ := GetSession(c)
+		if sess.ID != oldID {
+			t.Errorf("loaded session %q, want %q", sess.ID, oldID)
+		}
+		return c.String("ok")
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c := sessionCookie(rec, config.CookieName); c != nil && c.Value != cookie.Value {
+		t.Error("cookie changed on a read-only request")
+	}
+
+	// Writing moves the session to a new ID
+	rec = httptest.NewRecorder()
+	err = serve(t, config, rec, withCookie("/", cookie), func(c *goexpress.Context) error {
+		sess, _ := GetSession(c)
+		sess.Set("role", "admin")
+		return c.String("ok")
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	newCookie := sessionCookie(rec, config.CookieName)
+	if newCookie == nil || newCookie.Value == cookie.Value {
+		t.Fatalf("cookie = %v, want a new value after a change", newCookie)
+	}
+	if _, err := store.Get(oldID); err != ErrSessionNotFound {
+		t.Errorf("old session still stored: %v", err)
+	}
+	newID, err := verifyValue(newCookie.Value, testSecret)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sess, err := store.Get(newID)
+	if err != nil {
+		t.Fatalf("Get: %v", err)
+	}
+	if v, _ := sess.GetString("role"); v != "admin" {
+		t.Errorf("role = %q, want admin", v)
+	}
+}
+
+func TestValidateCookie(t *testing.T) {
+	tests := []struct {
+		name   string
+		modify func(*Config)
+		valid  bool
+	}{
+		{"defaults", func(*Config) {}, true},
+		{"SameSite=None without Secure", func(c *Config) { c.SameSite = http.SameSiteNoneMode }, false},
+		{"SameSite=None with Secure", func(c *Config) { c.SameSite = http.SameSiteNoneMode; c.Secure = true }, true},
+		{"Partitioned with Lax", func(c *Config) { c.Partitioned = true; c.Secure = true }, false},
+		{"__Host- without Secure", func(c *Config) { c.CookieName = "__Host-sid" }, false},
+		{"__Host- with Domain", func(c *Config) { c.CookieName = "__Host-sid"; c.Secure = true; c.CookieDomain = "example.com" }, false},
+		{"__Secure- with Secure", func(c *Config) { c.CookieName = "__Secure-sid"; c.Secure = true }, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			config := testConfig(newTestMemoryStore(t))
+			tt.modify(&config)
+			if err := validateCookie(config); (err == nil) != tt.valid {
+				t.Errorf("validateCookie = %v, want valid %v", err, tt.valid)
+			}
+		})
+	}
+}
+
+func TestMiddlewarePanicsOnInsecureSameSiteNone(t *testing.T) {
+	config := testConfig(newTestMemoryStore(t))
+	config.SameSite = http.SameSiteNoneMode
+
+	defer func() {
+		if recover() == nil {
+			t.Error("Middleware accepted SameSite=None without Secure")
+		}
+	}()
+	Middleware(config)
+}
+
+func TestRollingID(t *testing.T) {
+	store := newTestMemoryStore(t)
+	config := testConfig(store)
+	config.RollingID = true
+	id, cookie := newStoredSession(t, config)
+
+	seen := map[string]bool{id: true}
+	for i := 2; i <= 4; i++ {
+		rec := httptest.NewRecorder()
+		err := serve(t, config, rec, withCookie("/", cookie), func(c *goexpress.Context) error {
+			sess, _ := GetSession(c)
+			visits, _ := sess.GetInt("visits")
+			if visits != i-1 {
+				t.Errorf("request %d: visits = %d, want %d", i, visits, i-1)
+			}
+			sess.Set("visits", visits+1)
+			return c.String("ok")
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		cookie = sessionCookie(rec, config.CookieName)
+		if cookie == nil {
+			t.Fatalf("request %d: no session cookie", i)
+		}
+		newID, err := verifyValue(cookie.Value, testSecret)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if seen[newID] {
+			t.Errorf("request %d: session ID %q reused", i, newID)
+		}
+		seen[newID] = true
+		if _, err := store.Get(id); err != ErrSessionNotFound {
+			t.Errorf("request %d: previous ID still stored: %v", i, err)
+		}
+		id = newID
+	}
+
+	if store.Len() != 1 {
+		t.Errorf("store has %d sessions, want 1", store.Len())
+	}
+}
+
+// serveScopes runs handler behind the user middleware wrapping the admin one
+func serveScopes(t *testing.T, user, admin Config, w http.ResponseWriter, r *http.Request, handler goexpress.HandlerFunc) error {
+	t.Helper()
+	return Middleware(user)(Middleware(admin)(handler))(goexpress.NewContext(w, r))
+}
+
+func TestMultipleScopes(t *testing.T) {
+	store := newTestMemoryStore(t)
+	user := testConfig(store)
+	admin := testConfig(store)
+	admin.CookieName = "admin_id"
+	admin.ContextKey = "admin_session"
+
+	rec := httptest.NewRecorder()
+	err := serveScopes(t, user, admin, rec, httptest.NewRequest("GET", "/", nil), func(c *goexpress.Context) error {
+		userSess, err := GetSessionByKey(c, "session")
+		if err != nil {
+			return err
+		}
+		adminSess, err := GetSessionByKey(c, "admin_session")
+		if err != nil {
+			return err
+		}
+		if userSess == adminSess {
+			t.Fatal("both scopes got the same session")
+		}
+		userSess.Set("name", "alice")
+		adminSess.Set("name", "root")
+
+		// Helpers without a key use the innermost scope
+		if sess, _ := GetSession(c); sess != adminSess {
+			t.Error("GetSession did not return the innermost scope's session")
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	userCookie := sessionCookie(rec, user.CookieName)
+	adminCookie := sessionCookie(rec, admin.CookieName)
+	if userCookie == nil || adminCookie == nil {
+		t.Fatalf("cookies = %v, %v; want one per scope", userCookie, adminCookie)
+	}
+
+	// Each scope reloads its own session, and destroying one keeps the other
+	req := withCookie("/", userCookie)
+	req.AddCookie(adminCookie)
+	rec = httptest.NewRecorder()
+	err = serveScopes(t, user, admin, rec, req, func(c *goexpress.Context) error {
+		userSess, _ := GetSessionByKey(c, "session")
+		adminSess, _ := GetSessionByKey(c, "admin_session")
+		if v, _ := userSess.GetString("name"); v != "alice" {
+			t.Errorf("user scope name = %q, want alice", v)
+		}
+		if v, _ := adminSess.GetString("name"); v != "root" {
+			t.Errorf("admin scope name = %q, want root", v)
+		}
+		return DestroySession(c, admin)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if c := sessionCookie(rec, admin.CookieName); c == nil || c.MaxAge >= 0 {
+		t.Errorf("admin cookie = %v, want it cleared", c)
+	}
+	if c := sessionCookie(rec, user.CookieName); c != nil && c.MaxAge < 0 {
+		t.Error("user cookie cleared along with the admin scope")
+	}
+	if store.Len() != 1 {
+		t.Errorf("store has %d sessions, want only the user's", store.Len())
+	}
+}
+
+func TestSetPersistent(t *testing.T) {
+	for _, tt := range []struct {
+		name       string
+		persistent bool
+		maxAge     int           // Cookie Max-Age, 0 for a session cookie
+		ttl        time.Duration // Store lifetime
+	}{
+		{"remember", true, int((30 * 24 * time.Hour).Seconds()), 30 * 24 * time.Hour},
+		{"forget", false, 0, 24 * time.Hour},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			store := newTestMemoryStore(t)
+			config := testConfig(store)
+
+			var id string
+			handler := func(c *goexpress.Context) error {
+				sess, _ := GetSession(c)
+				id = sess.ID
+				return SetPersistent(c, config, tt.persistent)
+			}
+			rec := httptest.NewRecorder()
+			if err := serve(t, config, rec, httptest.NewRequest("POST", "/login", nil), handler); err != nil {
+				t.Fatal(err)
+			}
+
+			cookie := sessionCookie(rec, config.CookieName)
+			if cookie == nil {
+				t.Fatal("no session cookie on the response")
+			}
+			if cookie.MaxAge != tt.maxAge || !cookie.Expires.IsZero() {
+				t.Errorf("cookie Max-Age = %d, Expires = %v; want Max-Age %d and no Expires",
+					cookie.MaxAge, cookie.Expires, tt.maxAge)
+			}
+			if header := rec.Header().Get("Set-Cookie"); !tt.persistent && strings.Contains(header, "Max-Age") {
+				t.Errorf("Set-Cookie = %q, want a session cookie", header)
+			}
+
+			sess, err := store.Get(id)
+			if err != nil {
+				t.Fatalf("Get: %v", err)
+			}
+			if ttl := time.Until(sess.ExpiresAt); ttl < tt.ttl-time.Minute || ttl > tt.ttl {
+				t.Errorf("store TTL = %v, want %v", ttl, tt.ttl)
+			}
+
+			// The choice sticks on later requests
+			rec = httptest.NewRecorder()
+			err = serve(t, config, rec, withCookie("/", cookie), func(c *goexpress.Context) error {
+				return c.String("ok")
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if c := sessionCookie(rec, config.CookieName); c != nil && c.MaxAge != tt.maxAge {
+				t.Errorf("later cookie Max-Age = %d, want %d", c.MaxAge, tt.maxAge)
+			}
+			if sess, _ := store.Get(id); time.Until(sess.ExpiresAt) < tt.ttl-time.Minute {
+				t.Errorf("later store TTL = %v, want %v", time.Until(sess.ExpiresAt), tt.ttl)
+			}
+		})
+	}
+}
+
+func TestScopedCookiePaths(t *testing.T) {
+	store := newTestMemoryStore(t)
+	web := testConfig(store)
+	api := testConfig(store)
+	api.CookieName = "api_session"
+	api.CookiePath = "/api"
+	api.ContextKey = "api_session"
+
+	// A request under /api passes through both scopes
+	rec := httptest.NewRecorder()
+	var webID, apiID string
+	err := serveScopes(t, web, api, rec, httptest.NewRequest("POST", "/api/items", nil), func(c *goexpress.Context) error {
+		webSess, _ := GetSessionByKey(c, "session")
+		apiSess, _ := GetSessionByKey(c, "api_session")
+		webID, apiID = webSess.ID, apiSess.ID
+		webSess.Set("user", "alice")
+		apiSess.Set("token", "t1")
+
+		// Saving one scope early leaves the other for the response
+		if err := SaveByKey(c, "session"); err != nil {
+			return err
+		}
+		if _, err := store.Get(webID); err != nil {
+			t.Errorf("web session not saved by SaveByKey: %v", err)
+		}
+		if _, err := store.Get(apiID); err != ErrSessionNotFound {
+			t.Errorf("api session saved by the other scope's SaveByKey: %v", err)
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	webCookie := sessionCookie(rec, web.CookieName)
+	apiCookie := sessionCookie(rec, api.CookieName)
+	if webCookie == nil || apiCookie == nil {
+		t.Fatalf("cookies = %v, %v; want one per scope", webCookie, apiCookie)
+	}
+	if webCookie.Path != "/" || apiCookie.Path != "/api" {
+		t.Errorf("cookie paths = %q, %q; want / and /api", webCookie.Path, apiCookie.Path)
+	}
+	if webID == apiID {
+		t.Error("scopes share a session ID")
+	}
+
+	for id, key := range map[string]string{webID: "user", apiID: "token"} {
+		sess, err := store.Get(id)
+		if err != nil {
+			t.Fatalf("Get: %v", err)
+		}
+		if _, ok := sess.Get(key); !ok || len(sess.Data) != 1 {
+			t.Errorf("session %s data = %v, want only %q", id, sess.Data, key)
+		}
+	}
+}
+
+// failingStore is a Store whose Get fails with err
+type failingStore struct {
+	Store
+	err error
+}
+
+func (s *failingStore) Get(id string) (*Session, error) {
+	return nil, s.err
+}
+
+func TestLoadErrors(t *testing.T) {
+	errBackend := errors.New("connection refused")
+	memory := newTestMemoryStore(t)
+	if err := memory.Set(NewSessionWithID("expired", time.Hour)); err != nil {
+		t.Fatal(err)
+	}
+	if err := memory.Touch("expired", -time.Minute); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name     string
+		store    Store
+		id       string
+		failOpen bool
+		wantErr  error
+	}{
+		{"missing", memory, "missing", false, nil},
+		{"expired", memory, "expired", false, nil},
+		{"backend error", &failingStore{Store: memory, err: errBackend}, "any", false, errBackend},
+		{"backend error fail open", &failingStore{Store: memory, err: errBackend}, "any", true, nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			config := testConfig(tt.store)
+			config.FailOpen = tt.failOpen
+
+			req := withCookie("/", &http.Cookie{Name: config.CookieName, Value: signValue(tt.id, testSecret)})
+			ran := false
+			err := serve(t, config, httptest.NewRecorder(), req, func(c *goexpress.Context) error {
+				ran = true
+				sess, _ := GetSession(c)
+				if !sess.IsNew() || sess.ID == tt.id {
+					t.Errorf("got session %q, want a fresh one", sess.ID)
+				}
+				return nil
+			})
+			if err != tt.wantErr {
+				t.Errorf("middleware err = %v, want %v", err, tt.wantErr)
+			}
+			if ran != (tt.wantErr == nil) {
+				t.Errorf("handler ran = %v, want %v", ran, tt.wantErr == nil)
+			}
+		})
+	}
+}
+
+func TestRefresh(t *testing.T) {
+	store, server := newTestRedisStore(t, RedisConfig{})
+	config := testConfig(store)
+	config.MaxAge = time.Hour
+	config.TouchInterval = 45 * time.Minute
+	id, cookie := newStoredSession(t, config)
+
+	server.FastForward(30 * time.Minute)
+	handler := func(refresh bool) goexpress.HandlerFunc {
+		return func(c *goexpress.Context) error {
+			if refresh {
+				if err := Refresh(c, config); err != nil {
+					return err
+				}
+			}
+			return c.String("ok")
+		}
+	}
+
+	// Within TouchInterval a plain request leaves the expiration alone
+	rec := httptest.NewRecorder()
+	if err := serve(t, config, rec, withCookie("/", cookie), handler(false)); err != nil {
+		t.Fatal(err)
+	}
+	if ttl := server.TTL("session:" + id); ttl > 30*time.Minute {
+		t.Fatalf("TTL = %v, want it left at 30m", ttl)
+	}
+
+	// Refresh extends it regardless, in the store and the cookie
+	rec = httptest.NewRecorder()
+	if err := serve(t, config, rec, withCookie("/heartbeat", cookie), handler(true)); err != nil {
+		t.Fatal(err)
+	}
+	if ttl := server.TTL("session:" + id); ttl != time.Hour {
+		t.Errorf("TTL after Refresh = %v, want 1h", ttl)
+	}
+	refreshed := sessionCookie(rec, config.CookieName)
+	if refreshed == nil || refreshed.MaxAge != 3600 {
+		t.Errorf("cookie after Refresh = %v, want Max-Age 3600", refreshed)
+	}
+}
+
+// benchmarkRequests serves b.N requests for an existing session behind the
+// middleware for config, whose store is store, and reports the Redis
+// commands sent per request
+func benchmarkRequests(b *testing.B, store *RedisStore, config Config, handler goexpress.HandlerFunc) {
+	_, cookie := newStoredSession(b, config)
+	counter := countCommands(store)
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if err := serve(b, config, httptest.NewRecorder(), withCookie("/", cookie), handler); err != nil {
+			b.Fatal(err)
+		}
+	}
+	b.StopTimer()
+	counter.report(b, "set", "pexpire")
+}
+
+// BenchmarkMiddlewareReadOnly compares the Redis writes of read-only
+// requests, which only refresh the expiration, with modifying ones
+func BenchmarkMiddlewareReadOnly(b *testing.B) {
+	read := func(c *goexpress.Context) error {
+		sess, _ := GetSession(c)
+		visits, _ := sess.GetInt("visits")
+		return c.String(strconv.Itoa(visits))
+	}
+	write := func(c *goexpress.Context) error {
+		sess, _ := GetSession(c)
+		visits, _ := sess.GetInt("visits")
+		sess.Set("visits", visits+1)
+		return c.String(strconv.Itoa(visits))
+	}
+
+	b.Run("read", func(b *testing.B) {
+		store, _ := newTestRedisStore(b, RedisConfig{})
+		benchmarkRequests(b, store, testConfig(store), read)
+	})
+	b.Run("read-TouchInterval", func(b *testing.B) {
+		store, _ := newTestRedisStore(b, RedisConfig{})
+		config := testConfig(store)
+		config.TouchInterval = time.Hour
+		benchmarkRequests(b, store, config, read)
+	})
+	b.Run("write", func(b *testing.B) {
+		store, _ := newTestRedisStore(b, RedisConfig{})
+		benchmarkRequests(b, store, testConfig(store), write)
+	})
+}
+
+// BenchmarkMiddlewareTouchOnLoad compares the Redis round-trips of read-only
+// requests that load and then touch the session with TouchOnLoad, which
+// does both in one
+func BenchmarkMiddlewareTouchOnLoad(b *testing.B) {
+	read := func(c *goexpress.Context) error {
+		return c.String("ok")
+	}
+
+	for _, bm := range []struct {
+		name        string
+		touchOnLoad bool
+	}{
+		{"load-then-touch", false},
+		{"TouchOnLoad", true},
+	} {
+		b.Run(bm.name, func(b *testing.B) {
+			store, _ := newTestRedisStore(b, RedisConfig{})
+			config := testConfig(store)
+			config.TouchOnLoad = bm.touchOnLoad
+			benchmarkRequests(b, store, config, read)
+		})
+	}
+}
+
+// ctxKey marks the request context in TestRequestContextReachesStore
+type ctxKey struct{}
+
+// ctxRecordingStore records the context of every DeleteCtx and TouchCtx call
+type ctxRecordingStore struct {
+	Store
+	deletes, touches []context.Context
+}
+
+func (s *ctxRecordingStore) DeleteCtx(ctx context.Context, id string) error {
+	s.deletes = append(s.deletes, ctx)
+	return s.Store.Delete(id)
+}
+
+func (s *ctxRecordingStore) TouchCtx(ctx context.Context, id string, ttl time.Duration) error {
+	s.touches = append(s.touches, ctx)
+	return s.Store.Touch(id, ttl)
+}
+
+func TestRequestContextReachesStore(t *testing.T) {
+	store := &ctxRecordingStore{Store: newTestMemoryStore(t)}
+	config := testConfig(store)
+	_, cookie := newStoredSession(t, config)
+
+	request := func(handler goexpress.HandlerFunc) {
+		t.Helper()
+		req := withCookie("/", cookie)
+		req = req.WithContext(context.WithValue(req.Context(), ctxKey{}, "request"))
+		if err := serve(t, config, httptest.NewRecorder(), req, handler); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// An unmodified session is only touched
+	request(func(c *goexpress.Context) error { return nil })
+	// Regenerating deletes the old session
+	request(func(c *goexpress.Context) error { return RegenerateSession(c, config) })
+
+	if len(store.touches) == 0 || len(store.deletes) == 0 {
+		t.Fatalf("TouchCtx called %d times, DeleteCtx %d times, want both", len(store.touches), len(store.deletes))
+	}
+	for _, ctx := range append(store.touches, store.deletes...) {
+		if ctx.Value(ctxKey{}) != "request" {
+			t.Errorf("store called without the request context")
+		}
+	}
+}
@@ -1,70 +1,295 @@
 package session
 
 import (
+	"bytes"
 	"context"
+	"encoding/gob"
 	"encoding/json"
+	"fmt"
+	"strings"
+	"sync"
 	"time"
 
+	"github.com/abreed05/goexpress-redis/internal/redishook"
 	"github.com/redis/go-redis/v9"
+	"go.opentelemetry.io/otel/trace"
 )
 
+// pingTimeout bounds health check pings
+const pingTimeout = 2 * time.Second
+
 // RedisStore implements a Redis-based session store
 type RedisStore struct {
-	client *redis.Client
-	prefix string
-	ctx    context.Context
+	client       *redis.Client
+	ownsClient   bool
+	closer       *clientCloser
+	prefix       string
+	userPrefix   string
+	ctx          context.Context
+	tracer       trace.Tracer
+	touchRewrite bool
+	hashFields   bool
+	maxDataSize  int
+	encoding     string
 }
 
 // RedisConfig holds Redis connection configuration
 type RedisConfig struct {
 	Addr     string // Redis server address (e.g., "localhost:6379")
+	Username string // ACL username (Redis 6+), empty for the default user
 	Password string // Password for authentication
 	DB       int    // Database number
 	Prefix   string // Key prefix for sessions (e.g., "session:")
+
+	// Databases is how many databases the server has, its "databases"
+	// setting (default 16). NewRedisStore rejects a DB outside that range.
+	Databases int
+
+	// ConnectRetries is how many times NewRedisStore retries the initial ping,
+	// waiting ConnectBackoff (default 500ms) before the first retry and
+	// doubling the wait each time
+	ConnectRetries int
+	ConnectBackoff time.Duration
+
+	// OpTimeout bounds every Redis command made by NewRedisStore's client, so a
+	// network partition returns an error instead of hanging (0 = no timeout).
+	// Shared clients passed to a WithClient constructor are left as they are.
+	OpTimeout time.Duration
+
+	// TracerProvider enables OpenTelemetry spans around Get and Set when set
+	TracerProvider trace.TracerProvider
+
+	// UserPrefix is the key prefix for per-user session indexes (default "user_sessions:")
+	UserPrefix string
+
+	// TouchRewrite makes Touch rewrite the stored session to bump UpdatedAt.
+	// By default Touch only extends the key's TTL without transferring the value.
+	TouchRewrite bool
+
+	// HashFields stores each session as a Redis hash with one field per data
+	// key, so saving a session only writes the keys that changed.
+	// Sessions stored by one mode can't be read by the other.
+	HashFields bool
+
+	// MaxDataSize rejects writes larger than this many bytes with
+	// ErrSessionTooLarge (0 = unlimited). In HashFields mode it applies to
+	// the fields written by each save.
+	MaxDataSize int
+
+	// Encoding is how sessions are written, EncodingJSON (default) or
+	// EncodingGob. Stored values record their encoding, so sessions written
+	// before a change stay readable. HashFields mode always uses JSON.
+	Encoding string
 }
 
 // NewRedisStore creates a new Redis session store
 func NewRedisStore(config RedisConfig) (*RedisStore, error) {
+	if err := validateDB(config.DB, config.Databases); err != nil {
+		return nil, err
+	}
+
 	client := redis.NewClient(&redis.Options{
 		Addr:     config.Addr,
+		Username: config.Username,
 		Password: config.Password,
 		DB:       config.DB,
+
+		// Honour context deadlines, including OpTimeout
+		ContextTimeoutEnabled: true,
 	})
+	if config.OpTimeout > 0 {
+		client.AddHook(redishook.Timeout(config.OpTimeout))
+	}
 
 	ctx := context.Background()
 
-	// Test connection
-	if err := client.Ping(ctx).Err(); err != nil {
+	// Test connection, waiting for Redis to come up if configured
+	if err := pingWithRetry(ctx, client, config.ConnectRetries, config.ConnectBackoff); err != nil {
+		client.Close()
 		return nil, err
 	}
 
+	store := NewRedisStoreWithClient(client, config)
+	store.ownsClient = true
+	store.closer = &clientCloser{}
+	client.AddHook(closedHook{store.closer})
+	return store, nil
+}
+
+// validateDB checks db against the server's number of databases (default 16),
+// so a typo fails upfront instead of with an error on the first command
+func validateDB(db, databases int) error {
+	if databases <= 0 {
+		databases = 16
+	}
+	if db < 0 || db >= databases {
+		return fmt.Errorf("redis DB %d out of range, must be between 0 and %d", db, databases-1)
+	}
+	return nil
+}
+
+// pingWithRetry pings Redis, retrying up to retries times with an
+// exponential backoff starting at backoff. It returns the last error.
+func pingWithRetry(ctx context.Context, client *redis.Client, retries int, backoff time.Duration) error {
+	if backoff <= 0 {
+		backoff = 500 * time.Millisecond
+	}
+
+	err := client.Ping(ctx).Err()
+	for attempt := 0; err != nil && attempt < retries; attempt++ {
+		time.Sleep(backoff)
+		backoff *= 2
+		err = client.Ping(ctx).Err()
+	}
+	return err
+}
+
+// clientCloser closes an owned client once and remembers that it did
+type clientCloser struct {
+	mu     sync.Mutex
+	closed bool
+}
+
+// close closes client on the first call and returns nil on later ones
+func (c *clientCloser) close(client *redis.Client) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.closed {
+		return nil
+	}
+	c.closed = true
+	return client.Close()
+}
+
+// isClosed reports whether close has been called
+func (c *clientCloser) isClosed() bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.closed
+}
+
+// closedHook fails commands with ErrClosed once the owned client is closed
+type closedHook struct {
+	closer *clientCloser
+}
+
+// DialHook leaves dialing unchanged
+func (h closedHook) DialHook(next redis.DialHook) redis.DialHook {
+	return next
+}
+
+// ProcessHook rejects a single command after Close
+func (h closedHook) ProcessHook(next redis.ProcessHook) redis.ProcessHook {
+	return func(ctx context.Context, cmd redis.Cmder) error {
+		if h.closer.isClosed() {
+			cmd.SetErr(ErrClosed)
+			return ErrClosed
+		}
+		return next(ctx, cmd)
+	}
+}
+
+// ProcessPipelineHook rejects a whole pipeline or transaction after Close
+func (h closedHook) ProcessPipelineHook(next redis.ProcessPipelineHook) redis.ProcessPipelineHook {
+	return func(ctx context.Context, cmds []redis.Cmder) error {
+		if h.closer.isClosed() {
+			for _, cmd := range cmds {
+				cmd.SetErr(ErrClosed)
+			}
+			return ErrClosed
+		}
+		return next(ctx, cmds)
+	}
+}
+
+// NewRedisStoreWithClient creates a Redis session store on top of an existing client.
+// The connection fields of config are ignored, no Ping is made, and Close
+// leaves the shared client open.
+func NewRedisStoreWithClient(client *redis.Client, config RedisConfig) *RedisStore {
 	prefix := config.Prefix
 	if prefix == "" {
 		prefix = "session:"
 	}
 
+	userPrefix := config.UserPrefix
+	if userPrefix == "" {
+		userPrefix = "user_sessions:"
+	}
+
+	switch config.Encoding {
+	case "":
+		config.Encoding = EncodingJSON
+	case EncodingJSON, EncodingGob:
+	default:
+		panic("unknown redis store encoding " + config.Encoding)
+	}
+
+	var tracer trace.Tracer
+	if config.TracerProvider != nil {
+		tracer = config.TracerProvider.Tracer(tracerName)
+	}
+
 	return &RedisStore{
-		client: client,
-		prefix: prefix,
-		ctx:    ctx,
-	}, nil
+		client:       client,
+		prefix:       prefix,
+		userPrefix:   userPrefix,
+		ctx:          context.Background(),
+		tracer:       tracer,
+		touchRewrite: config.TouchRewrite,
+		hashFields:   config.HashFields,
+		maxDataSize:  config.MaxDataSize,
+		encoding:     config.Encoding,
+	}
 }
 
 // Get retrieves a session from Redis
 func (r *RedisStore) Get(id string) (*Session, error) {
+	return r.GetCtx(r.ctx, id)
+}
+
+// GetCtx retrieves a session from Redis using ctx
+func (r *RedisStore) GetCtx(ctx context.Context, id string) (*Session, error) {
+	return r.get(ctx, id, 0)
+}
+
+// GetAndTouch retrieves a session and extends its expiration by ttl
+func (r *RedisStore) GetAndTouch(id string, ttl time.Duration) (*Session, error) {
+	return r.GetAndTouchCtx(r.ctx, id, ttl)
+}
+
+// GetAndTouchCtx retrieves a session and extends its expiration by ttl in a
+// single round-trip, using ctx. The stored UpdatedAt is left unchanged.
+func (r *RedisStore) GetAndTouchCtx(ctx context.Context, id string, ttl time.Duration) (*Session, error) {
+	return r.get(ctx, id, ttl)
+}
+
+// get retrieves a session, extending its TTL in the same round-trip when touch > 0
+func (r *RedisStore) get(ctx context.Context, id string, touch time.Duration) (_ *Session, err error) {
+	ctx, span := r.startSpan(ctx, "session.Get", id)
+	defer func() { endSpan(span, err) }()
+
 	key := r.prefix + id
 
-	data, err := r.client.Get(r.ctx, key).Bytes()
-	if err == redis.Nil {
-		return nil, ErrSessionNotFound
+	var (
+		session *Session
+		ttl     time.Duration
+	)
+	if r.hashFields {
+		session, ttl, err = r.getHash(ctx, id, key, touch)
+	} else {
+		session, ttl, err = r.getValue(ctx, key, touch)
 	}
 	if err != nil {
 		return nil, err
 	}
 
-	var session Session
-	if err := json.Unmarshal(data, &session); err != nil {
-		return nil, err
+	// The key TTL is authoritative since Touch only extends it. A key without
+	// expiry (SetWithTTL with 0) is kept whatever its stored ExpiresAt says.
+	switch {
+	case ttl > 0:
+		session.ExpiresAt = time.Now().Add(ttl)
+	case ttl == NoExpiry:
+		return session, nil
 	}
 
 	if session.IsExpired() {
@@ -72,17 +297,96 @@ func (r *RedisStore) Get(id string) (*Session, error) {
 		return nil, ErrSessionExpired
 	}
 
+	return session, nil
+}
+
+// getValue fetches a session stored as a string value along with its TTL in one round-trip
+func (r *RedisStore) getValue(ctx context.Context, key string, touch time.Duration) (*Session, time.Duration, error) {
+	pipe := r.client.Pipeline()
+	getCmd := pipe.Get(ctx, key)
+	ttl := pipeTTL(ctx, pipe, key, touch)
+	if _, err := pipe.Exec(ctx); err != nil && err != redis.Nil {
+		// A session stored in HashFields mode is treated as missing
+		if redis.HasErrorPrefix(err, "WRONGTYPE") {
+			return nil, 0, ErrSessionNotFound
+		}
+		return nil, 0, err
+	}
+
+	data, err := getCmd.Bytes()
+	if err == redis.Nil {
+		return nil, 0, ErrSessionNotFound
+	}
+	if err != nil {
+		return nil, 0, err
+	}
+
+	session, err := decodeSession(data)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	return session, ttl(), nil
+}
+
+// gobMarker starts values written with EncodingGob. JSON values start with
+// '{', so values written before Encoding existed are still read as JSON.
+const gobMarker byte = 0x01
+
+// encodeSession encodes a session for storage as a string value
+func encodeSession(session *Session, encoding string) ([]byte, error) {
+	if encoding != EncodingGob {
+		return json.Marshal(session)
+	}
+
+	buf := bytes.NewBuffer([]byte{gobMarker})
+	if err := gob.NewEncoder(buf).Encode(session); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// decodeSession decodes a stored session in whichever encoding it was written
+func decodeSession(data []byte) (*Session, error) {
+	var session Session
+	if len(data) > 0 && data[0] == gobMarker {
+		if err := gob.NewDecoder(bytes.NewReader(data[1:])).Decode(&session); err != nil {
+			return nil, err
+		}
+	} else if err := json.Unmarshal(data, &session); err != nil {
+		return nil, err
+	}
+
+	if session.Data == nil {
+		session.Data = make(map[string]interface{})
+	}
 	return &session, nil
 }
 
+// pipeTTL queues a PTTL for key, or a PEXPIRE when touch > 0, and returns a
+// function reporting the key's TTL once the pipeline has run
+func pipeTTL(ctx context.Context, pipe redis.Pipeliner, key string, touch time.Duration) func() time.Duration {
+	if touch > 0 {
+		expireCmd := pipe.PExpire(ctx, key, touch)
+		return func() time.Duration {
+			if expireCmd.Val() {
+				return touch
+			}
+			return 0
+		}
+	}
+	return pipe.PTTL(ctx, key).Val
+}
+
 // Set stores a session in Redis
 func (r *RedisStore) Set(session *Session) error {
-	key := r.prefix + session.ID
+	return r.SetCtx(r.ctx, session)
+}
 
-	data, err := json.Marshal(session)
-	if err != nil {
-		return err
-	}
+// SetCtx stores a session in Redis using ctx
+func (r *RedisStore) SetCtx(ctx context.Context, session *Session) (err error) {
+	ctx, span := r.startSpan(ctx, "session.Set", session.ID)
+	defer func() { endSpan(span, err) }()
 
 	// Calculate TTL
 	ttl := time.Until(session.ExpiresAt)
@@ -90,24 +394,67 @@ func (r *RedisStore) Set(session *Session) error {
 		return ErrSessionExpired
 	}
 
-	return r.client.Set(r.ctx, key, data, ttl).Err()
+	return r.write(ctx, session, ttl)
+}
+
+// write stores a session with the given TTL in the configured format
+func (r *RedisStore) write(ctx context.Context, session *Session, ttl time.Duration) error {
+	if r.hashFields {
+		return r.setHash(ctx, session, ttl)
+	}
+
+	data, err := encodeSession(session, r.encoding)
+	if err != nil {
+		return err
+	}
+
+	if err := checkDataSize(len(data), r.maxDataSize); err != nil {
+		return err
+	}
+
+	return r.client.Set(ctx, r.prefix+session.ID, data, ttl).Err()
 }
 
 // Delete removes a session from Redis
 func (r *RedisStore) Delete(id string) error {
+	return r.DeleteCtx(r.ctx, id)
+}
+
+// DeleteCtx removes a session from Redis using ctx
+func (r *RedisStore) DeleteCtx(ctx context.Context, id string) error {
 	key := r.prefix + id
-	return r.client.Del(r.ctx, key).Err()
+	return r.client.Del(ctx, key).Err()
+}
+
+// Touch extends the session's expiration time
+func (r *RedisStore) Touch(id string, ttl time.Duration) error {
+	return r.TouchCtx(r.ctx, id, ttl)
 }
 
-// Touch updates the session's expiration time
-func (r *RedisStore) Touch(id string) error {
-	session, err := r.Get(id)
+// TouchCtx extends the session's expiration time using ctx
+func (r *RedisStore) TouchCtx(ctx context.Context, id string, ttl time.Duration) error {
+	if r.touchRewrite {
+		session, err := r.GetCtx(ctx, id)
+		if err != nil {
+			return err
+		}
+
+		now := time.Now()
+		session.UpdatedAt = now
+		session.ExpiresAt = now.Add(ttl)
+		return r.SetCtx(ctx, session)
+	}
+
+	key := r.prefix + id
+	ok, err := r.client.PExpire(ctx, key, ttl).Result()
 	if err != nil {
 		return err
 	}
+	if !ok {
+		return ErrSessionNotFound
+	}
 
-	session.UpdatedAt = time.Now()
-	return r.Set(session)
+	return nil
 }
 
 // Cleanup is a no-op for Redis (it handles expiration automatically)
@@ -115,9 +462,26 @@ func (r *RedisStore) Cleanup() error {
 	return nil
 }
 
-// Close closes the Redis connection
+// Close closes the Redis connection. It may be called more than once;
+// commands made afterwards fail with ErrClosed. Clients passed to
+// NewRedisStoreWithClient are left open.
 func (r *RedisStore) Close() error {
-	return r.client.Close()
+	if !r.ownsClient {
+		return nil
+	}
+	return r.closer.close(r.client)
+}
+
+// Ping checks that Redis is reachable, giving up after pingTimeout
+func (r *RedisStore) Ping(ctx context.Context) error {
+	ctx, cancel := context.WithTimeout(ctx, pingTimeout)
+	defer cancel()
+	return r.client.Ping(ctx).Err()
+}
+
+// Stats returns connection pool statistics
+func (r *RedisStore) Stats() *redis.PoolStats {
+	return r.client.PoolStats()
 }
 
 // GetClient returns the underlying Redis client for advanced operations
@@ -125,16 +489,109 @@ func (r *RedisStore) GetClient() *redis.Client {
 	return r.client
 }
 
-// SetWithTTL stores a session with a custom TTL
+// SetWithTTL stores a session with a custom TTL, moving its ExpiresAt to
+// match. A ttl of 0 stores the key without expiry and leaves ExpiresAt as it
+// is; Get then returns the session even once ExpiresAt has passed.
 func (r *RedisStore) SetWithTTL(session *Session, ttl time.Duration) error {
+	if ttl > 0 {
+		session.ExpiresAt = time.Now().Add(ttl)
+	}
+	return r.write(r.ctx, session, ttl)
+}
+
+// importBatchSize caps the commands Import sends per transaction
+const importBatchSize = 500
+
+// Import bulk-loads sessions, e.g. when migrating from another session
+// system. Writes are sent in pipelined transactions of up to importBatchSize
+// commands, each session expiring at its ExpiresAt; already expired sessions
+// are skipped. It stops at the first
+// error, leaving earlier batches stored, and can safely be run again since
+// sessions are overwritten. User session indexes are not updated.
+func (r *RedisStore) Import(sessions []*Session) error {
+	pipe := r.client.TxPipeline()
+	for _, session := range sessions {
+		ttl := time.Until(session.ExpiresAt)
+		if ttl <= 0 {
+			continue
+		}
+
+		if err := r.queueImport(pipe, session, ttl); err != nil {
+			return fmt.Errorf("import session %q: %w", session.ID, err)
+		}
+
+		if pipe.Len() >= importBatchSize {
+			if _, err := pipe.Exec(r.ctx); err != nil {
+				return err
+			}
+		}
+	}
+
+	if pipe.Len() > 0 {
+		_, err := pipe.Exec(r.ctx)
+		return err
+	}
+	return nil
+}
+
+// queueImport adds the commands writing one imported session to pipe
+func (r *RedisStore) queueImport(pipe redis.Pipeliner, session *Session, ttl time.Duration) error {
 	key := r.prefix + session.ID
 
-	data, err := json.Marshal(session)
+	if !r.hashFields {
+		data, err := encodeSession(session, r.encoding)
+		if err != nil {
+			return err
+		}
+		if err := checkDataSize(len(data), r.maxDataSize); err != nil {
+			return err
+		}
+		pipe.Set(r.ctx, key, data, ttl)
+		return nil
+	}
+
+	fields, size, err := hashDataFields(session)
 	if err != nil {
 		return err
 	}
+	if err := checkDataSize(size, r.maxDataSize); err != nil {
+		return err
+	}
 
-	return r.client.Set(r.ctx, key, data, ttl).Err()
+	values := append([]interface{}{
+		hashCreatedAt, session.CreatedAt.Format(time.RFC3339Nano),
+		hashExpiresAt, session.ExpiresAt.Format(time.RFC3339Nano),
+		hashUpdatedAt, session.UpdatedAt.Format(time.RFC3339Nano),
+	}, fields...)
+	pipe.Del(r.ctx, key)
+	pipe.HSet(r.ctx, key, values...)
+	pipe.PExpire(r.ctx, key, ttl)
+	return nil
+}
+
+// NoExpiry is returned by RemainingTTL for a session key without expiry
+const NoExpiry time.Duration = -1
+
+// RemainingTTL returns how long Redis will keep the session, read live with
+// PTTL. This can differ from Session.ExpiresAt, e.g. after Touch, which
+// only extends the key's TTL unless TouchRewrite is set.
+// It returns NoExpiry for a key without expiry and ErrSessionNotFound for a
+// missing one.
+func (r *RedisStore) RemainingTTL(id string) (time.Duration, error) {
+	key := r.prefix + id
+	ttl, err := r.client.PTTL(r.ctx, key).Result()
+	if err != nil {
+		return 0, err
+	}
+
+	// PTTL reports -2 for a missing key and -1 for one without expiry
+	switch ttl {
+	case -2:
+		return 0, ErrSessionNotFound
+	case -1:
+		return NoExpiry, nil
+	}
+	return ttl, nil
 }
 
 // Exists checks if a session exists
@@ -144,13 +601,47 @@ func (r *RedisStore) Exists(id string) (bool, error) {
 	return result > 0, err
 }
 
-// Count returns the number of active sessions
+// Count returns the number of active sessions. It walks the session keys
+// with SCAN, so Redis isn't blocked, but the cost still grows with the
+// keyspace, and keys written during the walk may be counted twice or missed.
 func (r *RedisStore) Count() (int64, error) {
-	keys, err := r.client.Keys(r.ctx, r.prefix+"*").Result()
-	if err != nil {
-		return 0, err
+	var count int64
+	iter := r.client.Scan(r.ctx, 0, r.prefix+"*", 100).Iterator()
+	for iter.Next(r.ctx) {
+		count++
+	}
+	return count, iter.Err()
+}
+
+// Each calls fn for every active session until fn returns an error
+func (r *RedisStore) Each(fn func(*Session) error) error {
+	return r.EachCtx(r.ctx, fn)
+}
+
+// EachCtx calls fn for every active session using ctx, scanning keys in
+// batches rather than loading them all at once. Expired sessions found along
+// the way are deleted and skipped, and sessions may be seen more than once if
+// they are written during the scan.
+func (r *RedisStore) EachCtx(ctx context.Context, fn func(*Session) error) error {
+	iter := r.client.Scan(ctx, 0, r.prefix+"*", 100).Iterator()
+	for iter.Next(ctx) {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+
+		session, err := r.get(ctx, strings.TrimPrefix(iter.Val(), r.prefix), 0)
+		if err == ErrSessionNotFound || err == ErrSessionExpired {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+
+		if err := fn(session); err != nil {
+			return err
+		}
 	}
-	return int64(len(keys)), nil
+	return iter.Err()
 }
 
 // Clear removes all sessions
@@ -166,3 +657,55 @@ func (r *RedisStore) Clear() error {
 
 	return nil
 }
+
+// AddUserSession records sessionID in the index of userID's sessions.
+// The index is a Redis set whose TTL is extended to cover the longest-lived
+// session added to it, so it expires on its own once those sessions are gone.
+// This costs two extra round-trips per call; sessions whose TTL is later
+// extended past the index's should be added again.
+func (r *RedisStore) AddUserSession(userID, sessionID string) error {
+	userKey := r.userPrefix + userID
+
+	pipe := r.client.Pipeline()
+	sessionTTL := pipe.PTTL(r.ctx, r.prefix+sessionID)
+	indexTTL := pipe.PTTL(r.ctx, userKey)
+	if _, err := pipe.Exec(r.ctx); err != nil {
+		return err
+	}
+
+	ttl := sessionTTL.Val()
+	if ttl <= 0 {
+		return ErrSessionNotFound
+	}
+
+	pipe = r.client.TxPipeline()
+	pipe.SAdd(r.ctx, userKey, sessionID)
+	if ttl > indexTTL.Val() {
+		pipe.PExpire(r.ctx, userKey, ttl)
+	}
+	_, err := pipe.Exec(r.ctx)
+	return err
+}
+
+// UserSessions returns the session IDs recorded for userID
+func (r *RedisStore) UserSessions(userID string) ([]string, error) {
+	return r.client.SMembers(r.ctx, r.userPrefix+userID).Result()
+}
+
+// DeleteUserSessions removes every session recorded for userID along with the index
+func (r *RedisStore) DeleteUserSessions(userID string) error {
+	userKey := r.userPrefix + userID
+
+	ids, err := r.client.SMembers(r.ctx, userKey).Result()
+	if err != nil {
+		return err
+	}
+
+	keys := make([]string, 0, len(ids)+1)
+	for _, id := range ids {
+		keys = append(keys, r.prefix+id)
+	}
+	keys = append(keys, userKey)
+
+	return r.client.Del(r.ctx, keys...).Err()
+}
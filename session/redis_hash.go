@@ -0,0 +1,149 @@
+package session
+
+import (
+	"context"
+	"encoding/json"
+	"strings"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// Field names used by RedisStore in HashFields mode. Data keys are prefixed so
+// they can never collide with the reserved metadata fields.
+const (
+	hashDataPrefix = "d:"
+	hashCreatedAt  = "m:created_at"
+	hashExpiresAt  = "m:expires_at"
+	hashUpdatedAt  = "m:updated_at"
+)
+
+// getHash fetches a session stored as a Redis hash along with its TTL in one round-trip
+func (r *RedisStore) getHash(ctx context.Context, id, key string, touch time.Duration) (*Session, time.Duration, error) {
+	pipe := r.client.Pipeline()
+	fieldsCmd := pipe.HGetAll(ctx, key)
+	ttl := pipeTTL(ctx, pipe, key, touch)
+	if _, err := pipe.Exec(ctx); err != nil {
+		// A session stored as a JSON value is treated as missing
+		if redis.HasErrorPrefix(err, "WRONGTYPE") {
+			return nil, 0, ErrSessionNotFound
+		}
+		return nil, 0, err
+	}
+
+	fields := fieldsCmd.Val()
+	if len(fields) == 0 {
+		return nil, 0, ErrSessionNotFound
+	}
+
+	session := &Session{
+		ID:      id,
+		Data:    make(map[string]interface{}, len(fields)),
+		changes: make(map[string]bool),
+	}
+
+	for field, value := range fields {
+		var err error
+		switch field {
+		case hashCreatedAt:
+			session.CreatedAt, err = time.Parse(time.RFC3339Nano, value)
+		case hashExpiresAt:
+			session.ExpiresAt, err = time.Parse(time.RFC3339Nano, value)
+		case hashUpdatedAt:
+			session.UpdatedAt, err = time.Parse(time.RFC3339Nano, value)
+		default:
+			if !strings.HasPrefix(field, hashDataPrefix) {
+				continue
+			}
+			var v interface{}
+			err = json.Unmarshal([]byte(value), &v)
+			session.Data[strings.TrimPrefix(field, hashDataPrefix)] = v
+		}
+		if err != nil {
+			return nil, 0, err
+		}
+	}
+
+	return session, ttl(), nil
+}
+
+// setHash writes a session as a Redis hash. Sessions loaded from a hash only
+// have their changed fields written; anything else replaces the whole hash.
+func (r *RedisStore) setHash(ctx context.Context, session *Session, ttl time.Duration) error {
+	key := r.prefix + session.ID
+
+	values := []interface{}{
+		hashCreatedAt, session.CreatedAt.Format(time.RFC3339Nano),
+		hashExpiresAt, session.ExpiresAt.Format(time.RFC3339Nano),
+		hashUpdatedAt, session.UpdatedAt.Format(time.RFC3339Nano),
+	}
+	var (
+		deleted []string
+		size    int
+	)
+
+	if session.changes == nil {
+		data, dataSize, err := hashDataFields(session)
+		if err != nil {
+			return err
+		}
+		values = append(values, data...)
+		size = dataSize
+	} else {
+		for k, set := range session.changes {
+			if !set {
+				deleted = append(deleted, hashDataPrefix+k)
+				continue
+			}
+			data, err := json.Marshal(session.Data[k])
+			if err != nil {
+				return err
+			}
+			values = append(values, hashDataPrefix+k, data)
+			size += len(data)
+		}
+	}
+
+	if err := checkDataSize(size, r.maxDataSize); err != nil {
+		return err
+	}
+
+	pipe := r.client.TxPipeline()
+	if session.changes == nil {
+		pipe.Del(ctx, key)
+	}
+	if len(deleted) > 0 {
+		pipe.HDel(ctx, key, deleted...)
+	}
+	pipe.HSet(ctx, key, values...)
+	if ttl > 0 {
+		pipe.PExpire(ctx, key, ttl)
+	} else {
+		pipe.Persist(ctx, key)
+	}
+	if _, err := pipe.Exec(ctx); err != nil {
+		return err
+	}
+
+	// Later saves only need to write what changes from here on
+	session.changes = make(map[string]bool)
+	return nil
+}
+
+// hashDataFields returns the hash fields and values holding all of a
+// session's data, and the size of the encoded values
+func hashDataFields(session *Session) ([]interface{}, int, error) {
+	var (
+		fields []interface{}
+		size   int
+	)
+	for k, v := range session.Data {
+		data, err := json.Marshal(v)
+		if err != nil {
+			return nil, 0, err
+		}
+		fields = append(fields, hashDataPrefix+k, data)
+		size += len(data)
+	}
+	return fields, size, nil
+}
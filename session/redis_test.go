@@ -0,0 +1,365 @@
+package session
+
+import (
+	"context"
+	"reflect"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/redis/go-redis/v9"
+)
+
+// newTestRedisStore returns a RedisStore backed by an in-memory Redis server
+func newTestRedisStore(t testing.TB, config RedisConfig) (*RedisStore, *miniredis.Miniredis) {
+	t.Helper()
+
+	server := miniredis.RunT(t)
+	client := redis.NewClient(&redis.Options{Addr: server.Addr()})
+	t.Cleanup(func() { client.Close() })
+
+	return NewRedisStoreWithClient(client, config), server
+}
+
+func TestRedisStoreGobRoundTrip(t *testing.T) {
+	store, _ := newTestRedisStore(t, RedisConfig{Encoding: EncodingGob})
+
+	sess := newFlashSession()
+	if err := store.Set(sess); err != nil {
+		t.Fatalf("Set: %v", err)
+	}
+
+	got, err := store.Get(sess.ID)
+	if err != nil {
+		t.Fatalf("Get: %v", err)
+	}
+	if !reflect.DeepEqual(got.Data, sess.Data) {
+		t.Errorf("Data = %#v, want %#v", got.Data, sess.Data)
+	}
+}
+
+func TestRedisStoreCount(t *testing.T) {
+	store, server := newTestRedisStore(t, RedisConfig{})
+
+	for i := 0; i < 250; i++ {
+		if err := store.Set(NewSession(time.Hour)); err != nil {
+			t.Fatalf("Set: %v", err)
+		}
+	}
+	server.Set("other:key", "x")
+
+	count, err := store.Count()
+	if err != nil {
+		t.Fatalf("Count: %v", err)
+	}
+	if count != 250 {
+		t.Errorf("Count = %d, want 250", count)
+	}
+}
+
+func TestRedisStoreSetWithTTL(t *testing.T) {
+	for _, hash := range []bool{false, true} {
+		store, server := newTestRedisStore(t, RedisConfig{HashFields: hash})
+
+		// A positive TTL moves ExpiresAt and the key's expiry
+		sess := NewSession(time.Hour)
+		if err := store.SetWithTTL(sess, 10*time.Minute); err != nil {
+			t.Fatalf("hash=%v: SetWithTTL: %v", hash, err)
+		}
+		if d := time.Until(sess.ExpiresAt); d > 10*time.Minute || d < 9*time.Minute {
+			t.Errorf("hash=%v: ExpiresAt in %v, want 10m", hash, d)
+		}
+		if ttl := server.TTL(store.prefix + sess.ID); ttl != 10*time.Minute {
+			t.Errorf("hash=%v: key TTL = %v, want 10m", hash, ttl)
+		}
+
+		// A TTL of 0 persists the session even past its ExpiresAt
+		sess = NewSession(time.Hour)
+		sess.Set("user", "alice")
+		sess.ExpiresAt = time.Now().Add(-time.Minute)
+		if err := store.SetWithTTL(sess, 0); err != nil {
+			t.Fatalf("hash=%v: SetWithTTL: %v", hash, err)
+		}
+
+		got, err := store.Get(sess.ID)
+		if err != nil {
+			t.Fatalf("hash=%v: Get of a session without expiry: %v", hash, err)
+		}
+		if v, _ := got.GetString("user"); v != "alice" {
+			t.Errorf("hash=%v: user = %q, want alice", hash, v)
+		}
+		if ttl, err := store.RemainingTTL(sess.ID); err != nil || ttl != NoExpiry {
+			t.Errorf("hash=%v: RemainingTTL = %v, %v, want NoExpiry", hash, ttl, err)
+		}
+	}
+}
+
+func TestRedisStoreRemainingTTL(t *testing.T) {
+	store, server := newTestRedisStore(t, RedisConfig{})
+
+	if _, err := store.RemainingTTL("missing"); err != ErrSessionNotFound {
+		t.Errorf("RemainingTTL of a missing session: err = %v, want ErrSessionNotFound", err)
+	}
+
+	sess := NewSession(time.Hour)
+	if err := store.Set(sess); err != nil {
+		t.Fatalf("Set: %v", err)
+	}
+
+	// Touch only extends the key, which RemainingTTL reads live
+	if err := store.Touch(sess.ID, 2*time.Hour); err != nil {
+		t.Fatalf("Touch: %v", err)
+	}
+	server.FastForward(time.Minute)
+
+	ttl, err := store.RemainingTTL(sess.ID)
+	if err != nil {
+		t.Fatalf("RemainingTTL: %v", err)
+	}
+	if ttl != 119*time.Minute {
+		t.Errorf("RemainingTTL = %v, want 1h59m", ttl)
+	}
+}
+
+// commandCounter is a go-redis hook counting round-trips, commands by name
+// and the bytes of their arguments
+type commandCounter struct {
+	mu         sync.Mutex
+	roundTrips int
+	commands   map[string]int
+	argBytes   int
+}
+
+// countCommands starts counting the commands store sends
+func countCommands(store *RedisStore) *commandCounter {
+	counter := &commandCounter{commands: make(map[string]int)}
+	store.GetClient().AddHook(counter)
+	return counter
+}
+
+func (c *commandCounter) DialHook(next redis.DialHook) redis.DialHook {
+	return next
+}
+
+func (c *commandCounter) ProcessHook(next redis.ProcessHook) redis.ProcessHook {
+	return func(ctx context.Context, cmd redis.Cmder) error {
+		c.record(cmd)
+		return next(ctx, cmd)
+	}
+}
+
+func (c *commandCounter) ProcessPipelineHook(next redis.ProcessPipelineHook) redis.ProcessPipelineHook {
+	return func(ctx context.Context, cmds []redis.Cmder) error {
+		c.record(cmds...)
+		return next(ctx, cmds)
+	}
+}
+
+// record counts one round-trip sending cmds
+func (c *commandCounter) record(cmds ...redis.Cmder) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.roundTrips++
+	for _, cmd := range cmds {
+		c.commands[cmd.Name()]++
+		for _, arg := range cmd.Args() {
+			switch v := arg.(type) {
+			case string:
+				c.argBytes += len(v)
+			case []byte:
+				c.argBytes += len(v)
+			}
+		}
+	}
+}
+
+// reset clears the counts, e.g. after a benchmark's setup
+func (c *commandCounter) reset() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.roundTrips = 0
+	c.commands = make(map[string]int)
+	c.argBytes = 0
+}
+
+// report adds the counts per operation to a benchmark's results
+func (c *commandCounter) report(b *testing.B, names ...string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	n := float64(b.N)
+	b.ReportMetric(float64(c.roundTrips)/n, "round-trips/op")
+	for _, name := range names {
+		b.ReportMetric(float64(c.commands[name])/n, name+"/op")
+	}
+}
+
+func TestRedisStoreImport(t *testing.T) {
+	for _, config := range []RedisConfig{{}, {HashFields: true}} {
+		store, server := newTestRedisStore(t, config)
+		counter := countCommands(store)
+
+		var sessions []*Session
+		for i := 0; i < 1200; i++ {
+			sess := NewSessionWithID("imported-"+strconv.Itoa(i), time.Duration(i+1)*time.Minute)
+			sess.Set("n", i)
+			sessions = append(sessions, sess)
+		}
+		sessions = append(sessions, NewSessionWithID("expired", -time.Minute))
+
+		if err := store.Import(sessions); err != nil {
+			t.Fatalf("Import (hash fields %v): %v", config.HashFields, err)
+		}
+
+		// 1200 SETs in batches of 500, or 3600 commands in hash mode
+		wantExecs := 3
+		if config.HashFields {
+			wantExecs = 8
+		}
+		if counter.roundTrips != wantExecs {
+			t.Errorf("hash fields %v: %d round-trips, want %d", config.HashFields, counter.roundTrips, wantExecs)
+		}
+
+		for _, i := range []int{0, 599, 1199} {
+			sess, err := store.Get(sessions[i].ID)
+			if err != nil {
+				t.Fatalf("Get(%s): %v", sessions[i].ID, err)
+			}
+			if n, _ := sess.GetInt("n"); n != i {
+				t.Errorf("%s: n = %d, want %d", sess.ID, n, i)
+			}
+			want := time.Until(sessions[i].ExpiresAt)
+			if ttl := server.TTL("session:" + sess.ID); ttl < want-time.Second || ttl > want+time.Second {
+				t.Errorf("%s: TTL = %v, want %v", sess.ID, ttl, want)
+			}
+		}
+		if _, err := store.Get("expired"); err != ErrSessionNotFound {
+			t.Errorf("expired session imported: %v", err)
+		}
+	}
+}
+
+// newLargeSession returns a session holding about size bytes of data spread
+// over fields of 200 bytes each
+func newLargeSession(size int) *Session {
+	sess := NewSession(time.Hour)
+	value := strings.Repeat("x", 200)
+	for i := 0; i < size/len(value); i++ {
+		sess.Set("field"+strconv.Itoa(i), value)
+	}
+	return sess
+}
+
+// BenchmarkRedisStoreTouch compares extending a 10KB session's expiration
+// with PEXPIRE against reading and rewriting it (TouchRewrite)
+func BenchmarkRedisStoreTouch(b *testing.B) {
+	for _, bm := range []struct {
+		name    string
+		rewrite bool
+	}{
+		{"pexpire", false},
+		{"rewrite", true},
+	} {
+		b.Run(bm.name, func(b *testing.B) {
+			store, _ := newTestRedisStore(b, RedisConfig{TouchRewrite: bm.rewrite})
+			sess := newLargeSession(10 * 1024)
+			if err := store.Set(sess); err != nil {
+				b.Fatal(err)
+			}
+			counter := countCommands(store)
+
+			b.ReportAllocs()
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				if err := store.Touch(sess.ID, time.Hour); err != nil {
+					b.Fatal(err)
+				}
+			}
+			b.StopTimer()
+			counter.report(b)
+			b.ReportMetric(float64(counter.argBytes)/float64(b.N), "sent-B/op")
+		})
+	}
+}
+
+// BenchmarkRedisStoreSetOneField compares saving a 10KB session after
+// changing one field as a JSON blob and as hash fields (HashFields)
+func BenchmarkRedisStoreSetOneField(b *testing.B) {
+	for _, bm := range []struct {
+		name   string
+		config RedisConfig
+	}{
+		{"blob", RedisConfig{}},
+		{"hash", RedisConfig{HashFields: true}},
+	} {
+		b.Run(bm.name, func(b *testing.B) {
+			store, _ := newTestRedisStore(b, bm.config)
+			sess := newLargeSession(10 * 1024)
+			if err := store.Set(sess); err != nil {
+				b.Fatal(err)
+			}
+			counter := countCommands(store)
+
+			b.ReportAllocs()
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				sess.Set("counter", i)
+				if err := store.Set(sess); err != nil {
+					b.Fatal(err)
+				}
+			}
+			b.StopTimer()
+			counter.report(b)
+			b.ReportMetric(float64(counter.argBytes)/float64(b.N), "sent-B/op")
+		})
+	}
+}
+
+// BenchmarkRedisStoreEncoding compares saving and loading sessions encoded
+// as JSON and as gob, reporting the stored size
+func BenchmarkRedisStoreEncoding(b *testing.B) {
+	typical := newFlashSession()
+	typical.Set("user_id", 42)
+	typical.Set("email", "alice@example.com")
+	typical.Set("roles", []interface{}{"admin", "editor"})
+	typical.Set("cart", map[string]interface{}{"items": []interface{}{"book", "pen"}, "total": 12.5})
+
+	large := newLargeSession(10 * 1024)
+	for i := 0; i < 100; i++ {
+		large.Set("count"+strconv.Itoa(i), i)
+	}
+
+	for _, size := range []struct {
+		name string
+		sess *Session
+	}{
+		{"typical", typical},
+		{"large", large},
+	} {
+		for _, encoding := range []string{EncodingJSON, EncodingGob} {
+			b.Run(size.name+"-"+encoding, func(b *testing.B) {
+				store, server := newTestRedisStore(b, RedisConfig{Encoding: encoding})
+
+				b.ReportAllocs()
+				b.ResetTimer()
+				for i := 0; i < b.N; i++ {
+					if err := store.Set(size.sess); err != nil {
+						b.Fatal(err)
+					}
+					if _, err := store.Get(size.sess.ID); err != nil {
+						b.Fatal(err)
+					}
+				}
+				b.StopTimer()
+
+				stored, err := server.Get("session:" + size.sess.ID)
+				if err != nil {
+					b.Fatal(err)
+				}
+				b.ReportMetric(float64(len(stored)), "stored-B")
+			})
+		}
+	}
+}
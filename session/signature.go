@@ -0,0 +1,42 @@
+package session
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"strings"
+)
+
+var (
+	// ErrInvalidSignature is returned when a signed value fails verification
+	ErrInvalidSignature = errors.New("invalid session signature")
+)
+
+// signValue appends an HMAC-SHA256 signature to value
+func signValue(value string, secretKey []byte) string {
+	return value + "." + computeSignature(value, secretKey)
+}
+
+// verifyValue checks the signature of a signed value and returns the original value
+func verifyValue(signed string, secretKey []byte) (string, error) {
+	idx := strings.LastIndex(signed, ".")
+	if idx < 0 {
+		return "", ErrInvalidSignature
+	}
+
+	value, signature := signed[:idx], signed[idx+1:]
+	expected := computeSignature(value, secretKey)
+	if !hmac.Equal([]byte(signature), []byte(expected)) {
+		return "", ErrInvalidSignature
+	}
+
+	return value, nil
+}
+
+// computeSignature returns the base64-encoded HMAC-SHA256 of value
+func computeSignature(value string, secretKey []byte) string {
+	mac := hmac.New(sha256.New, secretKey)
+	mac.Write([]byte(value))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
@@ -0,0 +1,75 @@
+package session
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+)
+
+// saveSnapshot writes the sessions to the snapshot file, least recently used
+// first. The file is replaced atomically so a crash never leaves it half written.
+func (m *MemoryStore) saveSnapshot() error {
+	m.mu.RLock()
+	sessions := make([]*Session, 0, len(m.sessions))
+	for elem := m.lru.Back(); elem != nil; elem = elem.Prev() {
+		if session := m.sessions[elem.Value.(string)]; !session.IsExpired() {
+			sessions = append(sessions, session)
+		}
+	}
+	data, err := json.Marshal(sessions)
+	m.mu.RUnlock()
+	if err != nil {
+		return err
+	}
+
+	tmp, err := os.CreateTemp(filepath.Dir(m.snapshotPath), filepath.Base(m.snapshotPath)+".tmp*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	// Sessions are credentials, keep them private to this user
+	if err := tmp.Chmod(0o600); err != nil {
+		tmp.Close()
+		return err
+	}
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+
+	return os.Rename(tmp.Name(), m.snapshotPath)
+}
+
+// loadSnapshot restores non-expired sessions from the snapshot file, if it exists
+func (m *MemoryStore) loadSnapshot() error {
+	data, err := os.ReadFile(m.snapshotPath)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	var sessions []*Session
+	if err := json.Unmarshal(data, &sessions); err != nil {
+		return err
+	}
+
+	for _, session := range sessions {
+		if session.IsExpired() {
+			continue
+		}
+		if session.Data == nil {
+			session.Data = make(map[string]interface{})
+		}
+		if err := m.Set(session); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
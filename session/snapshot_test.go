@@ -0,0 +1,70 @@
+package session
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestMemoryStoreSnapshot(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "sessions.json")
+
+	store := NewMemoryStoreWithConfig(MemoryConfig{SnapshotPath: path})
+	live := NewSessionWithID("live", time.Hour)
+	live.Set("user", "alice")
+	expiring := NewSessionWithID("expiring", time.Hour)
+	for _, sess := range []*Session{live, expiring} {
+		if err := store.Set(sess); err != nil {
+			t.Fatalf("Set: %v", err)
+		}
+	}
+	// Expires while the process is down
+	if err := store.Touch("expiring", 50*time.Millisecond); err != nil {
+		t.Fatalf("Touch: %v", err)
+	}
+	if err := store.Close(); err != nil {
+		t.Fatalf("Close: %v", err)
+	}
+
+	info, err := os.Stat(path)
+	if err != nil {
+		t.Fatalf("snapshot not written: %v", err)
+	}
+	if mode := info.Mode().Perm(); mode != 0o600 {
+		t.Errorf("snapshot mode = %v, want 0600", mode)
+	}
+
+	time.Sleep(100 * time.Millisecond)
+	restored := NewMemoryStoreWithConfig(MemoryConfig{SnapshotPath: path})
+	defer restored.Close()
+
+	sess, err := restored.Get("live")
+	if err != nil {
+		t.Fatalf("Get(live): %v", err)
+	}
+	if v, _ := sess.GetString("user"); v != "alice" {
+		t.Errorf("user = %q, want alice", v)
+	}
+	if !sess.ExpiresAt.Equal(live.ExpiresAt) {
+		t.Errorf("ExpiresAt = %v, want %v", sess.ExpiresAt, live.ExpiresAt)
+	}
+	if n := restored.Len(); n != 1 {
+		t.Errorf("restored %d sessions, want only the live one", n)
+	}
+}
+
+func TestMemoryStoreSnapshotMissingFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "sessions.json")
+
+	store := NewMemoryStoreWithConfig(MemoryConfig{SnapshotPath: path})
+	if n := store.Len(); n != 0 {
+		t.Errorf("Len = %d, want an empty store", n)
+	}
+	if err := store.Close(); err != nil {
+		t.Fatalf("Close: %v", err)
+	}
+	if _, err := os.Stat(path); err != nil {
+		t.Errorf("snapshot not written: %v", err)
+	}
+}
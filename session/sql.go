@@ -0,0 +1,179 @@
+package session
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// SQLStore implements a session store on top of database/sql
+type SQLStore struct {
+	db     *sql.DB
+	table  string
+	dollar bool
+}
+
+// SQLConfig holds SQL session store configuration
+type SQLConfig struct {
+	DB        *sql.DB // An open database handle, owned by the caller
+	TableName string  // Table holding sessions (default "sessions")
+	Dialect   string  // "postgres" uses $1-style placeholders, anything else uses ?
+}
+
+// NewSQLStore creates a new SQL session store.
+// The table must already exist, see README for the schema.
+func NewSQLStore(config SQLConfig) (*SQLStore, error) {
+	if config.DB == nil {
+		return nil, errors.New("sql session store requires a database handle")
+	}
+
+	table := config.TableName
+	if table == "" {
+		table = "sessions"
+	}
+
+	return &SQLStore{
+		db:     config.DB,
+		table:  table,
+		dollar: config.Dialect == "postgres",
+	}, nil
+}
+
+// Get retrieves a session from the database
+func (s *SQLStore) Get(id string) (*Session, error) {
+	query := s.query("SELECT data, created_at, expires_at, updated_at FROM %s WHERE id = ?")
+
+	var (
+		data    []byte
+		session = Session{ID: id}
+	)
+	err := s.db.QueryRow(query, id).Scan(&data, &session.CreatedAt, &session.ExpiresAt, &session.UpdatedAt)
+	if err == sql.ErrNoRows {
+		return nil, ErrSessionNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if err := json.Unmarshal(data, &session.Data); err != nil {
+		return nil, err
+	}
+	if session.Data == nil {
+		session.Data = make(map[string]interface{})
+	}
+
+	if session.IsExpired() {
+		s.Delete(id)
+		return nil, ErrSessionExpired
+	}
+
+	return &session, nil
+}
+
+// Set stores a session in the database
+func (s *SQLStore) Set(session *Session) error {
+	data, err := json.Marshal(session.Data)
+	if err != nil {
+		return err
+	}
+
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	// Update first and insert when the session is new, which works across dialects
+	result, err := tx.Exec(
+		s.query("UPDATE %s SET data = ?, expires_at = ?, updated_at = ? WHERE id = ?"),
+		data, session.ExpiresAt, session.UpdatedAt, session.ID,
+	)
+	if err != nil {
+		return err
+	}
+
+	rows, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+
+	if rows == 0 {
+		_, err = tx.Exec(
+			s.query("INSERT INTO %s (id, data, created_at, expires_at, updated_at) VALUES (?, ?, ?, ?, ?)"),
+			session.ID, data, session.CreatedAt, session.ExpiresAt, session.UpdatedAt,
+		)
+		if err != nil {
+			return err
+		}
+	}
+
+	return tx.Commit()
+}
+
+// Delete removes a session from the database
+func (s *SQLStore) Delete(id string) error {
+	_, err := s.db.Exec(s.query("DELETE FROM %s WHERE id = ?"), id)
+	return err
+}
+
+// Touch updates the last access time and extends the expiration by ttl
+func (s *SQLStore) Touch(id string, ttl time.Duration) error {
+	now := time.Now()
+	result, err := s.db.Exec(
+		s.query("UPDATE %s SET expires_at = ?, updated_at = ? WHERE id = ?"),
+		now.Add(ttl), now, id,
+	)
+	if err != nil {
+		return err
+	}
+
+	rows, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if rows == 0 {
+		return ErrSessionNotFound
+	}
+
+	return nil
+}
+
+// Cleanup removes expired sessions
+func (s *SQLStore) Cleanup() error {
+	_, err := s.CleanupExpired()
+	return err
+}
+
+// CleanupExpired removes expired sessions and returns how many were removed
+func (s *SQLStore) CleanupExpired() (int, error) {
+	result, err := s.db.Exec(s.query("DELETE FROM %s WHERE expires_at < ?"), time.Now())
+	if err != nil {
+		return 0, err
+	}
+
+	removed, err := result.RowsAffected()
+	return int(removed), err
+}
+
+// query fills in the table name and rewrites placeholders for the dialect
+func (s *SQLStore) query(format string) string {
+	query := fmt.Sprintf(format, s.table)
+	if !s.dollar {
+		return query
+	}
+
+	var b strings.Builder
+	n := 0
+	for _, r := range query {
+		if r == '?' {
+			n++
+			fmt.Fprintf(&b, "$%d", n)
+			continue
+		}
+		b.WriteRune(r)
+	}
+	return b.String()
+}
@@ -0,0 +1,127 @@
+package session
+
+import (
+	"database/sql"
+	"testing"
+	"time"
+
+	_ "github.com/mattn/go-sqlite3"
+)
+
+// sessionsSchema is the table layout documented in the README
+const sessionsSchema = `CREATE TABLE sessions (
+    id         VARCHAR(128) PRIMARY KEY,
+    data       TEXT         NOT NULL,
+    created_at TIMESTAMP    NOT NULL,
+    expires_at TIMESTAMP    NOT NULL,
+    updated_at TIMESTAMP    NOT NULL
+)`
+
+// newTestSQLStore returns an SQLStore on a fresh in-memory SQLite database
+func newTestSQLStore(t *testing.T, dialect string) *SQLStore {
+	t.Helper()
+
+	db, err := sql.Open("sqlite3", ":memory:")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Every connection to :memory: gets its own database
+	db.SetMaxOpenConns(1)
+	t.Cleanup(func() { db.Close() })
+
+	if _, err := db.Exec(sessionsSchema); err != nil {
+		t.Fatal(err)
+	}
+
+	store, err := NewSQLStore(SQLConfig{DB: db, Dialect: dialect})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return store
+}
+
+func TestSQLStorePlaceholders(t *testing.T) {
+	tests := []struct {
+		dialect string
+		want    string
+	}{
+		{"", "UPDATE sessions SET data = ?, expires_at = ? WHERE id = ?"},
+		{"postgres", "UPDATE sessions SET data = $1, expires_at = $2 WHERE id = $3"},
+	}
+	for _, tt := range tests {
+		store := newTestSQLStore(t, tt.dialect)
+		if got := store.query("UPDATE %s SET data = ?, expires_at = ? WHERE id = ?"); got != tt.want {
+			t.Errorf("dialect %q: query = %q, want %q", tt.dialect, got, tt.want)
+		}
+	}
+}
+
+func TestSQLStoreUpsert(t *testing.T) {
+	// SQLite accepts both placeholder styles, so both paths run for real
+	for _, dialect := range []string{"", "postgres"} {
+		store := newTestSQLStore(t, dialect)
+
+		// The first Set inserts
+		sess := NewSession(time.Hour)
+		sess.Set("user", "alice")
+		if err := store.Set(sess); err != nil {
+			t.Fatalf("dialect %q: insert: %v", dialect, err)
+		}
+
+		// The second updates the same row
+		sess.Set("user", "bob")
+		if err := store.Set(sess); err != nil {
+			t.Fatalf("dialect %q: update: %v", dialect, err)
+		}
+
+		var rows int
+		if err := store.db.QueryRow("SELECT COUNT(*) FROM sessions").Scan(&rows); err != nil {
+			t.Fatal(err)
+		}
+		if rows != 1 {
+			t.Errorf("dialect %q: %d rows, want 1", dialect, rows)
+		}
+
+		got, err := store.Get(sess.ID)
+		if err != nil {
+			t.Fatalf("dialect %q: Get: %v", dialect, err)
+		}
+		if v, _ := got.GetString("user"); v != "bob" {
+			t.Errorf("dialect %q: user = %q, want bob", dialect, v)
+		}
+
+		if err := store.Touch(sess.ID, 2*time.Hour); err != nil {
+			t.Errorf("dialect %q: Touch: %v", dialect, err)
+		}
+		if err := store.Touch("missing", time.Hour); err != ErrSessionNotFound {
+			t.Errorf("dialect %q: Touch of a missing session: err = %v, want ErrSessionNotFound", dialect, err)
+		}
+	}
+}
+
+func TestSQLStoreExpiry(t *testing.T) {
+	store := newTestSQLStore(t, "")
+
+	expired := NewSession(time.Hour)
+	expired.ExpiresAt = time.Now().Add(-time.Minute)
+	live := NewSession(time.Hour)
+	for _, sess := range []*Session{expired, live} {
+		if err := store.Set(sess); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	removed, err := store.CleanupExpired()
+	if err != nil {
+		t.Fatalf("CleanupExpired: %v", err)
+	}
+	if removed != 1 {
+		t.Errorf("CleanupExpired removed %d sessions, want 1", removed)
+	}
+	if _, err := store.Get(expired.ID); err != ErrSessionNotFound {
+		t.Errorf("Get of a cleaned up session: err = %v, want ErrSessionNotFound", err)
+	}
+	if _, err := store.Get(live.ID); err != nil {
+		t.Errorf("Get of a live session: %v", err)
+	}
+}
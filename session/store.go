@@ -1,10 +1,19 @@
 package session
 
 import (
+	"bytes"
+	"container/list"
+	"context"
+	"crypto/cipher"
 	"crypto/rand"
 	"encoding/base64"
+	"encoding/gob"
 	"encoding/json"
 	"errors"
+	"fmt"
+	"log"
+	"math"
+	"reflect"
 	"sync"
 	"time"
 )
@@ -14,6 +23,14 @@ var (
 	ErrSessionNotFound = errors.New("session not found")
 	// ErrSessionExpired is returned when a session has expired
 	ErrSessionExpired = errors.New("session expired")
+	// ErrStoreFull is returned when a bounded store rejects a new session
+	ErrStoreFull = errors.New("session store is full")
+	// ErrSessionTooLarge is returned when a session exceeds the store's MaxDataSize
+	ErrSessionTooLarge = errors.New("session data too large")
+	// ErrKeyNotFound is returned by Session.Unmarshal when the key is not set
+	ErrKeyNotFound = errors.New("session key not found")
+	// ErrClosed is returned by RedisStore commands made after Close
+	ErrClosed = errors.New("session store is closed")
 )
 
 // Store is the interface for session storage backends
@@ -30,8 +47,8 @@ type Store interface {
 	// Cleanup removes expired sessions
 	Cleanup() error
 	
-	// Touch updates the last access time
-	Touch(id string) error
+	// Touch updates the last access time and extends the expiration by ttl
+	Touch(id string, ttl time.Duration) error
 }
 
 // Session represents a user session
@@ -41,13 +58,32 @@ type Session struct {
 	CreatedAt time.Time              `json:"created_at"`
 	ExpiresAt time.Time              `json:"expires_at"`
 	UpdatedAt time.Time              `json:"updated_at"`
+
+	modified bool
+	isNew    bool
+	touched  bool // expiration already extended while loading
+
+	// changes records keys set (true) or deleted (false) since the session was
+	// last written, for stores that support partial updates. nil means the
+	// whole session has to be written.
+	changes map[string]bool
 }
 
-// NewSession creates a new session
+// NewSession creates a new session with a random ID.
+// It panics if the system entropy source fails.
 func NewSession(maxAge time.Duration) *Session {
+	id, err := generateSessionID()
+	if err != nil {
+		panic("session: failed to generate session ID: " + err.Error())
+	}
+	return NewSessionWithID(id, maxAge)
+}
+
+// NewSessionWithID creates a new session with the given ID
+func NewSessionWithID(id string, maxAge time.Duration) *Session {
 	now := time.Now()
 	return &Session{
-		ID:        generateSessionID(),
+		ID:        id,
 		Data:      make(map[string]interface{}),
 		CreatedAt: now,
 		ExpiresAt: now.Add(maxAge),
@@ -60,10 +96,24 @@ func (s *Session) IsExpired() bool {
 	return time.Now().After(s.ExpiresAt)
 }
 
+// IsNew reports whether the session was created during this request and not stored yet
+func (s *Session) IsNew() bool {
+	return s.isNew
+}
+
+// IsModified reports whether the session data changed since it was loaded
+func (s *Session) IsModified() bool {
+	return s.modified
+}
+
 // Set sets a value in the session
 func (s *Session) Set(key string, value interface{}) {
 	s.Data[key] = value
 	s.UpdatedAt = time.Now()
+	s.modified = true
+	if s.changes != nil {
+		s.changes[key] = true
+	}
 }
 
 // Get gets a value from the session
@@ -72,35 +122,237 @@ func (s *Session) Get(key string) (interface{}, bool) {
 	return val, ok
 }
 
+// GetString gets a string value from the session
+func (s *Session) GetString(key string) (string, bool) {
+	val, ok := s.Data[key].(string)
+	return val, ok
+}
+
+// GetBytes gets a []byte value from the session. JSON-based stores return
+// []byte values as base64 strings, which are decoded transparently, so only
+// use it for keys that were set to a []byte.
+func (s *Session) GetBytes(key string) ([]byte, bool) {
+	switch val := s.Data[key].(type) {
+	case []byte:
+		return val, true
+	case string:
+		// encoding/json encodes []byte as standard base64
+		data, err := base64.StdEncoding.DecodeString(val)
+		if err != nil {
+			return nil, false
+		}
+		return data, true
+	}
+	return nil, false
+}
+
+// GetInt gets an int value from the session, accepting JSON-decoded whole numbers
+func (s *Session) GetInt(key string) (int, bool) {
+	val, ok := s.GetInt64(key)
+	return int(val), ok
+}
+
+// GetInt64 gets an int64 value from the session, accepting JSON-decoded whole numbers
+func (s *Session) GetInt64(key string) (int64, bool) {
+	switch val := s.Data[key].(type) {
+	case int:
+		return int64(val), true
+	case int32:
+		return int64(val), true
+	case int64:
+		return val, true
+	case float64:
+		// JSON decodes all numbers as float64
+		if val != math.Trunc(val) {
+			return 0, false
+		}
+		return int64(val), true
+	}
+	return 0, false
+}
+
+// GetBool gets a bool value from the session
+func (s *Session) GetBool(key string) (bool, bool) {
+	val, ok := s.Data[key].(bool)
+	return val, ok
+}
+
+// GetFloat64 gets a float64 value from the session
+func (s *Session) GetFloat64(key string) (float64, bool) {
+	switch val := s.Data[key].(type) {
+	case float64:
+		return val, true
+	case float32:
+		return float64(val), true
+	case int:
+		return float64(val), true
+	case int64:
+		return float64(val), true
+	}
+	return 0, false
+}
+
+// Unmarshal decodes the value stored under key into dest, which must be a
+// pointer. Values that came back from a store as generic JSON (float64,
+// map[string]interface{}) are converted by re-encoding them, so structs and
+// integers can be read back as their original types.
+func (s *Session) Unmarshal(key string, dest interface{}) error {
+	val, ok := s.Data[key]
+	if !ok {
+		return ErrKeyNotFound
+	}
+
+	rv := reflect.ValueOf(dest)
+	if rv.Kind() != reflect.Ptr || rv.IsNil() {
+		return fmt.Errorf("session: Unmarshal of %q requires a non-nil pointer", key)
+	}
+
+	// Values that were never serialized already have the right type
+	if val != nil && reflect.TypeOf(val).AssignableTo(rv.Elem().Type()) {
+		rv.Elem().Set(reflect.ValueOf(val))
+		return nil
+	}
+
+	data, err := json.Marshal(val)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(data, dest)
+}
+
 // Delete removes a key from the session
 func (s *Session) Delete(key string) {
 	delete(s.Data, key)
 	s.UpdatedAt = time.Now()
+	s.modified = true
+	if s.changes != nil {
+		s.changes[key] = false
+	}
 }
 
 // Clear removes all data from the session
 func (s *Session) Clear() {
 	s.Data = make(map[string]interface{})
 	s.UpdatedAt = time.Now()
+	s.modified = true
+	s.changes = nil
+}
+
+// clone returns a deep copy of the session without its request-scoped flags
+func (s *Session) clone() *Session {
+	return &Session{
+		ID:        s.ID,
+		Data:      copyData(s.Data),
+		CreatedAt: s.CreatedAt,
+		ExpiresAt: s.ExpiresAt,
+		UpdatedAt: s.UpdatedAt,
+	}
 }
 
-// MemoryStore implements an in-memory session store
+// copyData deep-copies session data so the copy shares no maps or slices with the original
+func copyData(data map[string]interface{}) map[string]interface{} {
+	copied := make(map[string]interface{}, len(data))
+	for key, value := range data {
+		copied[key] = copyValue(value)
+	}
+	return copied
+}
+
+// copyValue deep-copies the container types produced by JSON decoding
+func copyValue(value interface{}) interface{} {
+	switch v := value.(type) {
+	case map[string]interface{}:
+		return copyData(v)
+	case []interface{}:
+		copied := make([]interface{}, len(v))
+		for i, item := range v {
+			copied[i] = copyValue(item)
+		}
+		return copied
+	case []byte:
+		return append([]byte(nil), v...)
+	default:
+		return v
+	}
+}
+
+// MemoryStore implements an in-memory session store.
+// Like the other stores it hands out copies: Get returns a private copy and
+// Set stores one, so changes are only visible to other requests after Set.
 type MemoryStore struct {
-	sessions map[string]*Session
-	mu       sync.RWMutex
-	stopCh   chan struct{}
+	sessions       map[string]*Session
+	lru            *list.List // Session IDs, most recently used first
+	elements       map[string]*list.Element
+	maxSessions    int
+	rejectWhenFull bool
+	maxDataSize    int
+	onCleanup      func(removed int)
+	snapshotPath   string
+	mu             sync.RWMutex
+	stopCh         chan struct{}
+	closeOnce      sync.Once
+}
+
+// MemoryConfig holds in-memory session store configuration
+type MemoryConfig struct {
+	CleanupInterval time.Duration // How often expired sessions are removed
+	MaxSessions     int           // Maximum number of sessions kept (0 = unlimited)
+	RejectWhenFull  bool          // Return ErrStoreFull instead of evicting the least recently used session
+	MaxDataSize     int           // Reject sessions whose JSON-encoded data exceeds this many bytes (0 = unlimited)
+
+	// OnCleanup is called after each background cleanup with the number of
+	// sessions removed. By default non-zero counts are logged.
+	OnCleanup func(removed int)
+
+	// SnapshotPath (optional) is a file the store is saved to on Close and
+	// restored from on creation, so sessions survive a restart
+	SnapshotPath string
 }
 
 // NewMemoryStore creates a new in-memory session store
 func NewMemoryStore(cleanupInterval time.Duration) *MemoryStore {
+	return NewMemoryStoreWithConfig(MemoryConfig{
+		CleanupInterval: cleanupInterval,
+	})
+}
+
+// NewMemoryStoreContext creates a new in-memory session store whose background
+// cleanup also stops when ctx is cancelled, e.g. on graceful shutdown.
+// Close is still needed to write a snapshot.
+func NewMemoryStoreContext(ctx context.Context, cleanupInterval time.Duration) *MemoryStore {
+	return newMemoryStore(ctx, MemoryConfig{
+		CleanupInterval: cleanupInterval,
+	})
+}
+
+// NewMemoryStoreWithConfig creates a new in-memory session store from a config
+func NewMemoryStoreWithConfig(config MemoryConfig) *MemoryStore {
+	return newMemoryStore(context.Background(), config)
+}
+
+// newMemoryStore creates a memory store whose cleanup runs until Close or ctx is done
+func newMemoryStore(ctx context.Context, config MemoryConfig) *MemoryStore {
 	store := &MemoryStore{
-		sessions: make(map[string]*Session),
-		stopCh:   make(chan struct{}),
+		sessions:       make(map[string]*Session),
+		lru:            list.New(),
+		elements:       make(map[string]*list.Element),
+		maxSessions:    config.MaxSessions,
+		rejectWhenFull: config.RejectWhenFull,
+		maxDataSize:    config.MaxDataSize,
+		onCleanup:      config.OnCleanup,
+		snapshotPath:   config.SnapshotPath,
+		stopCh:         make(chan struct{}),
+	}
+
+	if store.snapshotPath != "" {
+		if err := store.loadSnapshot(); err != nil {
+			log.Printf("session: failed to restore memory store snapshot: %v", err)
+		}
 	}
 	
 	// Start cleanup goroutine
-	if cleanupInterval > 0 {
-		go store.startCleanup(cleanupInterval)
+	if config.CleanupInterval > 0 {
+		go store.startCleanup(ctx, config.CleanupInterval)
 	}
 	
 	return store
@@ -108,8 +360,8 @@ func NewMemoryStore(cleanupInterval time.Duration) *MemoryStore {
 
 // Get retrieves a session
 func (m *MemoryStore) Get(id string) (*Session, error) {
-	m.mu.RLock()
-	defer m.mu.RUnlock()
+	m.mu.Lock()
+	defer m.mu.Unlock()
 	
 	session, exists := m.sessions[id]
 	if !exists {
@@ -120,15 +372,40 @@ func (m *MemoryStore) Get(id string) (*Session, error) {
 		return nil, ErrSessionExpired
 	}
 	
-	return session, nil
+	m.lru.MoveToFront(m.elements[id])
+	return session.clone(), nil
 }
 
-// Set stores a session
+// Set stores a session, evicting the least recently used one when full
 func (m *MemoryStore) Set(session *Session) error {
+	if m.maxDataSize > 0 {
+		data, err := json.Marshal(session.Data)
+		if err != nil {
+			return err
+		}
+		if err := checkDataSize(len(data), m.maxDataSize); err != nil {
+			return err
+		}
+	}
+
 	m.mu.Lock()
 	defer m.mu.Unlock()
 	
-	m.sessions[session.ID] = session
+	if elem, exists := m.elements[session.ID]; exists {
+		m.sessions[session.ID] = session.clone()
+		m.lru.MoveToFront(elem)
+		return nil
+	}
+	
+	if m.maxSessions > 0 && len(m.sessions) >= m.maxSessions {
+		if m.rejectWhenFull {
+			return ErrStoreFull
+		}
+		m.remove(m.lru.Back().Value.(string))
+	}
+	
+	m.sessions[session.ID] = session.clone()
+	m.elements[session.ID] = m.lru.PushFront(session.ID)
 	return nil
 }
 
@@ -137,12 +414,12 @@ func (m *MemoryStore) Delete(id string) error {
 	m.mu.Lock()
 	defer m.mu.Unlock()
 	
-	delete(m.sessions, id)
+	m.remove(id)
 	return nil
 }
 
-// Touch updates the last access time
-func (m *MemoryStore) Touch(id string) error {
+// Touch updates the last access time and extends the expiration
+func (m *MemoryStore) Touch(id string, ttl time.Duration) error {
 	m.mu.Lock()
 	defer m.mu.Unlock()
 	
@@ -151,57 +428,169 @@ func (m *MemoryStore) Touch(id string) error {
 		return ErrSessionNotFound
 	}
 	
-	session.UpdatedAt = time.Now()
+	now := time.Now()
+	session.UpdatedAt = now
+	session.ExpiresAt = now.Add(ttl)
+	m.lru.MoveToFront(m.elements[id])
 	return nil
 }
 
 // Cleanup removes expired sessions
 func (m *MemoryStore) Cleanup() error {
+	_, err := m.CleanupExpired()
+	return err
+}
+
+// CleanupExpired removes expired sessions and returns how many were removed
+func (m *MemoryStore) CleanupExpired() (int, error) {
 	m.mu.Lock()
 	defer m.mu.Unlock()
-	
+
+	removed := 0
 	now := time.Now()
 	for id, session := range m.sessions {
 		if now.After(session.ExpiresAt) {
-			delete(m.sessions, id)
+			m.remove(id)
+			removed++
 		}
 	}
-	
-	return nil
+
+	return removed, nil
+}
+
+// Len returns the number of sessions currently held, including expired
+// ones that haven't been cleaned up yet
+func (m *MemoryStore) Len() int {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	return len(m.sessions)
+}
+
+// remove deletes a session and its LRU entry; the caller must hold the lock
+func (m *MemoryStore) remove(id string) {
+	if elem, exists := m.elements[id]; exists {
+		m.lru.Remove(elem)
+		delete(m.elements, id)
+	}
+	delete(m.sessions, id)
 }
 
 // startCleanup runs periodic cleanup
-func (m *MemoryStore) startCleanup(interval time.Duration) {
+func (m *MemoryStore) startCleanup(ctx context.Context, interval time.Duration) {
 	ticker := time.NewTicker(interval)
 	defer ticker.Stop()
 	
 	for {
 		select {
 		case <-ticker.C:
-			m.Cleanup()
+			removed, _ := m.CleanupExpired()
+			if m.onCleanup != nil {
+				m.onCleanup(removed)
+			} else if removed > 0 {
+				log.Printf("session: cleanup removed %d expired sessions", removed)
+			}
 		case <-m.stopCh:
 			return
+		case <-ctx.Done():
+			return
 		}
 	}
 }
 
-// Close stops the cleanup goroutine
+// Close stops the cleanup goroutine and writes the snapshot if configured.
+// Calling it again does nothing.
 func (m *MemoryStore) Close() error {
-	close(m.stopCh)
-	return nil
+	var err error
+	m.closeOnce.Do(func() {
+		close(m.stopCh)
+
+		if m.snapshotPath != "" {
+			err = m.saveSnapshot()
+		}
+	})
+	return err
 }
 
 // CookieStore implements cookie-based session storage
 type CookieStore struct {
 	// Cookie sessions are stored entirely in the cookie
 	// This store just validates and manages cookie data
-	maxAge time.Duration
+	maxAge    time.Duration
+	secretKey []byte
+	encoding  string
+	aeads     []cipher.AEAD // Current encryption key first, then old keys
+}
+
+// Session encodings for the cookie store and RedisStore
+const (
+	// EncodingJSON encodes sessions as JSON (in standard base64 for cookies),
+	// readable by other languages
+	EncodingJSON = "json"
+	// EncodingGob encodes sessions with encoding/gob (in raw URL base64 for
+	// cookies). It keeps Go types (an int stays an int), but custom types
+	// stored in the session must be registered with gob.Register. It is not
+	// smaller or faster than JSON, since every value carries its type.
+	EncodingGob = "gob"
+)
+
+func init() {
+	// Flash messages and decoded JSON values are stored as these types
+	gob.Register(map[string]interface{}{})
+	gob.Register([]interface{}{})
+}
+
+// CookieConfig holds cookie store configuration
+type CookieConfig struct {
+	MaxAge    time.Duration
+	SecretKey []byte // Key used to sign payloads (required)
+	Encoding  string // EncodingJSON (default) or EncodingGob
+
+	// EncryptionKey (optional) encrypts payloads with AES-GCM so clients can't
+	// read them. It must be 16, 24 or 32 bytes (AES-128, -192 or -256).
+	EncryptionKey []byte
+	// OldEncryptionKeys are still accepted when decoding, to rotate keys
+	// without logging everyone out. New cookies always use EncryptionKey.
+	OldEncryptionKeys [][]byte
+}
+
+// NewCookieStore creates a new cookie store that signs its payloads with secretKey
+func NewCookieStore(maxAge time.Duration, secretKey []byte) *CookieStore {
+	return NewCookieStoreWithConfig(CookieConfig{
+		MaxAge:    maxAge,
+		SecretKey: secretKey,
+	})
 }
 
-// NewCookieStore creates a new cookie store
-func NewCookieStore(maxAge time.Duration) *CookieStore {
+// NewCookieStoreWithConfig creates a new cookie store from a config
+func NewCookieStoreWithConfig(config CookieConfig) *CookieStore {
+	if len(config.SecretKey) == 0 {
+		panic("cookie store secret key is required")
+	}
+
+	switch config.Encoding {
+	case "":
+		config.Encoding = EncodingJSON
+	case EncodingJSON, EncodingGob:
+	default:
+		panic("unknown cookie store encoding " + config.Encoding)
+	}
+
+	var aeads []cipher.AEAD
+	if len(config.EncryptionKey) > 0 {
+		for _, key := range append([][]byte{config.EncryptionKey}, config.OldEncryptionKeys...) {
+			aead, err := newAEAD(key)
+			if err != nil {
+				panic("invalid cookie store encryption key: " + err.Error())
+			}
+			aeads = append(aeads, aead)
+		}
+	}
+
 	return &CookieStore{
-		maxAge: maxAge,
+		maxAge:    config.MaxAge,
+		secretKey: config.SecretKey,
+		encoding:  config.Encoding,
+		aeads:     aeads,
 	}
 }
 
@@ -211,17 +600,35 @@ func (c *CookieStore) Get(cookieValue string) (*Session, error) {
 		return nil, ErrSessionNotFound
 	}
 	
-	// Decode base64
-	data, err := base64.StdEncoding.DecodeString(cookieValue)
+	// Verify signature before trusting the payload
+	payload, err := verifyValue(cookieValue, c.secretKey)
 	if err != nil {
 		return nil, err
 	}
 	
-	// Unmarshal JSON
+	data, err := c.payloadEncoding().DecodeString(payload)
+	if err != nil {
+		return nil, err
+	}
+
+	if c.aeads != nil {
+		if data, err = decrypt(data, c.aeads); err != nil {
+			return nil, err
+		}
+	}
+
 	var session Session
-	if err := json.Unmarshal(data, &session); err != nil {
+	if c.encoding == EncodingGob {
+		err = gob.NewDecoder(bytes.NewReader(data)).Decode(&session)
+	} else {
+		err = json.Unmarshal(data, &session)
+	}
+	if err != nil {
 		return nil, err
 	}
+	if session.Data == nil {
+		session.Data = make(map[string]interface{})
+	}
 	
 	if session.IsExpired() {
 		return nil, ErrSessionExpired
@@ -240,8 +647,8 @@ func (c *CookieStore) Delete(id string) error {
 	return nil
 }
 
-// Touch updates the session
-func (c *CookieStore) Touch(id string) error {
+// Touch is a no-op for cookie store
+func (c *CookieStore) Touch(id string, ttl time.Duration) error {
 	return nil
 }
 
@@ -252,19 +659,53 @@ func (c *CookieStore) Cleanup() error {
 
 // Encode encodes a session to cookie format
 func (c *CookieStore) Encode(session *Session) (string, error) {
-	// Marshal to JSON
-	data, err := json.Marshal(session)
+	var (
+		data []byte
+		err  error
+	)
+	if c.encoding == EncodingGob {
+		var buf bytes.Buffer
+		err = gob.NewEncoder(&buf).Encode(session)
+		data = buf.Bytes()
+	} else {
+		data, err = json.Marshal(session)
+	}
 	if err != nil {
 		return "", err
 	}
-	
-	// Encode to base64
-	return base64.StdEncoding.EncodeToString(data), nil
+
+	if c.aeads != nil {
+		if data, err = encrypt(data, c.aeads[0]); err != nil {
+			return "", err
+		}
+	}
+
+	// Encode to base64 and sign
+	return signValue(c.payloadEncoding().EncodeToString(data), c.secretKey), nil
+}
+
+// payloadEncoding returns the base64 variant for payloads: standard base64
+// for plain JSON, for interop, and the more compact raw URL base64 otherwise
+func (c *CookieStore) payloadEncoding() *base64.Encoding {
+	if c.encoding == EncodingJSON && c.aeads == nil {
+		return base64.StdEncoding
+	}
+	return base64.RawURLEncoding
 }
 
 // generateSessionID generates a random session ID
-func generateSessionID() string {
+func generateSessionID() (string, error) {
 	b := make([]byte, 32)
-	rand.Read(b)
-	return base64.URLEncoding.EncodeToString(b)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return base64.URLEncoding.EncodeToString(b), nil
+}
+
+// checkDataSize returns ErrSessionTooLarge when size exceeds max (0 = unlimited)
+func checkDataSize(size, max int) error {
+	if max > 0 && size > max {
+		return fmt.Errorf("%w: %d bytes (max %d)", ErrSessionTooLarge, size, max)
+	}
+	return nil
 }
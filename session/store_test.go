@@ -0,0 +1,376 @@
+package session
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"reflect"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+)
+
+// newFlashSession returns a session holding flash messages and nested
+// JSON-like values, the types gob has to be told about
+func newFlashSession() *Session {
+	sess := NewSession(time.Hour)
+	sess.Set(flashNewKey, map[string]interface{}{
+		"notice": "saved",
+		"errors": []interface{}{"name is required", "email is invalid"},
+	})
+	sess.Set("prefs", map[string]interface{}{
+		"theme": "dark",
+		"tags":  []interface{}{"a", "b"},
+	})
+	return sess
+}
+
+func TestCookieStoreGobRoundTrip(t *testing.T) {
+	store := NewCookieStoreWithConfig(CookieConfig{
+		MaxAge:    time.Hour,
+		SecretKey: []byte("test-secret"),
+		Encoding:  EncodingGob,
+	})
+
+	sess := newFlashSession()
+	value, err := store.Encode(sess)
+	if err != nil {
+		t.Fatalf("Encode: %v", err)
+	}
+
+	got, err := store.Get(value)
+	if err != nil {
+		t.Fatalf("Get: %v", err)
+	}
+	if !reflect.DeepEqual(got.Data, sess.Data) {
+		t.Errorf("Data = %#v, want %#v", got.Data, sess.Data)
+	}
+}
+
+func TestMemoryStoreConcurrentAccess(t *testing.T) {
+	store := NewMemoryStore(0)
+	sess := NewSessionWithID("shared", time.Hour)
+	sess.Set("prefs", map[string]interface{}{"theme": "dark"})
+	if err := store.Set(sess); err != nil {
+		t.Fatalf("Set: %v", err)
+	}
+
+	// Every goroutine loads the session before any of them changes it, then
+	// mutates its copy, including nested maps; run with -race to catch
+	// copies that share state
+	const workers = 32
+	var loaded, wg sync.WaitGroup
+	loaded.Add(workers)
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			got, err := store.Get("shared")
+			loaded.Done()
+			if err != nil {
+				t.Errorf("Get: %v", err)
+				return
+			}
+			loaded.Wait()
+
+			got.Set("counter", i)
+			got.Data["prefs"].(map[string]interface{})["theme"] = strconv.Itoa(i)
+			if err := store.Set(got); err != nil {
+				t.Errorf("Set: %v", err)
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	// The caller's original session must not have been touched
+	if theme := sess.Data["prefs"].(map[string]interface{})["theme"]; theme != "dark" {
+		t.Errorf("original session theme = %v, want dark", theme)
+	}
+}
+
+func TestMemoryStoreGetReturnsCopy(t *testing.T) {
+	store := NewMemoryStore(0)
+	if err := store.Set(NewSessionWithID("sid", time.Hour)); err != nil {
+		t.Fatalf("Set: %v", err)
+	}
+
+	got, err := store.Get("sid")
+	if err != nil {
+		t.Fatalf("Get: %v", err)
+	}
+	got.Set("user", "alice")
+
+	stored, err := store.Get("sid")
+	if err != nil {
+		t.Fatalf("Get: %v", err)
+	}
+	if _, ok := stored.Get("user"); ok {
+		t.Error("change to a loaded session was visible before Set")
+	}
+}
+
+func TestMemoryStoreEvictsLeastRecentlyUsed(t *testing.T) {
+	store := NewMemoryStoreWithConfig(MemoryConfig{MaxSessions: 3})
+	for _, id := range []string{"a", "b", "c"} {
+		if err := store.Set(NewSessionWithID(id, time.Hour)); err != nil {
+			t.Fatalf("Set(%s): %v", id, err)
+		}
+	}
+
+	// Reading "a" makes "b" the least recently used
+	if _, err := store.Get("a"); err != nil {
+		t.Fatalf("Get(a): %v", err)
+	}
+	if err := store.Set(NewSessionWithID("d", time.Hour)); err != nil {
+		t.Fatalf("Set(d): %v", err)
+	}
+
+	if n := store.Len(); n != 3 {
+		t.Errorf("Len = %d, want 3", n)
+	}
+	if _, err := store.Get("b"); err != ErrSessionNotFound {
+		t.Errorf("Get(b) error = %v, want ErrSessionNotFound", err)
+	}
+	for _, id := range []string{"a", "c", "d"} {
+		if _, err := store.Get(id); err != nil {
+			t.Errorf("Get(%s): %v", id, err)
+		}
+	}
+}
+
+func TestMemoryStoreRejectWhenFull(t *testing.T) {
+	store := NewMemoryStoreWithConfig(MemoryConfig{MaxSessions: 2, RejectWhenFull: true})
+	for _, id := range []string{"a", "b"} {
+		if err := store.Set(NewSessionWithID(id, time.Hour)); err != nil {
+			t.Fatalf("Set(%s): %v", id, err)
+		}
+	}
+
+	if err := store.Set(NewSessionWithID("c", time.Hour)); err != ErrStoreFull {
+		t.Errorf("Set(c) error = %v, want ErrStoreFull", err)
+	}
+	// Updating a stored session doesn't need room
+	if err := store.Set(NewSessionWithID("a", time.Hour)); err != nil {
+		t.Errorf("Set(a) update: %v", err)
+	}
+	if _, err := store.Get("a"); err != nil {
+		t.Errorf("Get(a): %v", err)
+	}
+	if _, err := store.Get("b"); err != nil {
+		t.Errorf("Get(b): %v", err)
+	}
+}
+
+func TestMemoryStoreCleanupExpired(t *testing.T) {
+	store := NewMemoryStore(0)
+	for _, sess := range []*Session{
+		NewSessionWithID("live", time.Hour),
+		NewSessionWithID("expired-1", -time.Minute),
+		NewSessionWithID("expired-2", -time.Minute),
+	} {
+		if err := store.Set(sess); err != nil {
+			t.Fatalf("Set: %v", err)
+		}
+	}
+	if n := store.Len(); n != 3 {
+		t.Errorf("Len = %d, want 3 before cleanup", n)
+	}
+
+	removed, err := store.CleanupExpired()
+	if err != nil || removed != 2 {
+		t.Errorf("CleanupExpired = %d, %v; want 2", removed, err)
+	}
+	if n := store.Len(); n != 1 {
+		t.Errorf("Len = %d, want 1 after cleanup", n)
+	}
+	if removed, _ := store.CleanupExpired(); removed != 0 {
+		t.Errorf("second CleanupExpired = %d, want 0", removed)
+	}
+}
+
+func TestMemoryStoreOnCleanup(t *testing.T) {
+	counts := make(chan int, 10)
+	store := NewMemoryStoreWithConfig(MemoryConfig{
+		CleanupInterval: 10 * time.Millisecond,
+		OnCleanup: func(removed int) {
+			select {
+			case counts <- removed:
+			default:
+			}
+		},
+	})
+	defer store.Close()
+
+	if err := store.Set(NewSessionWithID("expired", -time.Minute)); err != nil {
+		t.Fatalf("Set: %v", err)
+	}
+
+	// Ticks before the Set report nothing removed
+	timeout := time.After(time.Second)
+	for {
+		select {
+		case removed := <-counts:
+			if removed == 0 {
+				continue
+			}
+			if removed != 1 {
+				t.Errorf("OnCleanup got %d, want 1", removed)
+			}
+			return
+		case <-timeout:
+			t.Fatal("OnCleanup did not report the expired session")
+		}
+	}
+}
+
+type testCart struct {
+	Items []string `json:"items"`
+	Total int      `json:"total"`
+}
+
+func TestSessionUnmarshal(t *testing.T) {
+	sess := NewSession(time.Hour)
+	cart := testCart{Items: []string{"book", "pen"}, Total: 12}
+	sess.Set("cart", cart)
+	sess.Set("count", 3)
+
+	// Values read straight from memory keep their type
+	var got testCart
+	if err := sess.Unmarshal("cart", &got); err != nil || !reflect.DeepEqual(got, cart) {
+		t.Errorf("Unmarshal = %+v, %v; want %+v", got, err, cart)
+	}
+
+	// After a JSON round-trip through a store they are generic maps and floats
+	data, err := json.Marshal(sess)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var loaded Session
+	if err := json.Unmarshal(data, &loaded); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := loaded.Data["cart"].(map[string]interface{}); !ok {
+		t.Fatalf("cart decoded as %T, want a generic map", loaded.Data["cart"])
+	}
+
+	got = testCart{}
+	if err := loaded.Unmarshal("cart", &got); err != nil || !reflect.DeepEqual(got, cart) {
+		t.Errorf("Unmarshal after JSON = %+v, %v; want %+v", got, err, cart)
+	}
+	var count int
+	if err := loaded.Unmarshal("count", &count); err != nil || count != 3 {
+		t.Errorf("Unmarshal count = %d, %v; want 3", count, err)
+	}
+
+	if err := loaded.Unmarshal("missing", &got); err != ErrKeyNotFound {
+		t.Errorf("Unmarshal of a missing key = %v, want ErrKeyNotFound", err)
+	}
+	if err := loaded.Unmarshal("cart", got); err == nil {
+		t.Error("Unmarshal into a non-pointer returned no error")
+	}
+}
+
+func TestMemoryStoreCloseTwice(t *testing.T) {
+	store := NewMemoryStore(time.Minute)
+	if err := store.Close(); err != nil {
+		t.Fatalf("Close: %v", err)
+	}
+	if err := store.Close(); err != nil {
+		t.Fatalf("second Close: %v", err)
+	}
+}
+
+func TestMemoryStoreContextStopsCleanup(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	ticks := make(chan int, 100)
+	store := newMemoryStore(ctx, MemoryConfig{
+		CleanupInterval: 5 * time.Millisecond,
+		OnCleanup: func(removed int) {
+			select {
+			case ticks <- removed:
+			default:
+			}
+		},
+	})
+	defer store.Close()
+
+	select {
+	case <-ticks:
+	case <-time.After(time.Second):
+		t.Fatal("cleanup never ran")
+	}
+
+	cancel()
+	// Let a cleanup that was already running finish
+	time.Sleep(20 * time.Millisecond)
+	for len(ticks) > 0 {
+		<-ticks
+	}
+
+	select {
+	case <-ticks:
+		t.Error("cleanup still running after the context was cancelled")
+	case <-time.After(50 * time.Millisecond):
+	}
+}
+
+func TestGetBytesRoundTrip(t *testing.T) {
+	raw := []byte{0x00, 0xff, 0x10, 'c', 'a', 'r', 't', 0x80}
+
+	roundTrips := map[string]func(t *testing.T, sess *Session) *Session{
+		"memory": func(t *testing.T, sess *Session) *Session {
+			store := NewMemoryStore(0)
+			if err := store.Set(sess); err != nil {
+				t.Fatal(err)
+			}
+			got, err := store.Get(sess.ID)
+			if err != nil {
+				t.Fatal(err)
+			}
+			return got
+		},
+	}
+	for _, encoding := range []string{EncodingJSON, EncodingGob} {
+		roundTrips["redis "+encoding] = func(t *testing.T, sess *Session) *Session {
+			store, _ := newTestRedisStore(t, RedisConfig{Encoding: encoding})
+			if err := store.Set(sess); err != nil {
+				t.Fatal(err)
+			}
+			got, err := store.Get(sess.ID)
+			if err != nil {
+				t.Fatal(err)
+			}
+			return got
+		}
+		roundTrips["cookie "+encoding] = func(t *testing.T, sess *Session) *Session {
+			store := NewCookieStoreWithConfig(CookieConfig{MaxAge: time.Hour, SecretKey: testSecret, Encoding: encoding})
+			value, err := store.Encode(sess)
+			if err != nil {
+				t.Fatal(err)
+			}
+			got, err := store.Get(value)
+			if err != nil {
+				t.Fatal(err)
+			}
+			return got
+		}
+	}
+
+	for name, roundTrip := range roundTrips {
+		t.Run(name, func(t *testing.T) {
+			sess := NewSession(time.Hour)
+			sess.Set("cart", raw)
+			sess.Set("name", "alice")
+
+			got := roundTrip(t, sess)
+			data, ok := got.GetBytes("cart")
+			if !ok || !bytes.Equal(data, raw) {
+				t.Errorf("GetBytes = %v, %v; want %v", data, ok, raw)
+			}
+			if _, ok := got.GetBytes("missing"); ok {
+				t.Error("GetBytes found a missing key")
+			}
+		})
+	}
+}
@@ -0,0 +1,48 @@
+package session
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// tracerName identifies spans created by this package
+const tracerName = "github.com/abreed05/goexpress-redis/session"
+
+// startSpan starts a span for a store operation, or does nothing when tracing is disabled
+func (r *RedisStore) startSpan(ctx context.Context, name, id string) (context.Context, trace.Span) {
+	if r.tracer == nil {
+		return ctx, nil
+	}
+
+	return r.tracer.Start(ctx, name,
+		trace.WithSpanKind(trace.SpanKindClient),
+		trace.WithAttributes(
+			attribute.String("db.system", "redis"),
+			attribute.String("session.id_hash", hashID(id)),
+		),
+	)
+}
+
+// endSpan records the outcome of a store operation and ends its span
+func endSpan(span trace.Span, err error) {
+	if span == nil {
+		return
+	}
+
+	if err != nil && err != ErrSessionNotFound && err != ErrSessionExpired {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	span.End()
+}
+
+// hashID hashes a session ID so span attributes never carry the raw token
+func hashID(id string) string {
+	sum := sha256.Sum256([]byte(id))
+	return hex.EncodeToString(sum[:8])
+}